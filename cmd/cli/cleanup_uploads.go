@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+var cleanupUploadsCmd = &cobra.Command{
+	Use:   "cleanup-uploads",
+	Short: "Remove leftovers of abandoned uploads",
+	Long:  "Remove chunk directories, unfinished tus uploads and temp files older than a maximum age",
+	Run:   runCleanupUploads,
+}
+
+var (
+	cleanupDryRun     bool
+	cleanupStorageDir string
+	cleanupMaxAge     time.Duration
+)
+
+func init() {
+	cleanupUploadsCmd.Flags().BoolVar(&cleanupDryRun, "dry-run", false, "Show what would be removed without making changes")
+	cleanupUploadsCmd.Flags().StringVar(&cleanupStorageDir, "storage-dir", "", "Storage directory path (default from server configuration)")
+	cleanupUploadsCmd.Flags().DurationVar(&cleanupMaxAge, "max-age", 24*time.Hour, "Remove leftovers not modified for this long")
+	rootCmd.AddCommand(cleanupUploadsCmd)
+}
+
+func runCleanupUploads(cmd *cobra.Command, args []string) {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if cleanupStorageDir == "" {
+		cleanupStorageDir = cfg.StorageDir
+	}
+
+	// Initialize database
+	db, err := repository.InitDB(cfg.DatabasePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing database: %v\n", err)
+		os.Exit(1)
+	}
+
+	appLogger := logger.New(logger.WARN, os.Stderr)
+	defer appLogger.Close()
+
+	janitor := service.NewJanitor(cleanupStorageDir, repository.NewTusUploadRepository(db), appLogger)
+	report, err := janitor.Sweep(cleanupMaxAge, cleanupDryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error cleaning up uploads: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(report.Items) == 0 {
+		fmt.Printf("No upload leftovers older than %s\n", cleanupMaxAge)
+		return
+	}
+
+	for _, item := range report.Items {
+		fmt.Printf("  %-10s %12d bytes  %s  %s\n", item.Kind, item.Size, item.ModTime.Format(time.RFC3339), item.Path)
+	}
+
+	fmt.Println()
+	if cleanupDryRun {
+		fmt.Printf("Would remove %d items (%d bytes)\n", len(report.Items), report.Bytes)
+		return
+	}
+	fmt.Printf("Removed %d items (%d bytes)\n", len(report.Items)-report.Failed, report.Bytes)
+	if report.Failed > 0 {
+		fmt.Printf("Failed to remove %d items\n", report.Failed)
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,7 +8,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
 	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
 )
 
 var (
@@ -56,16 +57,30 @@ func runFixPhotoTimes(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	// Create photo repository for the user
-	photoRepo := repository.NewPhotoRepository(db, userID)
-
-	// Get all photos for the user
-	photos, err := photoRepo.GetAll()
+	// Photos are kept in one library per device of the user
+	naming := service.NewPhotoNaming()
+	devices, err := repository.NewDeviceRepository(db).ListByUserID(userID)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting photos: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error getting devices: %v\n", err)
 		os.Exit(1)
 	}
 
+	// Get all photos for the user, with the repository of the library each is in
+	var photos []models.Photo
+	var photoRepos []*repository.PhotoRepository
+	for i := range devices {
+		photoRepo := repository.NewPhotoRepository(db, &devices[i], naming)
+		devicePhotos, err := photoRepo.GetAll()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting photos: %v\n", err)
+			os.Exit(1)
+		}
+		for range devicePhotos {
+			photoRepos = append(photoRepos, photoRepo)
+		}
+		photos = append(photos, devicePhotos...)
+	}
+
 	if len(photos) == 0 {
 		fmt.Println("No photos found for user")
 		return
@@ -80,30 +95,31 @@ func runFixPhotoTimes(cmd *cobra.Command, args []string) {
 
 	fmt.Printf("Processing %d photos for user %d...\n\n", totalPhotos, userID)
 
-	for _, photo := range photos {
-		// Parse uploaded extensions
-		var extensions []string
-		if photo.UploadedExtensions != "" && photo.UploadedExtensions != "[]" {
-			if err := json.Unmarshal([]byte(photo.UploadedExtensions), &extensions); err != nil {
-				fmt.Printf("Warning: failed to parse extensions for photo %s: %v\n", photo.LocalID, err)
-				continue
-			}
+	for i, photo := range photos {
+		// Get uploaded files; edited renders and originals are stored under their own names
+		files, err := photoRepos[i].GetFiles(photo.LocalID)
+		if err != nil {
+			fmt.Printf("Warning: failed to get files for photo %s: %v\n", photo.LocalID, err)
+			continue
+		}
+		fileNames := make([]string, 0, len(files)+1)
+		for _, file := range files {
+			fileNames = append(fileNames, naming.ResourceFileName(photo.FileName, file.Role)+"."+file.Extension)
 		}
 
 		// Add the main file_type as an extension
 		if photo.FileType != "" {
-			extensions = append(extensions, photo.FileType)
+			fileNames = append(fileNames, photo.FileName+"."+photo.FileType)
 		}
 
-		if len(extensions) == 0 {
+		if len(fileNames) == 0 {
 			fmt.Printf("Warning: no extensions found for photo %s\n", photo.LocalID)
 			continue
 		}
 
-		// Process each extension
-		for _, ext := range extensions {
+		// Process each file
+		for _, fileName := range fileNames {
 			totalFiles++
-			fileName := photo.FileName + "." + ext
 			filePath := filepath.Join(storageDir, photo.FilePath, fileName)
 
 			// Check if file exists
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+var revokeSessionsCmd = &cobra.Command{
+	Use:   "revoke-sessions",
+	Short: "Revoke all sessions of a user",
+	Long:  "Revoke every token issued to a user, logging them out on all devices (a running server may accept them for up to 30 seconds)",
+	Run:   runRevokeSessions,
+}
+
+var revokeUsername string
+
+func init() {
+	revokeSessionsCmd.Flags().StringVarP(&revokeUsername, "username", "u", "", "Username whose sessions to revoke (required)")
+	revokeSessionsCmd.MarkFlagRequired("username")
+	rootCmd.AddCommand(revokeSessionsCmd)
+}
+
+func runRevokeSessions(cmd *cobra.Command, args []string) {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Initialize database
+	db, err := repository.InitDB(cfg.DatabasePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing database: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Find user
+	user, err := repository.NewUserRepository(db).FindByUsername(revokeUsername)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error finding user: %v\n", err)
+		os.Exit(1)
+	}
+	if user == nil {
+		fmt.Fprintf(os.Stderr, "Error: User '%s' not found\n", revokeUsername)
+		os.Exit(1)
+	}
+
+	// Delete the user's tokens
+	revoked, err := repository.NewTokenRepository(db).DeleteByUserID(user.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error revoking sessions: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Revoked %d sessions for user '%s'\n", revoked, user.Username)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+)
+
+var rotateJWTKeyCmd = &cobra.Command{
+	Use:   "rotate-jwt-key",
+	Short: "Rotate the JWT signing key",
+	Long:  "Add a new JWT signing key; tokens signed with the previous keys stay valid for a grace period (a running server picks up the new key within 10 seconds)",
+	Run:   runRotateJWTKey,
+}
+
+var rotateGrace time.Duration
+
+func init() {
+	rotateJWTKeyCmd.Flags().DurationVar(&rotateGrace, "grace", time.Hour, "How long the previous keys keep verifying tokens (0 retires them immediately)")
+	rootCmd.AddCommand(rotateJWTKeyCmd)
+}
+
+func runRotateJWTKey(cmd *cobra.Command, args []string) {
+	if rotateGrace < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid grace period: %s\n", rotateGrace)
+		os.Exit(1)
+	}
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load keyring
+	keyring, err := config.LoadOrCreateJWTKeyring(cfg.JWTKeyringPath, cfg.JWTSecretPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading JWT keyring: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Add the new key
+	key, err := keyring.Rotate(rotateGrace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error rotating JWT key: %v\n", err)
+		os.Exit(1)
+	}
+	if err := keyring.Save(cfg.JWTKeyringPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving JWT keyring: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("New JWT signing key: %s\n", key.ID)
+	for _, old := range keyring.Keys {
+		if old.RetiresAt != nil {
+			fmt.Printf("Key %s retires at %s\n", old.ID, old.RetiresAt.Format(time.RFC3339))
+		}
+	}
+}
@@ -10,7 +10,9 @@ import (
 
 	"github.com/ios-photo-backup/photo-backup-server/internal/config"
 	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
 	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
 	"github.com/ios-photo-backup/photo-backup-server/internal/api/routes"
 )
 
@@ -29,7 +31,7 @@ func main() {
 	}
 	appLogger.Info("Configuration loaded", logger.String("db_path", cfg.DatabasePath))
 
-	// Initialize application (create directories, JWT secret)
+	// Initialize application (create directories, JWT keyring)
 	if err := config.InitializeApp(cfg); err != nil {
 		appLogger.Error("Failed to initialize application", logger.String("error", err.Error()))
 		os.Exit(1)
@@ -56,14 +58,47 @@ func main() {
 	}
 	appLogger.Info("Database initialized", logger.String("db_path", cfg.DatabasePath))
 
+	// JWT keys, reloaded when they are rotated with the CLI
+	jwtKeys, err := config.NewJWTKeyStore(cfg.JWTKeyringPath)
+	if err != nil {
+		appLogger.Error("Failed to load JWT keyring", logger.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	// Photo changes are pushed to the event streams of connected clients
+	events := service.NewEventBroker()
+
+	// Photo storage is shared by the routes and the background jobs: uploads, trash moves
+	// and preview generation coordinate through the path locks of one FileStorage
+	naming := service.NewPhotoNaming()
+	fileStorage := service.NewFileStorage(cfg)
+	thumbnails := service.NewThumbnailService(cfg, appLogger)
+
 	// Setup routes
-	router := routes.SetupRoutes(db, cfg, appLogger)
+	router := routes.SetupRoutes(db, cfg, jwtKeys, naming, fileStorage, thumbnails, events, appLogger)
 	appLogger.Info("Routes configured")
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Periodically remove leftovers of abandoned uploads
+	janitor := service.NewJanitor(cfg.StorageDir, repository.NewTusUploadRepository(db), appLogger)
+	go janitor.Run(ctx, cfg.CleanupInterval, cfg.UploadMaxAge)
+	appLogger.Info("Upload cleanup scheduled",
+		logger.String("interval", cfg.CleanupInterval.String()),
+		logger.String("max_age", cfg.UploadMaxAge.String()))
+
+	// Periodically purge photos that have been in the trash past the retention period,
+	// and trash photos deleted from devices past their user's grace period
+	purger := service.NewTrashPurger(repository.NewUserRepository(db), repository.NewDeviceRepository(db), func(device *models.Device) *service.PhotoService {
+		return service.NewPhotoService(repository.NewPhotoRepository(db, device, naming), naming, fileStorage, thumbnails, events, cfg.StorageDir)
+	}, appLogger)
+	go purger.Run(ctx, cfg.CleanupInterval, fileStorage.TrashRetention())
+	appLogger.Info("Trash purge scheduled",
+		logger.String("interval", cfg.CleanupInterval.String()),
+		logger.Int("retention_days", cfg.TrashRetentionDays))
+
 	// Handle shutdown signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
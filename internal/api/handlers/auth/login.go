@@ -1,6 +1,7 @@
 package auth
 
 import (
+	stderrors "errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -26,6 +27,12 @@ func LoginHandler(authService *service.AuthService, appLogger *logger.Logger) gi
 
 		// Authenticate user
 		resp, err := authService.Login(&req)
+		var invalid *service.ValidationError
+		if stderrors.As(err, &invalid) {
+			appLogger.Warn("Invalid login request", logger.String("error", err.Error()))
+			errors.BadRequest(c, invalid.Error(), gin.H{"field": invalid.Field})
+			return
+		}
 		if err != nil {
 			appLogger.Auth(req.Username, "login", false)
 			errors.Unauthorized(c, err.Error())
@@ -36,8 +43,11 @@ func LoginHandler(authService *service.AuthService, appLogger *logger.Logger) gi
 
 		// Return success
 		c.JSON(http.StatusOK, gin.H{
-			"token":      resp.Token,
-			"expires_at": resp.ExpiresAt,
+			"token":              resp.Token,
+			"expires_at":         resp.ExpiresAt,
+			"refresh_token":      resp.RefreshToken,
+			"refresh_expires_at": resp.RefreshExpiresAt,
+			"device":             resp.Device,
 		})
 	}
 }
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// LogoutHandler revokes the token the request was made with
+func LogoutHandler(tokenService *service.TokenService, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get token from context (set by JWTMiddleware)
+		token := c.GetString(middleware.TokenKey)
+		if token == "" {
+			appLogger.Info("Logout without token in context")
+			errors.Unauthorized(c, "Token not found")
+			return
+		}
+		username, _ := middleware.GetUsername(c)
+
+		if err := tokenService.Logout(token); err != nil {
+			appLogger.Error("Logout failed",
+				logger.String("username", username),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, "Failed to log out", nil)
+			return
+		}
+
+		appLogger.Auth(username, "logout", true)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": "Logged out",
+		})
+	}
+}
+
+// LogoutAllHandler revokes every token of the user, logging out all devices
+func LogoutAllHandler(tokenService *service.TokenService, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Logout all without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+		username, _ := middleware.GetUsername(c)
+
+		revoked, err := tokenService.LogoutAll(userID)
+		if err != nil {
+			appLogger.Error("Logout all failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, "Failed to log out", nil)
+			return
+		}
+
+		appLogger.Auth(username, "logout_all", true)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": "Logged out on all devices",
+			"revoked": revoked,
+		})
+	}
+}
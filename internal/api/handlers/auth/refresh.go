@@ -1,10 +1,14 @@
 package auth
 
 import (
+	stderrors "errors"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
 	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
 	"github.com/ios-photo-backup/photo-backup-server/internal/service"
 )
@@ -12,37 +16,53 @@ import (
 // RefreshHandler handles token refresh requests
 func RefreshHandler(tokenService *service.TokenService, appLogger *logger.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get token from context (set by JWTMiddleware)
-		token, exists := c.Get("token")
-		if !exists {
-			appLogger.Info("Token refresh without token in context")
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":   "unauthorized",
-				"message": "Token not found",
-			})
-			return
+		var req service.RefreshRequest
+
+		// A client holding only a token issued before refresh tokens sends it as a Bearer token instead,
+		// possibly without a body
+		bearer := ""
+		if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			bearer = strings.TrimPrefix(header, "Bearer ")
 		}
 
-		tokenString, ok := token.(string)
-		if !ok {
-			appLogger.Info("Token refresh with invalid token format")
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":   "unauthorized",
-				"message": "Invalid token format",
-			})
+		// Bind request
+		if err := c.ShouldBindJSON(&req); err != nil && !(bearer != "" && stderrors.Is(err, io.EOF)) {
+			appLogger.Warn("Invalid refresh request", logger.String("error", err.Error()))
+			errors.BadRequest(c, "Invalid request format", err.Error())
 			return
 		}
+		if req.RefreshToken == "" && bearer == "" {
+			appLogger.Info("Token refresh without refresh token")
+			errors.BadRequest(c, "refresh_token is required", gin.H{"field": "refresh_token"})
+			return
+		}
+
+		var resp *service.TokenPair
+		var err error
+		if req.RefreshToken != "" {
+			appLogger.Info("Token refresh request")
 
-		appLogger.Info("Token refresh request")
+			// Exchange the refresh token for new tokens
+			resp, err = tokenService.Refresh(req.RefreshToken)
+		} else {
+			appLogger.Info("Legacy token exchange request")
 
-		// Refresh token (still needs db operations: delete old, save new)
-		resp, err := tokenService.Refresh(tokenString)
+			// Exchange the legacy token, once, for the tokens of a new session
+			resp, err = tokenService.ExchangeLegacyToken(bearer)
+		}
+		if stderrors.Is(err, service.ErrRefreshTokenReused) {
+			appLogger.Warn("Refresh token reused, session revoked")
+			errors.Unauthorized(c, err.Error())
+			return
+		}
+		if stderrors.Is(err, service.ErrRefreshTokenInvalid) || stderrors.Is(err, service.ErrLegacyTokenInvalid) {
+			appLogger.Info("Token refresh failed", logger.String("error", err.Error()))
+			errors.Unauthorized(c, err.Error())
+			return
+		}
 		if err != nil {
-			appLogger.Warn("Token refresh failed", logger.String("error", err.Error()))
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":   "unauthorized",
-				"message": err.Error(),
-			})
+			appLogger.Error("Token refresh failed", logger.String("error", err.Error()))
+			errors.InternalError(c, "Failed to refresh token", nil)
 			return
 		}
 
@@ -50,8 +70,10 @@ func RefreshHandler(tokenService *service.TokenService, appLogger *logger.Logger
 
 		// Return success
 		c.JSON(http.StatusOK, gin.H{
-			"token":      resp.Token,
-			"expires_at": resp.ExpiresAt,
+			"token":              resp.Token,
+			"expires_at":         resp.ExpiresAt,
+			"refresh_token":      resp.RefreshToken,
+			"refresh_expires_at": resp.RefreshExpiresAt,
 		})
 	}
 }
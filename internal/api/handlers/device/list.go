@@ -0,0 +1,44 @@
+package device
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// ListHandler lists the user's devices with the stats of their photo libraries
+func ListHandler(deviceService *service.DeviceService, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user and device from middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Device list request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+		current, ok := middleware.GetDevice(c)
+		if !ok {
+			appLogger.Warn("Device list request without device in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		devices, err := deviceService.ListDevices(userID, current.ID)
+		if err != nil {
+			appLogger.Error("Device list failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, "Failed to list devices", nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"devices": devices,
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package photo
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// requestDevice returns the device the request comes from, whose photo library it changes
+func requestDevice(c *gin.Context) (*models.Device, bool) {
+	device, ok := middleware.GetDevice(c)
+	if !ok {
+		errors.Unauthorized(c, "Invalid token claims")
+		return nil, false
+	}
+	return device, true
+}
+
+// libraryDevice returns the device whose photo library a read request browses:
+// the user's device given by the device_id query parameter, or else the device the request comes from
+func libraryDevice(c *gin.Context, db *gorm.DB, userID uint) (*models.Device, bool) {
+	param := c.Query("device_id")
+	if param == "" {
+		return requestDevice(c)
+	}
+	deviceID, err := strconv.ParseUint(param, 10, 32)
+	if err != nil || deviceID == 0 {
+		errors.BadRequest(c, "Invalid device_id, expected a device ID", gin.H{"field": "device_id"})
+		return nil, false
+	}
+
+	device, err := repository.NewDeviceRepository(db).FindByID(userID, uint(deviceID))
+	if err != nil {
+		errors.InternalError(c, err.Error(), nil)
+		return nil, false
+	}
+	if device == nil {
+		errors.NotFound(c, service.ErrDeviceNotFound.Error())
+		return nil, false
+	}
+	return device, true
+}
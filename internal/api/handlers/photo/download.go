@@ -0,0 +1,81 @@
+package photo
+
+import (
+	stderrors "errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// DownloadHandlerWithDeps streams a stored photo file back to its owner
+// Supports Range, If-None-Match and If-Modified-Since via http.ServeContent
+func DownloadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Photo download request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the device library being browsed
+		device, ok := libraryDevice(c, db, userID)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		localID := c.Param("local_id")
+		ext := strings.ToLower(c.Param("ext"))
+
+		photoFile, err := photoService.OpenPhotoFile(localID, c.Query("role"), ext)
+		if err != nil {
+			if stderrors.Is(err, service.ErrPhotoNotFound) || stderrors.Is(err, service.ErrFileNotFound) {
+				appLogger.Info("Photo download target not found",
+					logger.Uint("user_id", userID),
+					logger.String("local_id", localID),
+					logger.String("file_extension", ext))
+				errors.NotFound(c, err.Error())
+				return
+			}
+			if respondValidationError(c, err) {
+				return
+			}
+			appLogger.Error("Photo download failed",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+		defer photoFile.File.Close()
+
+		appLogger.Info("Downloading photo",
+			logger.Uint("user_id", userID),
+			logger.String("local_id", localID),
+			logger.String("file_extension", ext),
+			logger.String("range", c.GetHeader("Range")))
+
+		// Validator derived from size and mtime (mtime is the photo's creation time)
+		modTime := photoFile.Info.ModTime()
+		c.Header("ETag", fmt.Sprintf(`"%x-%x"`, photoFile.Info.Size(), modTime.UnixNano()))
+		c.Header("Cache-Control", "private, no-cache")
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": photoFile.FileName}))
+
+		http.ServeContent(c.Writer, c.Request, photoFile.FileName, modTime, photoFile.File)
+	}
+}
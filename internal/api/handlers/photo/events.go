@@ -0,0 +1,91 @@
+package photo
+
+import (
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// eventKeepAliveInterval is how often an idle event stream sends a comment,
+// so proxies and clients do not time out the connection
+const eventKeepAliveInterval = 30 * time.Second
+
+// EventsHandler streams the user's photo changes as Server-Sent Events until the client disconnects
+// The stream ends when the token it was opened with expires or is revoked, checked on every keep-alive
+func EventsHandler(events *service.EventBroker, tokenService *service.TokenService, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Event stream request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+		token := c.GetString(middleware.TokenKey)
+		expiresAt, ok := middleware.GetTokenExpiresAt(c)
+		if token == "" || !ok {
+			appLogger.Warn("Event stream request without token expiry in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		stream, unsubscribe := events.Subscribe(userID)
+		defer unsubscribe()
+
+		appLogger.Info("Event stream opened", logger.Uint("user_id", userID))
+
+		// Send the headers right away, so the client knows the stream is open
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Writer.WriteHeaderNow()
+		c.Writer.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAliveInterval)
+		defer keepAlive.Stop()
+		expired := time.NewTimer(time.Until(expiresAt))
+		defer expired.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case event, ok := <-stream:
+				if !ok {
+					// Dropped for falling behind; the client reconnects and resyncs
+					appLogger.Warn("Event stream dropped a slow client", logger.Uint("user_id", userID))
+					return false
+				}
+				c.SSEvent(event.Type, event)
+			case <-expired.C:
+				appLogger.Info("Event stream token expired", logger.Uint("user_id", userID))
+				return false
+			case <-keepAlive.C:
+				active, err := tokenService.IsActive(token)
+				if err != nil {
+					appLogger.Error("Event stream revocation check failed",
+						logger.Uint("user_id", userID),
+						logger.String("error", err.Error()))
+					return false
+				}
+				if !active {
+					appLogger.Info("Event stream token revoked", logger.Uint("user_id", userID))
+					return false
+				}
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return false
+				}
+			}
+			return true
+		})
+
+		appLogger.Info("Event stream closed", logger.Uint("user_id", userID))
+	}
+}
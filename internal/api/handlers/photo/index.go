@@ -14,7 +14,7 @@ import (
 )
 
 // IndexHandlerWithDeps handles photo indexing requests with dependency injection
-func IndexHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+func IndexHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get user ID from JWT middleware context
 		userID, ok := middleware.GetUserID(c)
@@ -24,11 +24,15 @@ func IndexHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage
 			return
 		}
 
-		// Create PhotoRepository for this user
-		photoRepo := repository.NewPhotoRepository(db, userID)
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
 
 		// Create PhotoService for this user
-		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, storageDir)
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
 
 		var req struct {
 			Date   string                         `json:"date" binding:"required"`
@@ -61,6 +65,12 @@ func IndexHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage
 		// Index photos
 		responses, err := photoService.IndexPhotos(userID, req.Date, req.Photos)
 		if err != nil {
+			if respondValidationError(c, err) {
+				appLogger.Warn("Photo indexing rejected",
+					logger.Uint("user_id", userID),
+					logger.String("error", err.Error()))
+				return
+			}
 			appLogger.Error("Photo indexing failed",
 				logger.Uint("user_id", userID),
 				logger.String("date", req.Date),
@@ -82,3 +92,74 @@ func IndexHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage
 		})
 	}
 }
+
+// BulkIndexHandlerWithDeps indexes photos taken on any number of dates, filing each under the date of its creation time
+func BulkIndexHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Bulk photo index request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		var req struct {
+			Photos []service.PhotoIndexRequest `json:"photos" binding:"required"`
+		}
+
+		// Bind request
+		if err := c.ShouldBindJSON(&req); err != nil {
+			appLogger.Warn("Invalid bulk photo index request",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.BadRequest(c, "Invalid request format", err.Error())
+			return
+		}
+
+		appLogger.Info("Bulk indexing photos",
+			logger.Uint("user_id", userID),
+			logger.Int("photo_count", len(req.Photos)))
+
+		results, err := photoService.BulkIndexPhotos(userID, req.Photos)
+		if err != nil {
+			if respondValidationError(c, err) {
+				return
+			}
+			appLogger.Error("Bulk photo indexing failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		failed := 0
+		for _, result := range results {
+			if result.Error != nil {
+				failed++
+			}
+		}
+
+		appLogger.Info("Bulk photo indexing complete",
+			logger.Uint("user_id", userID),
+			logger.Int("indexed_count", len(results)-failed),
+			logger.Int("failed_count", failed))
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"indexed": len(results) - failed,
+			"failed":  failed,
+			"results": results,
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package photo
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 500
+)
+
+// ListHandlerWithDeps handles photo listing requests with dependency injection
+func ListHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Photo list request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the device library being browsed
+		device, ok := libraryDevice(c, db, userID)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		req := service.PhotoListRequest{
+			FileType: c.Query("file_type"),
+			Limit:    defaultListLimit,
+		}
+
+		// Parse date range (YYYY-MM-DD, both inclusive)
+		if from := c.Query("from"); from != "" {
+			date, err := naming.ParseDate(from)
+			if err != nil {
+				errors.BadRequest(c, "Invalid from date, expected YYYY-MM-DD", nil)
+				return
+			}
+			req.From = &date
+		}
+		if to := c.Query("to"); to != "" {
+			date, err := naming.ParseDate(to)
+			if err != nil {
+				errors.BadRequest(c, "Invalid to date, expected YYYY-MM-DD", nil)
+				return
+			}
+			req.To = &date
+		}
+		if req.From != nil && req.To != nil && req.To.Before(*req.From) {
+			errors.BadRequest(c, "to date must not be before from date", nil)
+			return
+		}
+
+		// Parse sort order
+		switch c.DefaultQuery("order", "asc") {
+		case "asc":
+		case "desc":
+			req.Descending = true
+		default:
+			errors.BadRequest(c, "Invalid order, expected asc or desc", nil)
+			return
+		}
+
+		// Parse page size
+		if limitStr := c.Query("limit"); limitStr != "" {
+			limit, err := strconv.Atoi(limitStr)
+			if err != nil || limit <= 0 {
+				errors.BadRequest(c, "Invalid limit, expected a positive integer", nil)
+				return
+			}
+			if limit > maxListLimit {
+				limit = maxListLimit
+			}
+			req.Limit = limit
+		}
+
+		// Parse cursor from a previous page
+		if cursorStr := c.Query("cursor"); cursorStr != "" {
+			cursor, err := service.DecodeListCursor(cursorStr)
+			if err != nil {
+				errors.BadRequest(c, "Invalid cursor", err.Error())
+				return
+			}
+			req.Cursor = cursor
+		}
+
+		resp, err := photoService.ListPhotos(userID, req)
+		if err != nil {
+			appLogger.Error("Photo listing failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		appLogger.Info("Photo listing successful",
+			logger.Uint("user_id", userID),
+			logger.Int("photo_count", len(resp.Photos)),
+			logger.Bool("has_more", resp.HasMore))
+
+		// Return success
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "success",
+			"photos":      resp.Photos,
+			"next_cursor": resp.NextCursor,
+			"has_more":    resp.HasMore,
+		})
+	}
+}
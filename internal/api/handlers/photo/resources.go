@@ -0,0 +1,56 @@
+package photo
+
+import (
+	stderrors "errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// ResourcesHandlerWithDeps returns the uploaded files of a photo grouped by role,
+// e.g. the image and paired video of a Live Photo
+func ResourcesHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Photo resources request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the device library being browsed
+		device, ok := libraryDevice(c, db, userID)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		localID := c.Param("local_id")
+		resp, err := photoService.GetResources(localID)
+		if err != nil {
+			if stderrors.Is(err, service.ErrPhotoNotFound) {
+				errors.NotFound(c, err.Error())
+				return
+			}
+			appLogger.Error("Photo resources lookup failed",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,226 @@
+package photo
+
+import (
+	stderrors "errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// respondPolicyError maps a failure to read or change a deletion policy to an HTTP error response
+func respondPolicyError(c *gin.Context, err error) {
+	if stderrors.Is(err, service.ErrUserNotFound) {
+		errors.Unauthorized(c, err.Error())
+		return
+	}
+	if respondValidationError(c, err) {
+		return
+	}
+	errors.InternalError(c, err.Error(), nil)
+}
+
+// DeletionPolicyHandler returns the user's policy for photos deleted from the device library
+func DeletionPolicyHandler(policies *service.DeletionPolicyService, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Deletion policy request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		policy, err := policies.GetPolicy(userID)
+		if err != nil {
+			appLogger.Error("Deletion policy lookup failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			respondPolicyError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, policy)
+	}
+}
+
+// UpdateDeletionPolicyHandler changes the user's policy for photos deleted from the device library
+func UpdateDeletionPolicyHandler(policies *service.DeletionPolicyService, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Deletion policy update without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		var req struct {
+			Mode      string `json:"mode" binding:"required"`
+			GraceDays *int   `json:"grace_days"` // Unchanged if omitted
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			appLogger.Warn("Invalid deletion policy update",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.BadRequest(c, "Invalid request format", err.Error())
+			return
+		}
+
+		policy, err := policies.GetPolicy(userID)
+		if err == nil {
+			policy.Mode = req.Mode
+			if req.GraceDays != nil {
+				policy.GraceDays = *req.GraceDays
+			}
+			policy, err = policies.SetPolicy(userID, policy)
+		}
+		if err != nil {
+			appLogger.Warn("Deletion policy update failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			respondPolicyError(c, err)
+			return
+		}
+
+		appLogger.Info("Deletion policy updated",
+			logger.Uint("user_id", userID),
+			logger.String("mode", policy.Mode),
+			logger.Int("grace_days", policy.GraceDays))
+
+		c.JSON(http.StatusOK, policy)
+	}
+}
+
+// DeviceDeletionsHandlerWithDeps applies the user's deletion policy to photos the client
+// reports as deleted from the device library
+func DeviceDeletionsHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Device deletion report without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		var report service.DeviceDeletionReport
+		if err := c.ShouldBindJSON(&report); err != nil {
+			appLogger.Warn("Invalid device deletion report",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.BadRequest(c, "Invalid request format", err.Error())
+			return
+		}
+
+		policies := service.NewDeletionPolicyService(repository.NewUserRepository(db))
+		policy, err := policies.GetPolicy(userID)
+		if err != nil {
+			appLogger.Error("Deletion policy lookup failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			respondPolicyError(c, err)
+			return
+		}
+
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		resp, err := photoService.ApplyDeviceDeletions(policy, report)
+		if err != nil {
+			if respondValidationError(c, err) {
+				return
+			}
+			appLogger.Error("Device deletion report failed",
+				logger.Uint("user_id", userID),
+				logger.String("date", report.Date),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		appLogger.Info("Device deletion report applied",
+			logger.Uint("user_id", userID),
+			logger.String("date", report.Date),
+			logger.String("policy", policy.Mode),
+			logger.Int("missing", len(resp.Missing)))
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// ChangesHandlerWithDeps returns the photos created, updated or deleted after a change cursor
+func ChangesHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Changes request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Parse cursor from a previous response; omitted on the first sync
+		var since int64
+		if sinceStr := c.Query("since"); sinceStr != "" {
+			value, err := strconv.ParseInt(sinceStr, 10, 64)
+			if err != nil || value < 0 {
+				errors.BadRequest(c, "Invalid since, expected a non-negative integer", nil)
+				return
+			}
+			since = value
+		}
+
+		// Parse page size
+		limit := defaultListLimit
+		if limitStr := c.Query("limit"); limitStr != "" {
+			value, err := strconv.Atoi(limitStr)
+			if err != nil || value <= 0 {
+				errors.BadRequest(c, "Invalid limit, expected a positive integer", nil)
+				return
+			}
+			if value > maxListLimit {
+				value = maxListLimit
+			}
+			limit = value
+		}
+
+		// Create PhotoRepository for the device library being browsed
+		device, ok := libraryDevice(c, db, userID)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		resp, err := photoService.GetChanges(since, limit)
+		if err != nil {
+			if respondValidationError(c, err) {
+				return
+			}
+			appLogger.Error("Changes listing failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
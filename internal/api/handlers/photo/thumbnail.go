@@ -0,0 +1,66 @@
+package photo
+
+import (
+	stderrors "errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// ThumbnailHandlerWithDeps serves a JPEG preview of a photo, generating it on first request
+func ThumbnailHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Thumbnail request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the device library being browsed
+		device, ok := libraryDevice(c, db, userID)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		localID := c.Param("local_id")
+		size, ok := service.ParseThumbnailSize(c.DefaultQuery("size", string(service.ThumbnailSmall)))
+		if !ok {
+			errors.BadRequest(c, "Invalid size, expected small or medium", nil)
+			return
+		}
+
+		thumbnail, err := photoService.GetThumbnail(localID, size)
+		if err != nil {
+			if stderrors.Is(err, service.ErrPhotoNotFound) || stderrors.Is(err, service.ErrThumbnailUnavailable) {
+				errors.NotFound(c, err.Error())
+				return
+			}
+			appLogger.Error("Thumbnail generation failed",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		// Previews are regenerated when the source is replaced or restored, so clients revalidate every time.
+		// The validator changes with the source and with every regeneration; c.File answers a matching
+		// If-None-Match with 304
+		c.Header("ETag", fmt.Sprintf(`"%.16s-%x"`, thumbnail.SourceSHA256, thumbnail.Info.ModTime().UnixNano()))
+		c.Header("Cache-Control", "private, no-cache")
+		c.File(thumbnail.Path)
+	}
+}
@@ -0,0 +1,157 @@
+package photo
+
+import (
+	stderrors "errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// DeleteHandlerWithDeps moves a photo and its files into the user's trash
+func DeleteHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Photo delete request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		localID := c.Param("local_id")
+		trashed, err := photoService.TrashPhoto(localID)
+		if err != nil {
+			if stderrors.Is(err, service.ErrPhotoNotFound) {
+				errors.NotFound(c, err.Error())
+				return
+			}
+			if respondValidationError(c, err) {
+				return
+			}
+			appLogger.Error("Photo delete failed",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		appLogger.Info("Photo moved to trash",
+			logger.Uint("user_id", userID),
+			logger.String("local_id", localID))
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": "Photo moved to trash",
+			"photo":   trashed,
+		})
+	}
+}
+
+// TrashListHandlerWithDeps lists the photos in the user's trash
+func TrashListHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Trash list request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the device library being browsed
+		device, ok := libraryDevice(c, db, userID)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		photos, err := photoService.ListTrash()
+		if err != nil {
+			appLogger.Error("Trash listing failed",
+				logger.Uint("user_id", userID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "success",
+			"photos": photos,
+		})
+	}
+}
+
+// RestoreHandlerWithDeps moves a photo and its files out of the user's trash
+func RestoreHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Photo restore request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		localID := c.Param("local_id")
+		photo, err := photoService.RestorePhoto(localID)
+		if err != nil {
+			if stderrors.Is(err, service.ErrPhotoNotFound) {
+				errors.NotFound(c, "photo not in trash")
+				return
+			}
+			if respondValidationError(c, err) {
+				return
+			}
+			appLogger.Error("Photo restore failed",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		appLogger.Info("Photo restored from trash",
+			logger.Uint("user_id", userID),
+			logger.String("local_id", localID))
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":        "success",
+			"message":       "Photo restored",
+			"local_id":      photo.LocalID,
+			"creation_time": photo.CreationTime,
+			"file_name":     photo.FileName,
+			"file_type":     photo.FileType,
+		})
+	}
+}
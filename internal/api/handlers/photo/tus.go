@@ -0,0 +1,319 @@
+package photo
+
+import (
+	stderrors "errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// StatusTusChecksumMismatch is the tus checksum extension status for a PATCH body
+// that does not match its Upload-Checksum header
+const StatusTusChecksumMismatch = 460
+
+// tusOffsetContentType is the required content type of PATCH requests
+const tusOffsetContentType = "application/offset+octet-stream"
+
+// newTusService creates a TusService for the photo library of a device
+// Uploads are bound to the device that created them
+func newTusService(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, device *models.Device) *service.TusService {
+	photoRepo := repository.NewPhotoRepository(db, device, naming)
+	photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+	return service.NewTusService(repository.NewTusUploadRepository(db), photoService, fileStorage, storageDir)
+}
+
+// tusPrecondition sets the Tus-Resumable response header and rejects requests
+// for a protocol version other than the one implemented
+func tusPrecondition(c *gin.Context) bool {
+	c.Header("Tus-Resumable", service.TusVersion)
+	if c.GetHeader("Tus-Resumable") != service.TusVersion {
+		c.Header("Tus-Version", service.TusVersion)
+		errors.RespondWithError(c, http.StatusPreconditionFailed, errors.ErrBadRequest, "Unsupported tus version", gin.H{
+			"supported": service.TusVersion,
+		})
+		return false
+	}
+	return true
+}
+
+// respondTusError maps a tus upload failure to an HTTP error response
+func respondTusError(c *gin.Context, err error) {
+	switch {
+	case stderrors.Is(err, service.ErrUploadNotFound), stderrors.Is(err, service.ErrPhotoNotFound):
+		errors.NotFound(c, err.Error())
+	case stderrors.Is(err, service.ErrUploadOffsetMismatch):
+		errors.Conflict(c, err.Error(), nil)
+	case stderrors.Is(err, service.ErrUploadLocked):
+		errors.RespondWithError(c, http.StatusLocked, errors.ErrConflict, err.Error(), nil)
+	case stderrors.Is(err, service.ErrUploadTooLarge), stderrors.Is(err, service.ErrUploadLengthTooLarge):
+		errors.RespondWithError(c, http.StatusRequestEntityTooLarge, errors.ErrBadRequest, err.Error(), nil)
+	case stderrors.Is(err, service.ErrUploadChecksumMismatch):
+		errors.RespondWithError(c, StatusTusChecksumMismatch, errors.ErrBadRequest, err.Error(), nil)
+	default:
+		respondUploadError(c, err)
+	}
+}
+
+// TusOptionsHandler advertises the supported tus version, extensions and maximum upload size
+func TusOptionsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", service.TusVersion)
+		c.Header("Tus-Version", service.TusVersion)
+		c.Header("Tus-Extension", service.TusExtensions)
+		c.Header("Tus-Max-Size", strconv.FormatInt(service.MaxUploadSize, 10))
+		c.Header("Tus-Checksum-Algorithm", service.TusChecksumAlgorithms)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// TusCreateHandlerWithDeps creates a resumable upload for an indexed photo (tus creation extension)
+// Upload-Metadata must carry local_id and file_type; role, sha256 and device are optional
+func TusCreateHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusPrecondition(c) {
+			return
+		}
+
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Tus create request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		if c.GetHeader("Upload-Defer-Length") != "" {
+			errors.BadRequest(c, "Upload-Defer-Length is not supported", nil)
+			return
+		}
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			errors.BadRequest(c, "Upload-Length must be a non-negative integer", nil)
+			return
+		}
+		if length > service.MaxUploadSize {
+			c.Header("Tus-Max-Size", strconv.FormatInt(service.MaxUploadSize, 10))
+			errors.RespondWithError(c, http.StatusRequestEntityTooLarge, errors.ErrBadRequest, "Upload-Length exceeds the maximum upload size", gin.H{
+				"max_size": service.MaxUploadSize,
+			})
+			return
+		}
+
+		rawMetadata := c.GetHeader("Upload-Metadata")
+		metadata, err := service.ParseTusMetadata(rawMetadata)
+		if err != nil {
+			errors.BadRequest(c, err.Error(), nil)
+			return
+		}
+
+		localID := metadata["local_id"]
+		fileType := metadata["file_type"]
+		if localID == "" {
+			errors.BadRequest(c, "local_id is required in Upload-Metadata", nil)
+			return
+		}
+		if fileType == "" {
+			errors.BadRequest(c, "file_type is required in Upload-Metadata", nil)
+			return
+		}
+
+		// Use file_type as the file extension
+		ext := strings.ToLower(fileType)
+
+		expectedHash, err := expectedSHA256(c, metadata["sha256"])
+		if err != nil {
+			errors.BadRequest(c, err.Error(), nil)
+			return
+		}
+
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		tusService := newTusService(db, naming, fileStorage, thumbnails, events, storageDir, device)
+		upload, result, err := tusService.CreateUpload(userID, service.TusCreateRequest{
+			UploadRequest: service.UploadRequest{
+				LocalID:        localID,
+				Role:           metadata["role"],
+				FileExtension:  ext,
+				FileType:       fileType,
+				ExpectedSHA256: expectedHash,
+				Device:         deviceName(c, metadata["device"]),
+			},
+			Length:   length,
+			Metadata: rawMetadata,
+		})
+		if err != nil {
+			appLogger.Error("Tus upload creation failed",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.String("error", err.Error()))
+			respondTusError(c, err)
+			return
+		}
+
+		appLogger.Info("Tus upload created",
+			logger.Uint("user_id", userID),
+			logger.String("upload_id", upload.ID),
+			logger.String("local_id", localID),
+			logger.String("file_extension", ext),
+			logger.Int64("length", length))
+		if result != nil {
+			appLogger.PhotoOperation("upload_tus", localID, localID, userID, true)
+			logContentMismatch(appLogger, userID, localID, ext, result)
+		}
+
+		c.Header("Location", strings.TrimSuffix(c.FullPath(), "/")+"/"+upload.ID)
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Status(http.StatusCreated)
+	}
+}
+
+// TusHeadHandlerWithDeps reports how many bytes of an upload have been received
+func TusHeadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		if !tusPrecondition(c) {
+			return
+		}
+
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Tus head request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		tusService := newTusService(db, naming, fileStorage, thumbnails, events, storageDir, device)
+		upload, err := tusService.GetUpload(userID, c.Param("upload_id"))
+		if err != nil {
+			respondTusError(c, err)
+			return
+		}
+
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.Metadata != "" {
+			c.Header("Upload-Metadata", upload.Metadata)
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// TusPatchHandlerWithDeps appends the request body to an upload
+// The file is stored for the photo once the declared length has been received
+func TusPatchHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusPrecondition(c) {
+			return
+		}
+
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Tus patch request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		if c.ContentType() != tusOffsetContentType {
+			errors.RespondWithError(c, http.StatusUnsupportedMediaType, errors.ErrBadRequest, "Content-Type must be "+tusOffsetContentType, nil)
+			return
+		}
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			errors.BadRequest(c, "Upload-Offset must be a non-negative integer", nil)
+			return
+		}
+
+		var checksum *service.TusChecksum
+		if header := c.GetHeader("Upload-Checksum"); header != "" {
+			checksum, err = service.ParseTusChecksum(header)
+			if err != nil {
+				errors.BadRequest(c, err.Error(), gin.H{"supported": service.TusChecksumAlgorithms})
+				return
+			}
+		}
+
+		uploadID := c.Param("upload_id")
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		tusService := newTusService(db, naming, fileStorage, thumbnails, events, storageDir, device)
+		upload, result, err := tusService.WriteChunk(userID, uploadID, offset, c.Request.ContentLength, c.Request.Body, checksum)
+		if upload != nil {
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		}
+		if err != nil {
+			appLogger.Warn("Tus patch failed",
+				logger.Uint("user_id", userID),
+				logger.String("upload_id", uploadID),
+				logger.Int64("offset", offset),
+				logger.String("error", err.Error()))
+			respondTusError(c, err)
+			return
+		}
+
+		if result != nil {
+			appLogger.Info("Tus upload complete",
+				logger.Uint("user_id", userID),
+				logger.String("upload_id", uploadID),
+				logger.String("local_id", upload.LocalID),
+				logger.String("file_extension", upload.Extension),
+				logger.Int64("size", result.Size))
+			appLogger.PhotoOperation("upload_tus", upload.LocalID, upload.LocalID, userID, true)
+			logContentMismatch(appLogger, userID, upload.LocalID, upload.Extension, result)
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// TusDeleteHandlerWithDeps terminates an unfinished upload (tus termination extension)
+func TusDeleteHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusPrecondition(c) {
+			return
+		}
+
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Tus delete request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		uploadID := c.Param("upload_id")
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		tusService := newTusService(db, naming, fileStorage, thumbnails, events, storageDir, device)
+		if err := tusService.TerminateUpload(userID, uploadID); err != nil {
+			respondTusError(c, err)
+			return
+		}
+
+		appLogger.Info("Tus upload terminated",
+			logger.Uint("user_id", userID),
+			logger.String("upload_id", uploadID))
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -1,7 +1,10 @@
 package photo
 
 import (
+	"encoding/hex"
+	stderrors "errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
@@ -15,8 +18,134 @@ import (
 	"github.com/ios-photo-backup/photo-backup-server/internal/service"
 )
 
+// ContentSHA256Header carries the expected hex SHA-256 of an upload
+// The sha256 form field or query parameter may be used instead
+const ContentSHA256Header = "X-Content-SHA256"
+
+// expectedSHA256 reads the optional expected content hash from the request header,
+// falling back to the given sha256 form or query value
+func expectedSHA256(c *gin.Context, fallback string) (string, error) {
+	value := c.GetHeader(ContentSHA256Header)
+	if value == "" {
+		value = fallback
+	}
+	if value == "" {
+		return "", nil
+	}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	if decoded, err := hex.DecodeString(value); err != nil || len(decoded) != 32 {
+		return "", fmt.Errorf("sha256 must be 64 hex characters")
+	}
+	return value, nil
+}
+
+// DeviceNameHeader carries the name of the uploading device
+// The device form field or query parameter may be used instead
+const DeviceNameHeader = "X-Device-Name"
+
+// deviceName reads the optional uploading device name from the request header,
+// falling back to the given device form or query value and then to the name the device registered
+func deviceName(c *gin.Context, fallback string) string {
+	value := c.GetHeader(DeviceNameHeader)
+	if value == "" {
+		value = fallback
+	}
+	if value == "" {
+		if device, ok := middleware.GetDevice(c); ok {
+			value = device.Name
+		}
+	}
+	return strings.TrimSpace(value)
+}
+
+// respondValidationError responds with 400 if err is a rejected request parameter
+func respondValidationError(c *gin.Context, err error) bool {
+	var invalid *service.ValidationError
+	if !stderrors.As(err, &invalid) {
+		return false
+	}
+	errors.BadRequest(c, invalid.Error(), gin.H{"field": invalid.Field})
+	return true
+}
+
+// respondUploadError maps an upload failure to an HTTP error response
+func respondUploadError(c *gin.Context, err error) {
+	if respondValidationError(c, err) {
+		return
+	}
+	var mismatch *service.ChecksumMismatchError
+	if stderrors.As(err, &mismatch) {
+		errors.BadRequest(c, "Checksum mismatch, file was not stored", gin.H{
+			"expected_sha256": mismatch.Expected,
+			"actual_sha256":   mismatch.Actual,
+		})
+		return
+	}
+	var sizeMismatch *service.SizeMismatchError
+	if stderrors.As(err, &sizeMismatch) {
+		errors.BadRequest(c, "Size mismatch, file was not stored", gin.H{
+			"expected_size": sizeMismatch.Expected,
+			"actual_size":   sizeMismatch.Actual,
+		})
+		return
+	}
+	var contentMismatch *service.ContentTypeMismatchError
+	if stderrors.As(err, &contentMismatch) {
+		errors.RespondWithError(c, http.StatusUnsupportedMediaType, errors.ErrBadRequest, "Content does not match file_type, file was not stored", gin.H{
+			"file_type":          contentMismatch.Extension,
+			"detected_mime_type": contentMismatch.Detected,
+		})
+		return
+	}
+	if stderrors.Is(err, service.ErrInvalidChunkCount) {
+		errors.BadRequest(c, err.Error(), gin.H{"max_total_chunks": service.MaxUploadChunks})
+		return
+	}
+	if stderrors.Is(err, service.ErrChunkSessionConflict) || stderrors.Is(err, service.ErrResourceConflict) {
+		errors.Conflict(c, err.Error(), nil)
+		return
+	}
+	// Not indexed, or in the trash
+	if stderrors.Is(err, service.ErrPhotoNotFound) {
+		errors.NotFound(c, err.Error())
+		return
+	}
+	errors.InternalError(c, err.Error(), nil)
+}
+
+// uploadResponse builds the success response of a stored upload
+func uploadResponse(message, localID, ext string, result *service.UploadResult) gin.H {
+	return gin.H{
+		"status":           "success",
+		"message":          message,
+		"local_id":         localID,
+		"role":             result.Role,
+		"filename":         result.FileName + "." + ext,
+		"file_path":        result.FilePath,
+		"size":             result.Size,
+		"sha256":           result.SHA256,
+		"mime_type":        result.MimeType,
+		"content_mismatch": result.ContentMismatch,
+		"version":          result.Version,
+	}
+}
+
+// logContentMismatch warns about a stored file whose content does not match its extension
+func logContentMismatch(appLogger *logger.Logger, userID uint, localID, ext string, result *service.UploadResult) {
+	if !result.ContentMismatch {
+		return
+	}
+	appLogger.Warn("Uploaded content does not match file type",
+		logger.Uint("user_id", userID),
+		logger.String("local_id", localID),
+		logger.String("role", result.Role),
+		logger.String("file_extension", ext),
+		logger.String("detected_mime_type", result.MimeType))
+}
+
 // UploadHandlerWithDeps handles photo upload requests with dependency injection
-func UploadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+func UploadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get user ID from JWT middleware context
 		userID, ok := middleware.GetUserID(c)
@@ -26,11 +155,15 @@ func UploadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage
 			return
 		}
 
-		// Create PhotoRepository for this user
-		photoRepo := repository.NewPhotoRepository(db, userID)
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
 
 		// Create PhotoService for this user
-		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, storageDir)
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
 
 		// Parse multipart form
 		if err := c.Request.ParseMultipartForm(50 << 20); err != nil { // 50MB max
@@ -80,6 +213,12 @@ func UploadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage
 			return
 		}
 
+		expectedHash, err := expectedSHA256(c, c.Request.FormValue("sha256"))
+		if err != nil {
+			errors.BadRequest(c, err.Error(), nil)
+			return
+		}
+
 		appLogger.Info("Uploading photo",
 			logger.Uint("user_id", userID),
 			logger.String("local_id", localID),
@@ -102,7 +241,7 @@ func UploadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage
 
 		// Read file data
 		fileData := make([]byte, fileHeader.Size)
-		if _, err := file.Read(fileData); err != nil {
+		if _, err := io.ReadFull(file, fileData); err != nil {
 			appLogger.Error("Failed to read uploaded file",
 				logger.Uint("user_id", userID),
 				logger.String("local_id", localID),
@@ -111,44 +250,34 @@ func UploadHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage
 			return
 		}
 
-		// Upload photo with extension
-		if err := photoService.UploadPhoto(userID, localID, ext, fileType, fileData); err != nil {
+		// Upload photo with role and extension
+		result, err := photoService.UploadPhoto(userID, service.UploadRequest{
+			LocalID:        localID,
+			Role:           c.Request.FormValue("role"),
+			FileExtension:  ext,
+			FileType:       fileType,
+			ExpectedSHA256: expectedHash,
+			Device:         deviceName(c, c.Request.FormValue("device")),
+		}, fileData)
+		if err != nil {
 			appLogger.Error("Photo upload failed",
 				logger.Uint("user_id", userID),
 				logger.String("local_id", localID),
 				logger.String("error", err.Error()))
-			errors.InternalError(c, err.Error(), nil)
+			respondUploadError(c, err)
 			return
 		}
 
 		appLogger.PhotoOperation("upload", localID, localID, userID, true)
+		logContentMismatch(appLogger, userID, localID, ext, result)
 
-		// Return success with filename
-		// Build the expected filename from the indexed photo
-		photo, err := photoRepo.FindByLocalID(localID)
-		if err == nil && photo != nil {
-			// Return the actual filename with extension
-			c.JSON(http.StatusOK, gin.H{
-				"status":    "success",
-				"message":   "File uploaded",
-				"local_id":  localID,
-				"filename":  photo.FileName + "." + ext,
-				"file_path": photo.FilePath + photo.FileName + "." + ext,
-			})
-		} else {
-			// Fallback if we can't get photo info
-			c.JSON(http.StatusOK, gin.H{
-				"status":   "success",
-				"message":  "File uploaded",
-				"local_id": localID,
-				"filename": localID + "." + ext,
-			})
-		}
+		// Return success with the stored filename
+		c.JSON(http.StatusOK, uploadResponse("File uploaded", localID, ext, result))
 	}
 }
 
 // UploadStreamHandlerWithDeps handles photo upload requests using pure streaming (no multipart parsing)
-func UploadStreamHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+func UploadStreamHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get user ID from JWT middleware context
 		userID, ok := middleware.GetUserID(c)
@@ -158,11 +287,15 @@ func UploadStreamHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileS
 			return
 		}
 
-		// Create PhotoRepository for this user
-		photoRepo := repository.NewPhotoRepository(db, userID)
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
 
 		// Create PhotoService for this user
-		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, storageDir)
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
 
 		// Get parameters from query string
 		localID := c.Query("local_id")
@@ -183,6 +316,12 @@ func UploadStreamHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileS
 		// Use file_type as the file extension
 		ext := strings.ToLower(fileType)
 
+		expectedHash, err := expectedSHA256(c, c.Query("sha256"))
+		if err != nil {
+			errors.BadRequest(c, err.Error(), nil)
+			return
+		}
+
 		appLogger.Info("Streaming photo upload (raw body)",
 			logger.Uint("user_id", userID),
 			logger.String("local_id", localID),
@@ -190,40 +329,33 @@ func UploadStreamHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileS
 			logger.String("file_extension", ext))
 
 		// Upload photo directly from request body (pure streaming)
-		if err := photoService.UploadPhotoStream(userID, localID, ext, fileType, c.Request.Body); err != nil {
+		result, err := photoService.UploadPhotoStream(userID, service.UploadRequest{
+			LocalID:        localID,
+			Role:           c.Query("role"),
+			FileExtension:  ext,
+			FileType:       fileType,
+			ExpectedSHA256: expectedHash,
+			Device:         deviceName(c, c.Query("device")),
+		}, c.Request.Body)
+		if err != nil {
 			appLogger.Error("Photo stream upload failed",
 				logger.Uint("user_id", userID),
 				logger.String("local_id", localID),
 				logger.String("error", err.Error()))
-			errors.InternalError(c, err.Error(), nil)
+			respondUploadError(c, err)
 			return
 		}
 
 		appLogger.PhotoOperation("upload_stream", localID, localID, userID, true)
+		logContentMismatch(appLogger, userID, localID, ext, result)
 
-		// Return success with filename
-		photo, err := photoRepo.FindByLocalID(localID)
-		if err == nil && photo != nil {
-			c.JSON(http.StatusOK, gin.H{
-				"status":    "success",
-				"message":   "File uploaded (streamed)",
-				"local_id":  localID,
-				"filename":  photo.FileName + "." + ext,
-				"file_path": photo.FilePath + photo.FileName + "." + ext,
-			})
-		} else {
-			c.JSON(http.StatusOK, gin.H{
-				"status":   "success",
-				"message":  "File uploaded (streamed)",
-				"local_id": localID,
-				"filename": localID + "." + ext,
-			})
-		}
+		// Return success with the stored filename
+		c.JSON(http.StatusOK, uploadResponse("File uploaded (streamed)", localID, ext, result))
 	}
 }
 
 // UploadChunkHandlerWithDeps handles chunked photo upload requests
-func UploadChunkHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+func UploadChunkHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get user ID from JWT middleware context
 		userID, ok := middleware.GetUserID(c)
@@ -233,11 +365,15 @@ func UploadChunkHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileSt
 			return
 		}
 
-		// Create PhotoRepository for this user
-		photoRepo := repository.NewPhotoRepository(db, userID)
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
 
 		// Create PhotoService for this user
-		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, storageDir)
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
 
 		// Parse multipart form
 		if err := c.Request.ParseMultipartForm(50 << 20); err != nil { // 50MB max per chunk
@@ -299,10 +435,34 @@ func UploadChunkHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileSt
 			errors.BadRequest(c, "invalid chunk numbers", nil)
 			return
 		}
+		if totalChunks > service.MaxUploadChunks {
+			appLogger.Warn("Too many chunks",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.Int("total_chunks", totalChunks))
+			errors.BadRequest(c, "total_chunks exceeds the maximum", gin.H{"max_total_chunks": service.MaxUploadChunks})
+			return
+		}
+
+		// Optional declared size of the whole file, checked once all chunks are merged
+		var totalSize int64
+		if totalSizeStr := c.Request.FormValue("total_size"); totalSizeStr != "" {
+			if _, err := fmt.Sscanf(totalSizeStr, "%d", &totalSize); err != nil || totalSize <= 0 {
+				errors.BadRequest(c, "invalid total_size format", nil)
+				return
+			}
+		}
 
 		// Use file_type as the file extension
 		ext := strings.ToLower(fileType)
 
+		// Expected hash of the whole file, checked once all chunks are merged
+		expectedHash, err := expectedSHA256(c, c.Request.FormValue("sha256"))
+		if err != nil {
+			errors.BadRequest(c, err.Error(), nil)
+			return
+		}
+
 		// Get chunk file
 		fileHeader, err := c.FormFile("chunk_data")
 		if err != nil {
@@ -336,7 +496,7 @@ func UploadChunkHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileSt
 		defer file.Close()
 
 		chunkData := make([]byte, fileHeader.Size)
-		if _, err := file.Read(chunkData); err != nil {
+		if _, err := io.ReadFull(file, chunkData); err != nil {
 			appLogger.Error("Failed to read chunk file",
 				logger.Uint("user_id", userID),
 				logger.String("local_id", localID),
@@ -346,49 +506,107 @@ func UploadChunkHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileSt
 		}
 
 		// Upload chunk
-		isComplete, err := photoService.UploadPhotoChunk(userID, localID, ext, chunkNumber, totalChunks, chunkData)
+		isComplete, result, err := photoService.UploadPhotoChunk(userID, service.UploadRequest{
+			LocalID:        localID,
+			Role:           c.Request.FormValue("role"),
+			FileExtension:  ext,
+			FileType:       fileType,
+			ExpectedSHA256: expectedHash,
+			Device:         deviceName(c, c.Request.FormValue("device")),
+		}, chunkNumber, totalChunks, totalSize, chunkData)
 		if err != nil {
 			appLogger.Error("Chunk upload failed",
 				logger.Uint("user_id", userID),
 				logger.String("local_id", localID),
 				logger.Int("chunk_number", chunkNumber),
 				logger.String("error", err.Error()))
-			errors.InternalError(c, err.Error(), nil)
+			respondUploadError(c, err)
 			return
 		}
 
 		if isComplete {
 			appLogger.PhotoOperation("upload_chunk_complete", localID, localID, userID, true)
+			logContentMismatch(appLogger, userID, localID, ext, result)
 
-			// Return success with filename
-			photo, err := photoRepo.FindByLocalID(localID)
-			if err == nil && photo != nil {
-				c.JSON(http.StatusOK, gin.H{
-					"status":      "success",
-					"message":     "File uploaded (chunked)",
-					"local_id":    localID,
-					"filename":    photo.FileName + "." + ext,
-					"file_path":   photo.FilePath + photo.FileName + "." + ext,
-					"is_complete": true,
-				})
-			} else {
-				c.JSON(http.StatusOK, gin.H{
-					"status":      "success",
-					"message":     "File uploaded (chunked)",
-					"local_id":    localID,
-					"filename":    localID + "." + ext,
-					"is_complete": true,
-				})
-			}
+			// Return success with the stored filename
+			response := uploadResponse("File uploaded (chunked)", localID, ext, result)
+			response["is_complete"] = true
+			c.JSON(http.StatusOK, response)
 		} else {
 			c.JSON(http.StatusOK, gin.H{
-				"status":      "success",
-				"message":     "Chunk uploaded",
-				"local_id":    localID,
+				"status":       "success",
+				"message":      "Chunk uploaded",
+				"local_id":     localID,
 				"chunk_number": chunkNumber,
 				"total_chunks": totalChunks,
-				"is_complete": false,
+				"is_complete":  false,
 			})
 		}
 	}
 }
+
+// UploadChunkStatusHandlerWithDeps reports which chunks of a chunked upload have been received
+func UploadChunkStatusHandlerWithDeps(db *gorm.DB, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, storageDir string, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from JWT middleware context
+		userID, ok := middleware.GetUserID(c)
+		if !ok {
+			appLogger.Warn("Chunk status request without valid user_id in context", logger.String("path", c.Request.URL.Path))
+			errors.Unauthorized(c, "Invalid token claims")
+			return
+		}
+
+		// Create PhotoRepository for the library of the device the request comes from
+		device, ok := requestDevice(c)
+		if !ok {
+			return
+		}
+		photoRepo := repository.NewPhotoRepository(db, device, naming)
+
+		// Create PhotoService for this user
+		photoService := service.NewPhotoService(photoRepo, naming, fileStorage, thumbnails, events, storageDir)
+
+		localID := c.Query("local_id")
+		fileType := c.Query("file_type")
+		if localID == "" {
+			errors.BadRequest(c, "local_id is required", nil)
+			return
+		}
+		if fileType == "" {
+			errors.BadRequest(c, "file_type is required", nil)
+			return
+		}
+
+		// Use file_type as the file extension
+		ext := strings.ToLower(fileType)
+
+		status, err := photoService.GetChunkUploadStatus(localID, c.Query("role"), ext)
+		if err != nil {
+			if respondValidationError(c, err) {
+				return
+			}
+			if stderrors.Is(err, service.ErrPhotoNotFound) || stderrors.Is(err, service.ErrChunkSessionNotFound) {
+				errors.NotFound(c, err.Error())
+				return
+			}
+			appLogger.Error("Chunk status failed",
+				logger.Uint("user_id", userID),
+				logger.String("local_id", localID),
+				logger.String("error", err.Error()))
+			errors.InternalError(c, err.Error(), nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":          "success",
+			"local_id":        localID,
+			"file_type":       ext,
+			"total_chunks":    status.TotalChunks,
+			"total_size":      status.TotalSize,
+			"received_chunks": status.ReceivedChunks,
+			"missing_chunks":  status.MissingChunks,
+			"missing_count":   status.MissingCount,
+			"received_size":   status.ReceivedSize,
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	stderrors "errors"
+
+	"github.com/gin-gonic/gin"
+
+	apierrors "github.com/ios-photo-backup/photo-backup-server/internal/api/errors"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/service"
+)
+
+// DeviceKey is the context key of the device a request comes from
+const DeviceKey = "device"
+
+// DeviceMiddleware resolves the device a request comes from (must be used after JWTMiddleware)
+// Requests with tokens issued before devices were registered come from the user's original device
+func DeviceMiddleware(deviceService *service.DeviceService, appLogger *logger.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := GetUserID(c)
+		if !ok {
+			apierrors.Unauthorized(c, "User ID not found in context")
+			c.Abort()
+			return
+		}
+		tokenDeviceID, _ := c.Get(TokenDeviceIDKey)
+		deviceID, _ := tokenDeviceID.(uint)
+
+		device, err := deviceService.Current(userID, deviceID)
+		if err != nil {
+			if stderrors.Is(err, service.ErrDeviceNotFound) {
+				appLogger.Warn("Token of unknown device",
+					logger.Uint("user_id", userID),
+					logger.Uint("device_id", deviceID))
+				apierrors.Unauthorized(c, "Device is not registered")
+			} else {
+				appLogger.Error("Device lookup failed",
+					logger.Uint("user_id", userID),
+					logger.String("error", err.Error()))
+				apierrors.InternalError(c, "Device lookup failed", nil)
+			}
+			c.Abort()
+			return
+		}
+
+		c.Set(DeviceKey, device)
+		c.Next()
+	}
+}
+
+// GetDevice extracts the device a request comes from (must be used after DeviceMiddleware)
+func GetDevice(c *gin.Context) (*models.Device, bool) {
+	device, exists := c.Get(DeviceKey)
+	if !exists {
+		return nil, false
+	}
+	d, ok := device.(*models.Device)
+	return d, ok
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -12,9 +13,12 @@ import (
 
 // Context keys for JWT claims
 const (
-	ClaimsKey  = "claims"
-	UserIDKey  = "user_id"
-	UsernameKey = "username"
+	TokenKey          = "token"
+	ClaimsKey         = "claims"
+	UserIDKey         = "user_id"
+	UsernameKey       = "username"
+	TokenDeviceIDKey  = "token_device_id"
+	TokenExpiresAtKey = "token_expires_at"
 )
 
 // JWTMiddleware provides unified JWT authentication middleware
@@ -57,6 +61,23 @@ func JWTMiddleware(tokenService *service.TokenService, appLogger *logger.Logger)
 			return
 		}
 
+		// Tokens removed from the tokens table (logout, refresh) are revoked before they expire
+		active, err := tokenService.IsActive(token)
+		if err != nil {
+			appLogger.Error("JWT revocation check failed",
+				logger.String("path", c.Request.URL.Path),
+				logger.String("error", err.Error()))
+			apierrors.InternalError(c, "Failed to check token", nil)
+			c.Abort()
+			return
+		}
+		if !active {
+			appLogger.Info("JWT revoked", logger.String("path", c.Request.URL.Path))
+			apierrors.Unauthorized(c, "Token has been revoked")
+			c.Abort()
+			return
+		}
+
 		// Extract user_id from claims
 		userIDFloat, ok := claims["user_id"].(float64)
 		if !ok {
@@ -67,7 +88,8 @@ func JWTMiddleware(tokenService *service.TokenService, appLogger *logger.Logger)
 		}
 		userID := uint(userIDFloat)
 
-		// Store claims and user_id in context for handlers to use
+		// Store token, claims and user_id in context for handlers to use
+		c.Set(TokenKey, token)
 		c.Set(ClaimsKey, claims)
 		c.Set(UserIDKey, userID)
 
@@ -76,6 +98,16 @@ func JWTMiddleware(tokenService *service.TokenService, appLogger *logger.Logger)
 			c.Set(UsernameKey, username)
 		}
 
+		// Handlers of long-lived requests end them when the token expires
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			c.Set(TokenExpiresAtKey, exp.Time)
+		}
+
+		// Tokens issued before devices were registered carry no device_id
+		if deviceID, ok := claims["device_id"].(float64); ok {
+			c.Set(TokenDeviceIDKey, uint(deviceID))
+		}
+
 		c.Next()
 	}
 }
@@ -90,6 +122,16 @@ func GetUserID(c *gin.Context) (uint, bool) {
 	return id, ok
 }
 
+// GetTokenExpiresAt extracts when the request's token expires (must be used after JWTMiddleware)
+func GetTokenExpiresAt(c *gin.Context) (time.Time, bool) {
+	expiresAt, exists := c.Get(TokenExpiresAtKey)
+	if !exists {
+		return time.Time{}, false
+	}
+	at, ok := expiresAt.(time.Time)
+	return at, ok
+}
+
 // GetClaims extracts all claims from Gin context (must be used after JWTMiddleware)
 func GetClaims(c *gin.Context) (map[string]interface{}, bool) {
 	claims, exists := c.Get(ClaimsKey)
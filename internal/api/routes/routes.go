@@ -7,20 +7,28 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/ios-photo-backup/photo-backup-server/internal/api/handlers/auth"
+	"github.com/ios-photo-backup/photo-backup-server/internal/api/handlers/device"
 	"github.com/ios-photo-backup/photo-backup-server/internal/api/handlers/photo"
 	"github.com/ios-photo-backup/photo-backup-server/internal/api/handlers/user"
 	"github.com/ios-photo-backup/photo-backup-server/internal/api/middleware"
 	"github.com/ios-photo-backup/photo-backup-server/internal/config"
 	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
 	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
 	"github.com/ios-photo-backup/photo-backup-server/internal/service"
 )
 
 // SetupRoutes sets up all API routes
-func SetupRoutes(db *gorm.DB, cfg *config.Config, appLogger *logger.Logger) *gin.Engine {
+// jwtKeys sign and verify access tokens; events carries photo changes to the event streams. The background jobs
+// publish to events as well and share naming, fileStorage and thumbnails, whose path locks and in-flight previews are per instance
+func SetupRoutes(db *gorm.DB, cfg *config.Config, jwtKeys *config.JWTKeyStore, naming *service.PhotoNaming, fileStorage *service.FileStorage, thumbnails *service.ThumbnailService, events *service.EventBroker, appLogger *logger.Logger) *gin.Engine {
 	// Create Gin router
 	router := gin.Default()
 
+	// iOS local identifiers contain slashes (e.g. "UUID/L0/001"), so match
+	// path parameters against the escaped path to allow %2F inside them
+	router.UseRawPath = true
+
 	// Add logging middleware
 	router.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
 		appLogger.HTTPRequest(
@@ -37,35 +45,81 @@ func SetupRoutes(db *gorm.DB, cfg *config.Config, appLogger *logger.Logger) *gin
 	// Create repositories
 	userRepo := repository.NewUserRepository(db)
 	tokenRepo := repository.NewTokenRepository(db)
+	deviceRepo := repository.NewDeviceRepository(db)
 
 	// Create services
-	authService := service.NewAuthService(userRepo, tokenRepo, cfg.JWTSecretPath)
-	tokenService := service.NewTokenService(tokenRepo, cfg.JWTSecretPath)
+	tokenService := service.NewTokenService(tokenRepo, userRepo, jwtKeys, cfg.AccessTokenTTL, cfg.RefreshTokenTTL)
+	authService := service.NewAuthService(userRepo, deviceRepo, tokenService)
+	deletionPolicies := service.NewDeletionPolicyService(userRepo)
 
-	// Create photo services (photo repository will be created per-request with user ID)
-	naming := service.NewPhotoNaming()
-	fileStorage := service.NewFileStorage(cfg)
+	// Create photo services (photo repository will be created per-request with user ID and device)
+	deviceService := service.NewDeviceService(deviceRepo, func(device *models.Device) *repository.PhotoRepository {
+		return repository.NewPhotoRepository(db, device, naming)
+	})
 
 	// Public routes (no authentication required)
 	public := router.Group("/")
 	{
 		public.POST("/login", auth.LoginHandler(authService, appLogger))
+
+		// Refresh tokens stand in for the access token, which may already have expired
+		public.POST("/refresh", auth.RefreshHandler(tokenService, appLogger))
+
+		// tus discovery carries no user data and clients may probe it before authenticating
+		public.OPTIONS("/photos/upload/tus", photo.TusOptionsHandler())
 	}
 
 	// Protected routes (authentication required)
 	protected := router.Group("/")
-	protected.Use(middleware.JWTMiddleware(tokenService, appLogger))
+	protected.Use(middleware.JWTMiddleware(tokenService, appLogger), middleware.DeviceMiddleware(deviceService, appLogger))
 	{
-		// Add refresh and status endpoints
-		protected.POST("/refresh", auth.RefreshHandler(tokenService, appLogger))
+		// Add status endpoint
 		protected.GET("/status", user.StatusHandler(appLogger))
 
+		// Revoke the token of the request, or every token of the user
+		protected.POST("/logout", auth.LogoutHandler(tokenService, appLogger))
+		protected.POST("/logout/all", auth.LogoutAllHandler(tokenService, appLogger))
+
+		// Devices of the user and their photo libraries
+		protected.GET("/devices", device.ListHandler(deviceService, appLogger))
+
 		// Add photo endpoints
-		// PhotoRepository will be created per-request with user ID from JWT
-		protected.POST("/photos/index", photo.IndexHandlerWithDeps(db, naming, fileStorage, cfg.StorageDir, appLogger))
-		protected.POST("/photos/upload", photo.UploadHandlerWithDeps(db, naming, fileStorage, cfg.StorageDir, appLogger))
-		protected.POST("/photos/upload/stream", photo.UploadStreamHandlerWithDeps(db, naming, fileStorage, cfg.StorageDir, appLogger))
-		protected.POST("/photos/upload/chunk", photo.UploadChunkHandlerWithDeps(db, naming, fileStorage, cfg.StorageDir, appLogger))
+		// PhotoRepository will be created per-request with user ID from JWT and the device's library
+		protected.GET("/photos", photo.ListHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/photos/:local_id/files/:ext", photo.DownloadHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/photos/:local_id/thumbnail", photo.ThumbnailHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/photos/:local_id/metadata", photo.MetadataHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/photos/:local_id/resources", photo.ResourcesHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/photos/:local_id/versions", photo.VersionsHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/photos/:local_id/versions/:version/files/:ext", photo.VersionDownloadHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.DELETE("/photos/:local_id", photo.DeleteHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.POST("/photos/index", photo.IndexHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.POST("/photos/index/bulk", photo.BulkIndexHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.POST("/photos/upload", photo.UploadHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.POST("/photos/upload/stream", photo.UploadStreamHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.POST("/photos/upload/chunk", photo.UploadChunkHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/photos/upload/chunk/status", photo.UploadChunkStatusHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+
+		// Trash (photos deleted with DELETE /photos/:local_id)
+		protected.GET("/trash", photo.TrashListHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.POST("/trash/:local_id/restore", photo.RestoreHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+
+		// Mirroring of deletions in the device library
+		protected.POST("/sync/deletions", photo.DeviceDeletionsHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.GET("/sync/deletion-policy", photo.DeletionPolicyHandler(deletionPolicies, appLogger))
+		protected.PUT("/sync/deletion-policy", photo.UpdateDeletionPolicyHandler(deletionPolicies, appLogger))
+
+		// Changes since a cursor, for clients keeping a copy of the library in sync
+		protected.GET("/sync/changes", photo.ChangesHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+
+		// Live stream of photo changes (Server-Sent Events)
+		protected.GET("/events", photo.EventsHandler(events, tokenService, appLogger))
+
+		// Resumable uploads (tus 1.0)
+		protected.POST("/photos/upload/tus", photo.TusCreateHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.HEAD("/photos/upload/tus/:upload_id", photo.TusHeadHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.PATCH("/photos/upload/tus/:upload_id", photo.TusPatchHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
+		protected.DELETE("/photos/upload/tus/:upload_id", photo.TusDeleteHandlerWithDeps(db, naming, fileStorage, thumbnails, events, cfg.StorageDir, appLogger))
 	}
 
 	// Add a simple health check endpoint
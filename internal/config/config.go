@@ -4,6 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
+)
+
+// Policies for uploads whose content does not match their file extension
+const (
+	ContentPolicyFlag   = "flag"   // Store the file and mark it as mismatching
+	ContentPolicyReject = "reject" // Refuse the upload and keep any previous file
 )
 
 // Config holds the application configuration
@@ -20,18 +28,52 @@ type Config struct {
 	DatabasePath string
 
 	// JWT
-	JWTSecretPath string
+	JWTSecretPath   string        // Secret a new keyring starts with, if the file exists
+	JWTKeyringPath  string        // Keys that sign and verify tokens
+	AccessTokenTTL  time.Duration // Lifetime of access tokens
+	RefreshTokenTTL time.Duration // Lifetime of refresh tokens; each refresh issues a new one
+
+	// Uploads
+	AllowedExtensions []string // Lowercase file extensions accepted for upload
+	ContentTypePolicy string   // ContentPolicyFlag or ContentPolicyReject
+
+	// Versions
+	VersionRetention int // Replaced versions kept per file in addition to the original
+
+	// Trash
+	TrashRetentionDays int // Days deleted photos stay in the trash before they are purged; 0 keeps them until restored
+
+	// Upload cleanup
+	CleanupInterval time.Duration // How often the janitor and trash purge run; 0 disables them
+	UploadMaxAge    time.Duration // Age after which abandoned chunks, tus uploads and temp files are removed
 }
 
 // DefaultConfig returns a default configuration
 func DefaultConfig() *Config {
 	return &Config{
-		Host:          "0.0.0.0",
-		Port:          8080,
-		DataDir:       "./data",
-		StorageDir:    "./storage",
-		DatabasePath:  "./data/app.db",
-		JWTSecretPath: "./data/jwt_secret.key",
+		Host:           "0.0.0.0",
+		Port:           8080,
+		DataDir:        "./data",
+		StorageDir:     "./storage",
+		DatabasePath:   "./data/app.db",
+		JWTSecretPath:  "./data/jwt_secret.key",
+		JWTKeyringPath: "./data/jwt_keys.json",
+
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+
+		AllowedExtensions: []string{
+			"jpg", "jpeg", "heic", "heif", "png", "gif", "webp", "dng", "tif", "tiff",
+			"mov", "mp4", "m4v", "aae",
+		},
+		ContentTypePolicy: ContentPolicyFlag,
+
+		VersionRetention: 10,
+
+		TrashRetentionDays: 30,
+
+		CleanupInterval: time.Hour,
+		UploadMaxAge:    24 * time.Hour,
 	}
 }
 
@@ -45,10 +87,42 @@ func Load() (*Config, error) {
 	flag.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "Data directory path")
 	flag.StringVar(&cfg.StorageDir, "storage-dir", cfg.StorageDir, "Storage directory path")
 	flag.StringVar(&cfg.DatabasePath, "db-path", cfg.DatabasePath, "Database file path")
-	flag.StringVar(&cfg.JWTSecretPath, "jwt-secret-path", cfg.JWTSecretPath, "JWT secret file path")
+	flag.StringVar(&cfg.JWTSecretPath, "jwt-secret-path", cfg.JWTSecretPath, "JWT secret file path, imported into a new keyring")
+	flag.StringVar(&cfg.JWTKeyringPath, "jwt-keyring-path", cfg.JWTKeyringPath, "JWT keyring file path")
+	flag.DurationVar(&cfg.AccessTokenTTL, "access-token-ttl", cfg.AccessTokenTTL, "Lifetime of access tokens")
+	flag.DurationVar(&cfg.RefreshTokenTTL, "refresh-token-ttl", cfg.RefreshTokenTTL, "Lifetime of refresh tokens")
+	allowedExtensions := flag.String("allowed-extensions", strings.Join(cfg.AllowedExtensions, ","), "Comma-separated file extensions accepted for upload")
+	flag.StringVar(&cfg.ContentTypePolicy, "content-type-policy", cfg.ContentTypePolicy, "What to do with uploads whose content does not match file_type: flag or reject")
+	flag.IntVar(&cfg.VersionRetention, "version-retention", cfg.VersionRetention, "Replaced versions kept per file in addition to the original")
+	flag.IntVar(&cfg.TrashRetentionDays, "trash-retention-days", cfg.TrashRetentionDays, "Days deleted photos stay in the trash before they are purged (0 disables purging)")
+	flag.DurationVar(&cfg.CleanupInterval, "cleanup-interval", cfg.CleanupInterval, "Interval between upload cleanup and trash purge runs (0 disables)")
+	flag.DurationVar(&cfg.UploadMaxAge, "upload-max-age", cfg.UploadMaxAge, "Age after which abandoned upload leftovers are removed")
 
 	flag.Parse()
 
+	cfg.AllowedExtensions = nil
+	for _, ext := range strings.Split(*allowedExtensions, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+			cfg.AllowedExtensions = append(cfg.AllowedExtensions, ext)
+		}
+	}
+
+	if cfg.ContentTypePolicy != ContentPolicyFlag && cfg.ContentTypePolicy != ContentPolicyReject {
+		return nil, fmt.Errorf("invalid content-type-policy value: %s", cfg.ContentTypePolicy)
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		return nil, fmt.Errorf("invalid access-token-ttl value: %s", cfg.AccessTokenTTL)
+	}
+	if cfg.RefreshTokenTTL < cfg.AccessTokenTTL {
+		return nil, fmt.Errorf("invalid refresh-token-ttl value: %s is shorter than access-token-ttl", cfg.RefreshTokenTTL)
+	}
+	if cfg.VersionRetention < 0 {
+		return nil, fmt.Errorf("invalid version-retention value: %d", cfg.VersionRetention)
+	}
+	if cfg.TrashRetentionDays < 0 {
+		return nil, fmt.Errorf("invalid trash-retention-days value: %d", cfg.TrashRetentionDays)
+	}
+
 	// Environment variables override defaults
 	if host := os.Getenv("HOST"); host != "" {
 		cfg.Host = host
@@ -5,7 +5,7 @@ import (
 )
 
 // InitializeApp initializes the application by creating necessary directories
-// and setting up the JWT secret
+// and setting up the JWT keyring
 func InitializeApp(cfg *Config) error {
 	// Create data directory
 	if err := EnsureDir(cfg.DataDir, 0755); err != nil {
@@ -17,9 +17,9 @@ func InitializeApp(cfg *Config) error {
 		return fmt.Errorf("failed to create storage directory: %w", err)
 	}
 
-	// Load or create JWT secret
-	if _, err := LoadOrCreateJWTSecret(cfg.JWTSecretPath); err != nil {
-		return fmt.Errorf("failed to setup JWT secret: %w", err)
+	// Load or create JWT keyring
+	if _, err := LoadOrCreateJWTKeyring(cfg.JWTKeyringPath, cfg.JWTSecretPath); err != nil {
+		return fmt.Errorf("failed to setup JWT keyring: %w", err)
 	}
 
 	return nil
@@ -20,27 +20,6 @@ func GenerateJWTSecret() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// LoadOrCreateJWTSecret loads an existing JWT secret from file or creates a new one
-func LoadOrCreateJWTSecret(secretPath string) (string, error) {
-	// Try to load existing secret
-	if data, err := os.ReadFile(secretPath); err == nil {
-		return string(data), nil
-	}
-
-	// Generate new secret
-	secret, err := GenerateJWTSecret()
-	if err != nil {
-		return "", fmt.Errorf("failed to generate JWT secret: %w", err)
-	}
-
-	// Save to file
-	if err := os.WriteFile(secretPath, []byte(secret), 0600); err != nil {
-		return "", fmt.Errorf("failed to save JWT secret: %w", err)
-	}
-
-	return secret, nil
-}
-
 // HashPassword hashes a password using bcrypt
 func HashPassword(password string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
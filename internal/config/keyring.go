@@ -0,0 +1,228 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// jwtKeyringCheckInterval is how often a JWTKeyStore checks whether the keyring file was changed
+const jwtKeyringCheckInterval = 10 * time.Second
+
+// JWTKey is an HMAC key for JWTs, named in the kid header of the tokens it signs
+type JWTKey struct {
+	ID        string     `json:"kid"`
+	Secret    string     `json:"secret"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"` // Set when a newer key replaces it; nil for the signing key
+	Legacy    bool       `json:"legacy,omitempty"`     // Imported from the JWT secret file; also verifies tokens without a kid
+}
+
+// Retired reports whether the key no longer verifies tokens at the given time
+func (k *JWTKey) Retired(at time.Time) bool {
+	return k.RetiresAt != nil && !at.Before(*k.RetiresAt)
+}
+
+// JWTKeyring holds the JWT keys, oldest first
+// The newest key signs new tokens; older keys verify the tokens they signed until they retire
+type JWTKeyring struct {
+	Keys []JWTKey `json:"keys"`
+}
+
+// newJWTKey creates a key with a random ID
+func newJWTKey(secret string) (JWTKey, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return JWTKey{}, fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return JWTKey{
+		ID:        hex.EncodeToString(id),
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// SigningKey returns the key new tokens are signed with
+func (k *JWTKeyring) SigningKey() (*JWTKey, error) {
+	if len(k.Keys) == 0 {
+		return nil, fmt.Errorf("JWT keyring has no keys")
+	}
+	return &k.Keys[len(k.Keys)-1], nil
+}
+
+// VerificationKey returns the key with the given ID unless it has retired
+// Tokens signed before the keyring have no ID and are verified with the imported legacy key
+func (k *JWTKeyring) VerificationKey(id string, at time.Time) (*JWTKey, bool) {
+	for i := range k.Keys {
+		if k.Keys[i].ID == id || (id == "" && k.Keys[i].Legacy) {
+			if k.Keys[i].Retired(at) {
+				return nil, false
+			}
+			return &k.Keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// Rotate adds a new signing key and retires the other keys after grace
+// Keys that have already retired are removed; a key due to retire earlier keeps its time
+func (k *JWTKeyring) Rotate(grace time.Duration) (*JWTKey, error) {
+	secret, err := GenerateJWTSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate JWT secret: %w", err)
+	}
+	key, err := newJWTKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	retiresAt := key.CreatedAt.Add(grace)
+	keys := make([]JWTKey, 0, len(k.Keys)+1)
+	for _, old := range k.Keys {
+		if old.Retired(key.CreatedAt) {
+			continue
+		}
+		if old.RetiresAt == nil || old.RetiresAt.After(retiresAt) {
+			old.RetiresAt = &retiresAt
+		}
+		keys = append(keys, old)
+	}
+	k.Keys = append(keys, key)
+	return &k.Keys[len(k.Keys)-1], nil
+}
+
+// LoadJWTKeyring reads a keyring file
+func LoadJWTKeyring(path string) (*JWTKeyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT keyring: %w", err)
+	}
+	var keyring JWTKeyring
+	if err := json.Unmarshal(data, &keyring); err != nil {
+		return nil, fmt.Errorf("failed to parse JWT keyring: %w", err)
+	}
+	if len(keyring.Keys) == 0 {
+		return nil, fmt.Errorf("JWT keyring %s has no keys", path)
+	}
+	return &keyring, nil
+}
+
+// Save writes the keyring readable only by its owner, replacing the file atomically
+func (k *JWTKeyring) Save(path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JWT keyring: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to save JWT keyring: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save JWT keyring: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save JWT keyring: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return fmt.Errorf("failed to save JWT keyring: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save JWT keyring: %w", err)
+	}
+	return nil
+}
+
+// LoadOrCreateJWTKeyring loads the keyring at path, creating it if it does not exist
+// A new keyring starts with the secret in legacySecretPath if that file exists, marked as the legacy key so
+// tokens signed with it before the keyring stay valid, otherwise with a new key
+func LoadOrCreateJWTKeyring(path, legacySecretPath string) (*JWTKeyring, error) {
+	if _, err := os.Stat(path); err == nil {
+		return LoadJWTKeyring(path)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read JWT keyring: %w", err)
+	}
+
+	secret, err := os.ReadFile(legacySecretPath)
+	legacy := err == nil
+	if os.IsNotExist(err) {
+		generated, genErr := GenerateJWTSecret()
+		if genErr != nil {
+			return nil, fmt.Errorf("failed to generate JWT secret: %w", genErr)
+		}
+		secret, err = []byte(generated), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT secret: %w", err)
+	}
+
+	key, err := newJWTKey(string(secret))
+	if err != nil {
+		return nil, err
+	}
+	key.Legacy = legacy
+	keyring := &JWTKeyring{Keys: []JWTKey{key}}
+	if err := keyring.Save(path); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// JWTKeyStore provides the keyring to the server and reloads it when the keyring file changes,
+// so keys rotated with the CLI take effect without a restart
+type JWTKeyStore struct {
+	path string
+
+	mu        sync.Mutex
+	keyring   *JWTKeyring
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewJWTKeyStore loads the keyring file at path
+func NewJWTKeyStore(path string) (*JWTKeyStore, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT keyring: %w", err)
+	}
+	keyring, err := LoadJWTKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTKeyStore{
+		path:      path,
+		keyring:   keyring,
+		modTime:   info.ModTime(),
+		checkedAt: time.Now(),
+	}, nil
+}
+
+// Keyring returns the current keyring
+// The file is checked for changes every jwtKeyringCheckInterval; if it cannot be read the last keyring stays in use
+func (s *JWTKeyStore) Keyring() *JWTKeyring {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.checkedAt) < jwtKeyringCheckInterval {
+		return s.keyring
+	}
+	s.checkedAt = now
+
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return s.keyring
+	}
+	if keyring, err := LoadJWTKeyring(s.path); err == nil {
+		s.keyring = keyring
+		s.modTime = info.ModTime()
+	}
+	return s.keyring
+}
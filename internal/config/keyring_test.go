@@ -0,0 +1,45 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerificationKeyWithoutID(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "jwt_secret.key")
+	if err := os.WriteFile(secretPath, []byte("legacy-secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := LoadOrCreateJWTKeyring(filepath.Join(dir, "jwt_keys.json"), secretPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key, ok := keyring.VerificationKey("", time.Now())
+	if !ok || key.Secret != "legacy-secret" {
+		t.Fatalf("verification key without kid = %+v, %v, want the imported secret", key, ok)
+	}
+
+	// The legacy key stays after a rotation until it retires
+	if _, err := keyring.Rotate(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keyring.VerificationKey("", time.Now()); !ok {
+		t.Errorf("legacy key is not found during the grace period")
+	}
+	if _, ok := keyring.VerificationKey("", time.Now().Add(2*time.Hour)); ok {
+		t.Errorf("legacy key is found after it retired")
+	}
+
+	// A keyring that did not import a secret verifies no tokens without a kid
+	generated, err := LoadOrCreateJWTKeyring(filepath.Join(dir, "generated.json"), filepath.Join(dir, "missing.key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := generated.VerificationKey("", time.Now()); ok {
+		t.Errorf("generated keyring verifies tokens without a kid")
+	}
+}
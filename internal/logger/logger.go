@@ -244,6 +244,11 @@ func Int(key string, value int) Field {
 	return Field{Key: key, Value: value}
 }
 
+// Int64 creates an int64 field
+func Int64(key string, value int64) Field {
+	return Field{Key: key, Value: value}
+}
+
 // Uint creates a uint field
 func Uint(key string, value uint) Field {
 	return Field{Key: key, Value: value}
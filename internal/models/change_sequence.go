@@ -0,0 +1,14 @@
+package models
+
+// ChangeSequence holds the last change sequence number handed out for a user's photos
+// Every change to a photo or file record takes the next number, so clients can ask for
+// everything that changed after the last number they have seen
+type ChangeSequence struct {
+	UserID uint  `gorm:"primaryKey;autoIncrement:false"`
+	Value  int64 `gorm:"not null;default:0"`
+}
+
+// TableName specifies the table name for ChangeSequence model
+func (ChangeSequence) TableName() string {
+	return "change_sequences"
+}
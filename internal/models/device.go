@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// Device is a client device of a user, registered when it logs in
+// Local identifiers of photos are only unique on one device, so each device has its own photo library
+type Device struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     uint      `json:"-" gorm:"not null;uniqueIndex:idx_devices_user_id_identifier"`
+	Identifier string    `json:"identifier" gorm:"not null;size:255;uniqueIndex:idx_devices_user_id_identifier"` // Chosen by the client (e.g. identifierForVendor); empty if it sent none
+	Name       string    `json:"name" gorm:"size:255"`
+	Model      string    `json:"model" gorm:"size:255"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+
+	// The user's first device; its library holds the photos backed up before devices were registered
+	Original bool `json:"original" gorm:"not null;default:false"`
+}
+
+// TableName specifies the table name for Device model
+func (Device) TableName() string {
+	return "devices"
+}
@@ -0,0 +1,15 @@
+package models
+
+// NameSequence holds the last file name sequence number handed out in one of a user's date directories
+// Photos are named IMG_0001, IMG_0002, ... per directory; numbers are never handed out twice,
+// even after the photo that had one was purged
+type NameSequence struct {
+	UserID   uint   `gorm:"primaryKey;autoIncrement:false"`
+	FilePath string `gorm:"primaryKey"` // Directory of the date, as in Photo.FilePath
+	Value    int    `gorm:"not null;default:0"`
+}
+
+// TableName specifies the table name for NameSequence model
+func (NameSequence) TableName() string {
+	return "name_sequences"
+}
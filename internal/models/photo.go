@@ -9,16 +9,23 @@ import (
 // Photo represents a photo in the system
 // This model is used for dynamic tables (photos_user_{user_id})
 type Photo struct {
-	LocalID            string         `json:"local_id" gorm:"primaryKey"`
-	CreationTime       time.Time      `json:"creation_time" gorm:"not null;index"`
-	FilePath           string         `json:"file_path" gorm:"not null;index"`
-	FileName           string         `json:"file_name" gorm:"not null;size:255"`
-	FileType           string         `json:"file_type" gorm:"not null;size:50"` // File extension (e.g., "jpg", "heic", "png")
-	FileCount          int            `json:"file_count" gorm:"default:0"`
-	UploadedExtensions string         `json:"uploaded_extensions" gorm:"type:text;default:'[]'"`
-	CreatedAt          time.Time      `json:"created_at"`
-	UpdatedAt          time.Time      `json:"updated_at"`
-	DeletedAt          gorm.DeletedAt `json:"-" gorm:"index"`
+	LocalID      string         `json:"local_id" gorm:"primaryKey"`
+	CreationTime time.Time      `json:"creation_time" gorm:"not null;index"`
+	FilePath     string         `json:"file_path" gorm:"not null;index"`
+	FileName     string         `json:"file_name" gorm:"not null;size:255"`
+	FileType     string         `json:"file_type" gorm:"not null;size:50"` // File extension (e.g., "jpg", "heic", "png")
+	FileCount    int            `json:"file_count" gorm:"default:0"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
+
+	// When the client first reported the photo as deleted from the device library; nil while present
+	DeviceDeletedAt *time.Time `json:"-" gorm:"index"`
+
+	// Change sequence numbers (see ChangeSequence) of the record's creation and its latest change,
+	// including changes to its files; records that predate change tracking are numbered on migration
+	CreatedSeq int64 `json:"-" gorm:"not null;default:0"`
+	ChangeSeq  int64 `json:"-" gorm:"not null;default:0;index"`
 }
 
 // TableName is not defined here because Photo models
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// PhotoFile represents one uploaded file (resource) of a photo, identified by role and extension
+// This model is used for dynamic tables (photo_files_user_{user_id})
+type PhotoFile struct {
+	ID              uint      `json:"-" gorm:"primaryKey"`
+	LocalID         string    `json:"local_id" gorm:"not null;index"`
+	Role            string    `json:"role" gorm:"not null;size:32;default:photo"` // e.g. photo, paired_video, adjustment_data
+	Extension       string    `json:"extension" gorm:"not null;size:50"`
+	Size            int64     `json:"size"`
+	SHA256          string    `json:"sha256" gorm:"column:sha256;size:64"`
+	MimeType        string    `json:"mime_type" gorm:"size:100"`             // Detected from the content
+	ContentMismatch bool      `json:"content_mismatch" gorm:"default:false"` // Content does not match Extension
+	Device          string    `json:"device" gorm:"size:255"`
+	Version         int       `json:"version" gorm:"not null;default:1"`    // 1 for the first upload, incremented whenever the content changes
+	ChangeSeq       int64     `json:"change_seq" gorm:"not null;default:0"` // Change sequence number of the last upload
+	UploadedAt      time.Time `json:"uploaded_at"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// TableName is not defined here because PhotoFile models
+// use dynamic table names based on user ID
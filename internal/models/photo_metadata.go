@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+)
+
+// PhotoMetadata holds metadata extracted from one uploaded file of a photo
+// Zero values and nil pointers mean the file did not carry the field
+// This model is used for dynamic tables (photo_metadata_user_{user_id})
+type PhotoMetadata struct {
+	ID              uint       `json:"-" gorm:"primaryKey"`
+	LocalID         string     `json:"local_id" gorm:"not null;index"`
+	Role            string     `json:"role" gorm:"not null;size:32;default:photo"`
+	Extension       string     `json:"extension" gorm:"not null;size:50"`
+	Make            string     `json:"make,omitempty" gorm:"size:255"`
+	Model           string     `json:"model,omitempty" gorm:"size:255"`
+	Software        string     `json:"software,omitempty" gorm:"size:255"`
+	LensModel       string     `json:"lens_model,omitempty" gorm:"size:255"`
+	Width           int        `json:"width,omitempty"`
+	Height          int        `json:"height,omitempty"`
+	Orientation     int        `json:"orientation,omitempty"`   // EXIF orientation (1-8)
+	ExposureTime    float64    `json:"exposure_time,omitempty"` // Seconds
+	FNumber         float64    `json:"f_number,omitempty"`      // Aperture
+	ISO             int        `json:"iso,omitempty" gorm:"column:iso"`
+	FocalLength     float64    `json:"focal_length,omitempty"` // Millimeters
+	FocalLength35mm int        `json:"focal_length_35mm,omitempty" gorm:"column:focal_length_35mm"`
+	Latitude        *float64   `json:"latitude,omitempty"`
+	Longitude       *float64   `json:"longitude,omitempty"`
+	Altitude        *float64   `json:"altitude,omitempty"` // Meters above sea level
+	CapturedAt      *time.Time `json:"captured_at,omitempty" gorm:"index"`
+	CapturedOffset  string     `json:"captured_offset,omitempty" gorm:"size:6"`     // e.g. "+08:00"; empty if the file had no time zone
+	Duration        float64    `json:"duration,omitempty"`                          // Seconds, videos only
+	ExtractionError string     `json:"extraction_error,omitempty" gorm:"type:text"` // Why the file could not be parsed
+	ExtractedAt     time.Time  `json:"extracted_at"`
+	CreatedAt       time.Time  `json:"-"`
+	UpdatedAt       time.Time  `json:"-"`
+}
+
+// TableName is not defined here because PhotoMetadata models
+// use dynamic table names based on user ID
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// PhotoTombstone records a photo purged from the trash, so clients syncing changes learn it is gone
+// This model is used for dynamic tables (photo_tombstones_user_{user_id})
+type PhotoTombstone struct {
+	LocalID   string    `json:"local_id" gorm:"primaryKey"`
+	ChangeSeq int64     `json:"change_seq" gorm:"not null;index"`
+	PurgedAt  time.Time `json:"purged_at"`
+}
+
+// TableName is not defined here because PhotoTombstone models
+// use dynamic table names based on user ID
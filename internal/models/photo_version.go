@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+// PhotoVersion is a replaced version of an uploaded file, kept when a file is uploaded again with different content
+// Version 1 is the original upload; the current content is described by PhotoFile
+// This model is used for dynamic tables (photo_versions_user_{user_id})
+type PhotoVersion struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	LocalID    string    `json:"local_id" gorm:"not null;index"`
+	Role       string    `json:"role" gorm:"not null;size:32"`
+	Extension  string    `json:"extension" gorm:"not null;size:50"`
+	Version    int       `json:"version" gorm:"not null"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256" gorm:"column:sha256;size:64"`
+	MimeType   string    `json:"mime_type" gorm:"size:100"`
+	Device     string    `json:"device" gorm:"size:255"`
+	UploadedAt time.Time `json:"uploaded_at"` // When this version was uploaded
+	ReplacedAt time.Time `json:"replaced_at"` // When a newer version replaced it
+	CreatedAt  time.Time `json:"-"`
+}
+
+// TableName is not defined here because PhotoVersion models
+// use dynamic table names based on user ID
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// RefreshToken is an opaque token a client exchanges for a new access token
+// Only a SHA-256 digest of the token is stored. Each exchange replaces the token with a new one of
+// the same family; presenting a replaced token again revokes the whole family
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"-" gorm:"not null;index"`
+	DeviceID  uint       `json:"-" gorm:"not null;default:0"`
+	FamilyID  string     `json:"-" gorm:"not null;size:64;index"` // Shared by the tokens of one login
+	TokenHash string     `json:"-" gorm:"not null;size:64;uniqueIndex"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"index"`
+	UsedAt    *time.Time `json:"used_at"` // When the token was exchanged; nil while it is the current token of its family
+}
+
+// TableName specifies the table name for RefreshToken model
+func (RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
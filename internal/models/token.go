@@ -10,7 +10,9 @@ import (
 type Token struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
 	UserID    uint           `json:"-" gorm:"not null;index"`
-	TokenValue string        `json:"-" gorm:"uniqueIndex;not null"`
+	DeviceID  uint           `json:"-" gorm:"not null;default:0;index"`     // 0 for tokens issued before devices were registered
+	TokenHash string         `json:"-" gorm:"size:64;uniqueIndex;not null"` // Hex SHA-256 digest of the token; the token itself is not stored
+	FamilyID  string         `json:"-" gorm:"size:64;index"`                // Session the token was issued to; empty for tokens issued before refresh tokens
 	CreatedAt time.Time      `json:"created_at"`
 	ExpiresAt time.Time      `json:"expires_at" gorm:"index"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+)
+
+// TusUpload tracks a resumable upload created through the tus protocol
+// The upload is bound to one indexed photo of a device, resource role and extension; its data is kept
+// under storage/uploads/{user_id}/{id} until the last byte arrives. A finished upload keeps its record,
+// without data, so HEAD still reports it complete until the upload janitor expires it
+type TusUpload struct {
+	ID             string    `json:"id" gorm:"primaryKey;size:64"`
+	UserID         uint      `json:"-" gorm:"not null;index"`
+	DeviceID       uint      `json:"-" gorm:"not null;default:0"` // Device whose photo library the upload is for
+	LocalID        string    `json:"local_id" gorm:"not null"`
+	Role           string    `json:"role" gorm:"size:32"`
+	Extension      string    `json:"extension" gorm:"not null;size:50"`
+	FileType       string    `json:"file_type" gorm:"size:50"`
+	Length         int64     `json:"length" gorm:"column:upload_length"` // Declared Upload-Length
+	Offset         int64     `json:"offset" gorm:"column:upload_offset"` // Bytes durably received so far
+	Metadata       string    `json:"-" gorm:"type:text"`                 // Raw Upload-Metadata header, echoed on HEAD
+	ExpectedSHA256 string    `json:"-" gorm:"column:expected_sha256;size:64"`
+	Device         string    `json:"-" gorm:"size:255"`
+	Finished       bool      `json:"finished" gorm:"not null;default:false"` // File stored for the photo
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" gorm:"index"`
+}
+
+// TableName specifies the table name for TusUpload model
+func (TusUpload) TableName() string {
+	return "tus_uploads"
+}
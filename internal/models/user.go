@@ -14,6 +14,10 @@ type User struct {
 	CreatedAt    time.Time      `json:"created_at"`
 	UpdatedAt    time.Time      `json:"updated_at"`
 	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
+
+	// What happens to photos reported as deleted from the user's device library
+	DeletionPolicy    string `json:"deletion_policy" gorm:"not null;size:16;default:keep"`
+	DeletionGraceDays int    `json:"deletion_grace_days" gorm:"not null;default:30"` // Used by the grace policy
 }
 
 // TableName specifies the table name for User model
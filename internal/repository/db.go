@@ -27,16 +27,29 @@ func InitDB(dbPath string) (*gorm.DB, error) {
 	return db, nil
 }
 
-// AutoMigrate runs database migrations for users and tokens tables
+// AutoMigrate runs database migrations for users, devices, tokens, refresh tokens, tus uploads, change sequences and name sequences tables
 func AutoMigrate(db *gorm.DB) error {
-	// Migrate User and Token models
-	// Photo tables are created dynamically per user
+	if err := hashStoredTokens(db); err != nil {
+		return err
+	}
+
+	// Migrate User, Device, Token, RefreshToken, TusUpload, ChangeSequence and NameSequence models
+	// Photo tables are created dynamically per user and device
 	if err := db.AutoMigrate(
 		&models.User{},
+		&models.Device{},
 		&models.Token{},
+		&models.RefreshToken{},
+		&models.TusUpload{},
+		&models.ChangeSequence{},
+		&models.NameSequence{},
 	); err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
 
+	if err := backfillOriginalDevices(db); err != nil {
+		return err
+	}
+
 	return nil
 }
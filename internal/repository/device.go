@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// DeviceRepository provides operations for the devices of users
+type DeviceRepository struct {
+	db *gorm.DB
+}
+
+// NewDeviceRepository creates a new DeviceRepository
+func NewDeviceRepository(db *gorm.DB) *DeviceRepository {
+	return &DeviceRepository{db: db}
+}
+
+// Register records a login from a device and returns the device
+// Devices are found by identifier. An original device registered without one keeps serving logins
+// without an identifier, as sent by the clients whose photos it holds; a login with a new identifier
+// takes it over only with claimOriginal. Name and model are updated when given
+func (r *DeviceRepository) Register(userID uint, identifier, name, model string, claimOriginal bool) (*models.Device, error) {
+	now := time.Now()
+	var device models.Device
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Writing first takes the database write lock, so concurrent logins cannot both register the original device
+		result := tx.Model(&models.Device{}).
+			Where("user_id = ? AND identifier = ?", userID, identifier).
+			Update("last_seen_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 && identifier != "" && claimOriginal {
+			result = tx.Model(&models.Device{}).
+				Where("user_id = ? AND identifier = '' AND original = ?", userID, true).
+				Updates(map[string]interface{}{"identifier": identifier, "last_seen_at": now})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if result.RowsAffected == 0 {
+			var count int64
+			if err := tx.Model(&models.Device{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+				return err
+			}
+			device = models.Device{
+				UserID:     userID,
+				Identifier: identifier,
+				Name:       name,
+				Model:      model,
+				LastSeenAt: now,
+				Original:   count == 0,
+			}
+			return tx.Create(&device).Error
+		}
+
+		if err := tx.Where("user_id = ? AND identifier = ?", userID, identifier).First(&device).Error; err != nil {
+			return err
+		}
+		updates := make(map[string]interface{})
+		if name != "" && name != device.Name {
+			updates["name"] = name
+		}
+		if model != "" && model != device.Model {
+			updates["model"] = model
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(&device).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register device: %w", err)
+	}
+	return &device, nil
+}
+
+// FindByID finds a device of a user by ID
+// Returns nil without an error if the user has no such device
+func (r *DeviceRepository) FindByID(userID, id uint) (*models.Device, error) {
+	var device models.Device
+	if err := r.db.Where("id = ? AND user_id = ?", id, userID).First(&device).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find device: %w", err)
+	}
+	return &device, nil
+}
+
+// FindOriginal returns the original device of a user, registering it if the user has no device yet
+func (r *DeviceRepository) FindOriginal(userID uint) (*models.Device, error) {
+	var devices []models.Device
+	if err := r.db.Where("user_id = ? AND original = ?", userID, true).Limit(1).Find(&devices).Error; err != nil {
+		return nil, fmt.Errorf("failed to find original device: %w", err)
+	}
+	if len(devices) > 0 {
+		return &devices[0], nil
+	}
+	return r.Register(userID, "", "", "", false)
+}
+
+// ListByUserID lists the devices of a user in registration order
+func (r *DeviceRepository) ListByUserID(userID uint) ([]models.Device, error) {
+	var devices []models.Device
+	if err := r.db.Where("user_id = ?", userID).Order("id").Find(&devices).Error; err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	return devices, nil
+}
+
+// Touch records that a device was seen
+func (r *DeviceRepository) Touch(id uint, at time.Time) error {
+	if err := r.db.Model(&models.Device{}).Where("id = ?", id).Update("last_seen_at", at).Error; err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+	return nil
+}
+
+// backfillOriginalDevices registers an original device for every user without devices,
+// so the photos backed up before devices were registered belong to one
+func backfillOriginalDevices(db *gorm.DB) error {
+	now := time.Now()
+	if err := db.Exec(
+		"INSERT INTO devices (user_id, identifier, name, model, created_at, last_seen_at, original) "+
+			"SELECT id, '', '', '', ?, ?, ? FROM users "+
+			"WHERE NOT EXISTS (SELECT 1 FROM devices WHERE devices.user_id = users.id)",
+		now, now, true,
+	).Error; err != nil {
+		return fmt.Errorf("failed to register original devices: %w", err)
+	}
+	return nil
+}
@@ -1,9 +1,10 @@
 package repository
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"gorm.io/gorm"
 
@@ -11,33 +12,99 @@ import (
 )
 
 // PhotoRepository provides CRUD operations for photos
-// Uses dynamic table names based on user ID
+// Uses dynamic table names based on user ID and device
 type PhotoRepository struct {
-	db      *gorm.DB
-	userID  uint
-	tableName string
+	db              *gorm.DB
+	userID          uint
+	deviceID        uint
+	namer           SequenceNamer
+	tableName       string
+	filesTable      string
+	metadataTable   string
+	versionsTable   string
+	tombstonesTable string
 }
 
-// NewPhotoRepository creates a new PhotoRepository for a specific user
-func NewPhotoRepository(db *gorm.DB, userID uint) *PhotoRepository {
+// NewPhotoRepository creates a new PhotoRepository for the photo library of one of a user's devices
+// namer names new photos; see CreateNamed
+func NewPhotoRepository(db *gorm.DB, device *models.Device, namer SequenceNamer) *PhotoRepository {
+	suffix := photoTableSuffix(device)
 	return &PhotoRepository{
-		db:      db,
-		userID:  userID,
-		tableName: fmt.Sprintf("photos_user_%d", userID),
+		db:              db,
+		userID:          device.UserID,
+		deviceID:        device.ID,
+		namer:           namer,
+		tableName:       fmt.Sprintf("photos_user_%d%s", device.UserID, suffix),
+		filesTable:      fmt.Sprintf("photo_files_user_%d%s", device.UserID, suffix),
+		metadataTable:   fmt.Sprintf("photo_metadata_user_%d%s", device.UserID, suffix),
+		versionsTable:   fmt.Sprintf("photo_versions_user_%d%s", device.UserID, suffix),
+		tombstonesTable: fmt.Sprintf("photo_tombstones_user_%d%s", device.UserID, suffix),
 	}
 }
 
-// ensureTableExists creates the photo table if it doesn't exist and migrates schema if needed
+// photoTableSuffix returns the suffix of the photo table names of a device
+// The original device keeps the tables named after the user alone, which predate devices
+func photoTableSuffix(device *models.Device) string {
+	if device.Original {
+		return ""
+	}
+	return fmt.Sprintf("_device_%d", device.ID)
+}
+
+// UserID returns the ID of the user whose photos this repository accesses
+func (r *PhotoRepository) UserID() uint {
+	return r.userID
+}
+
+// DeviceID returns the ID of the device whose photo library this repository accesses
+func (r *PhotoRepository) DeviceID() uint {
+	return r.deviceID
+}
+
+// migratedPhotoTables records which per-user photo tables have been migrated by this process
+var (
+	migratedPhotoTables  sync.Map
+	photoTableMigrations sync.Mutex
+)
+
+// ensureTableExists creates the photo tables if they don't exist and migrates schema if needed
 func (r *PhotoRepository) ensureTableExists() error {
-	// Check if table already exists
-	if r.db.Migrator().HasTable(r.tableName) {
+	// Check if table was already migrated by this process
+	if _, ok := migratedPhotoTables.Load(r.tableName); ok {
+		return nil
+	}
+
+	photoTableMigrations.Lock()
+	defer photoTableMigrations.Unlock()
+	if _, ok := migratedPhotoTables.Load(r.tableName); ok {
 		return nil
 	}
 
-	// Create the table with the custom name
+	// Create the table with the custom name, or add columns introduced since it was created
 	if err := r.db.Table(r.tableName).AutoMigrate(&models.Photo{}); err != nil {
 		return fmt.Errorf("failed to migrate photo table: %w", err)
 	}
+
+	if err := r.ensureFilesTable(); err != nil {
+		return err
+	}
+	if err := r.ensureMetadataTable(); err != nil {
+		return err
+	}
+	if err := r.ensureVersionsTable(); err != nil {
+		return err
+	}
+	if err := r.ensureTombstonesTable(); err != nil {
+		return err
+	}
+	if err := r.backfillChangeSeqs(); err != nil {
+		return err
+	}
+	if err := r.ensureUniqueNames(); err != nil {
+		return err
+	}
+
+	migratedPhotoTables.Store(r.tableName, true)
 	return nil
 }
 
@@ -46,7 +113,14 @@ func (r *PhotoRepository) Create(photo *models.Photo) error {
 	if err := r.ensureTableExists(); err != nil {
 		return err
 	}
-	if err := r.db.Table(r.tableName).Create(photo).Error; err != nil {
+	if err := r.withChangeSeq(func(tx *gorm.DB, seq int64) error {
+		photo.CreatedSeq, photo.ChangeSeq = seq, seq
+		if err := tx.Table(r.tableName).Create(photo).Error; err != nil {
+			return err
+		}
+		// A photo indexed again after being purged is no longer gone
+		return tx.Table(r.tombstonesTable).Where("local_id = ?", photo.LocalID).Delete(&models.PhotoTombstone{}).Error
+	}); err != nil {
 		return fmt.Errorf("failed to create photo: %w", err)
 	}
 	return nil
@@ -57,12 +131,69 @@ func (r *PhotoRepository) CreateBatch(photos []models.Photo) error {
 	if err := r.ensureTableExists(); err != nil {
 		return err
 	}
-	if err := r.db.Table(r.tableName).CreateInBatches(photos, 100).Error; err != nil {
+	if err := r.withChangeSeqs(len(photos), func(tx *gorm.DB, first int64) error {
+		for i := range photos {
+			photos[i].CreatedSeq = first + int64(i)
+			photos[i].ChangeSeq = photos[i].CreatedSeq
+		}
+		return tx.Table(r.tableName).CreateInBatches(photos, 100).Error
+	}); err != nil {
 		return fmt.Errorf("failed to create photo batch: %w", err)
 	}
 	return nil
 }
 
+// SequenceNamer turns the sequence numbers of a directory into file names and back
+type SequenceNamer interface {
+	GenerateFilename(sequenceNumber int) string
+	ParseSequence(fileName string) (int, bool)
+}
+
+// CreateNamed creates photo records in one transaction, naming each after the next sequence number
+// of its directory (FilePath), in the order given
+func (r *PhotoRepository) CreateNamed(photos []*models.Photo) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if len(photos) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for _, photo := range photos {
+		counts[photo.FilePath]++
+	}
+	if err := r.withChangeSeqs(len(photos), func(tx *gorm.DB, first int64) error {
+		next := make(map[string]int, len(counts))
+		for filePath, count := range counts {
+			sequence, err := r.takeNameSequences(tx, filePath, count)
+			if err != nil {
+				return err
+			}
+			next[filePath] = sequence
+		}
+
+		for i, photo := range photos {
+			photo.FileName = r.namer.GenerateFilename(next[photo.FilePath])
+			next[photo.FilePath]++
+			photo.CreatedSeq = first + int64(i)
+			photo.ChangeSeq = photo.CreatedSeq
+
+			if err := tx.Table(r.tableName).Create(photo).Error; err != nil {
+				return err
+			}
+			// A photo indexed again after being purged is no longer gone
+			if err := tx.Table(r.tombstonesTable).Where("local_id = ?", photo.LocalID).Delete(&models.PhotoTombstone{}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create photos: %w", err)
+	}
+	return nil
+}
+
 // FindByLocalID finds a photo by local_id
 func (r *PhotoRepository) FindByLocalID(localID string) (*models.Photo, error) {
 	if err := r.ensureTableExists(); err != nil {
@@ -90,26 +221,15 @@ func (r *PhotoRepository) GetByDate(date string) ([]models.Photo, error) {
 	return photos, nil
 }
 
-// GetCountByDate gets the count of photos for a specific date
-func (r *PhotoRepository) GetCountByDate(date string) (int, error) {
-	if err := r.ensureTableExists(); err != nil {
-		return 0, err
-	}
-	// Convert date format from YYYY-MM-DD to YYYY/MM/DD to match file_path structure
-	dateForPath := strings.ReplaceAll(date, "-", "/")
-	var count int64
-	if err := r.db.Table(r.tableName).Where("file_path LIKE ?", "%"+dateForPath+"%").Count(&count).Error; err != nil {
-		return 0, fmt.Errorf("failed to count photos by date: %w", err)
-	}
-	return int(count), nil
-}
-
 // Update updates a photo record
 func (r *PhotoRepository) Update(photo *models.Photo) error {
 	if err := r.ensureTableExists(); err != nil {
 		return err
 	}
-	if err := r.db.Table(r.tableName).Save(photo).Error; err != nil {
+	if err := r.withChangeSeq(func(tx *gorm.DB, seq int64) error {
+		photo.ChangeSeq = seq
+		return tx.Table(r.tableName).Save(photo).Error
+	}); err != nil {
 		return fmt.Errorf("failed to update photo: %w", err)
 	}
 	return nil
@@ -131,81 +251,77 @@ func (r *PhotoRepository) GetLocalIDs(date string) ([]string, error) {
 	if err := r.ensureTableExists(); err != nil {
 		return nil, err
 	}
+	// Convert date format from YYYY-MM-DD to YYYY/MM/DD to match file_path structure
+	dateForPath := strings.ReplaceAll(date, "-", "/")
 	var localIDs []string
-	if err := r.db.Table(r.tableName).Where("file_path LIKE ?", "%"+date+"%").Pluck("local_id", &localIDs).Error; err != nil {
+	// The model scope leaves out photos in the trash
+	if err := r.db.Table(r.tableName).Model(&models.Photo{}).Where("file_path LIKE ?", "%"+dateForPath+"%").Pluck("local_id", &localIDs).Error; err != nil {
 		return nil, fmt.Errorf("failed to get local IDs: %w", err)
 	}
 	return localIDs, nil
 }
 
-// GetUploadedExtensions returns the list of uploaded extensions for a photo
-func (r *PhotoRepository) GetUploadedExtensions(localID string) ([]string, error) {
+// GetAll retrieves all photo records for the user
+func (r *PhotoRepository) GetAll() ([]models.Photo, error) {
 	if err := r.ensureTableExists(); err != nil {
 		return nil, err
 	}
-	var photo models.Photo
-	if err := r.db.Table(r.tableName).Where("local_id = ?", localID).First(&photo).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("failed to get photo: %w", err)
+	var photos []models.Photo
+	if err := r.db.Table(r.tableName).Find(&photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to get all photos: %w", err)
 	}
+	return photos, nil
+}
 
-	// Parse JSON array from uploaded_extensions field
-	extensions := make([]string, 0)
-	if photo.UploadedExtensions != "" && photo.UploadedExtensions != "[]" {
-		if err := json.Unmarshal([]byte(photo.UploadedExtensions), &extensions); err != nil {
-			return nil, fmt.Errorf("failed to parse uploaded extensions: %w", err)
-		}
-	}
-	return extensions, nil
+// PhotoListOptions holds the filters and cursor position used by List
+type PhotoListOptions struct {
+	FromPath   string     // Inclusive lower bound on file_path (start date directory)
+	ToPath     string     // Exclusive upper bound on file_path (day after end date directory)
+	FileType   string     // Match on file_type, case-insensitive
+	Descending bool       // Sort newest first
+	AfterTime  *time.Time // Cursor: creation_time of the last photo already returned
+	AfterID    string     // Cursor: local_id of the last photo already returned
+	Limit      int
 }
 
-// AddUploadedExtension adds an extension to the uploaded extensions list if not already present
-func (r *PhotoRepository) AddUploadedExtension(localID string, extension string) error {
+// List retrieves a page of photo records ordered by creation_time, then local_id
+func (r *PhotoRepository) List(opts PhotoListOptions) ([]models.Photo, error) {
 	if err := r.ensureTableExists(); err != nil {
-		return err
+		return nil, err
 	}
 
-	// Get current extensions
-	extensions, err := r.GetUploadedExtensions(localID)
-	if err != nil {
-		return err
+	query := r.db.Table(r.tableName)
+	if opts.FromPath != "" {
+		query = query.Where("file_path >= ?", opts.FromPath)
 	}
-
-	// Check if extension already exists
-	for _, ext := range extensions {
-		if ext == extension {
-			// Extension already exists, no need to update
-			return nil
-		}
+	if opts.ToPath != "" {
+		query = query.Where("file_path < ?", opts.ToPath)
 	}
-
-	// Add new extension
-	extensions = append(extensions, extension)
-
-	// Marshal back to JSON
-	extensionsJSON, err := json.Marshal(extensions)
-	if err != nil {
-		return fmt.Errorf("failed to marshal extensions: %w", err)
+	if opts.FileType != "" {
+		query = query.Where("LOWER(file_type) = ?", strings.ToLower(opts.FileType))
 	}
 
-	// Update database
-	if err := r.db.Table(r.tableName).Where("local_id = ?", localID).Update("uploaded_extensions", string(extensionsJSON)).Error; err != nil {
-		return fmt.Errorf("failed to update uploaded extensions: %w", err)
+	direction := "ASC"
+	cmp := ">"
+	if opts.Descending {
+		direction = "DESC"
+		cmp = "<"
 	}
 
-	return nil
-}
-
-// GetAll retrieves all photo records for the user
-func (r *PhotoRepository) GetAll() ([]models.Photo, error) {
-	if err := r.ensureTableExists(); err != nil {
-		return nil, err
+	// Keyset pagination: continue strictly after the cursor position
+	if opts.AfterTime != nil {
+		query = query.Where(
+			fmt.Sprintf("creation_time %s ? OR (creation_time = ? AND local_id %s ?)", cmp, cmp),
+			*opts.AfterTime, *opts.AfterTime, opts.AfterID,
+		)
 	}
+
 	var photos []models.Photo
-	if err := r.db.Table(r.tableName).Find(&photos).Error; err != nil {
-		return nil, fmt.Errorf("failed to get all photos: %w", err)
+	if err := query.
+		Order(fmt.Sprintf("creation_time %s, local_id %s", direction, direction)).
+		Limit(opts.Limit).
+		Find(&photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to list photos: %w", err)
 	}
 	return photos, nil
 }
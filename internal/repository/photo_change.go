@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// ensureTombstonesTable creates the table recording photos purged from the trash
+func (r *PhotoRepository) ensureTombstonesTable() error {
+	if err := r.db.Table(r.tombstonesTable).AutoMigrate(&models.PhotoTombstone{}); err != nil {
+		return fmt.Errorf("failed to migrate photo tombstones table: %w", err)
+	}
+	return nil
+}
+
+// withChangeSeq runs fn in a transaction with the user's next change sequence number
+// The number is taken inside the transaction that writes it, so changes become visible in sequence order
+func (r *PhotoRepository) withChangeSeq(fn func(tx *gorm.DB, seq int64) error) error {
+	return r.withChangeSeqs(1, fn)
+}
+
+// withChangeSeqs runs fn in a transaction with the first of the user's next n change sequence numbers
+func (r *PhotoRepository) withChangeSeqs(n int, fn func(tx *gorm.DB, first int64) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var last int64
+		if err := tx.Raw(
+			"INSERT INTO change_sequences (user_id, value) VALUES (?, ?) "+
+				"ON CONFLICT (user_id) DO UPDATE SET value = value + excluded.value RETURNING value",
+			r.userID, n,
+		).Scan(&last).Error; err != nil {
+			return fmt.Errorf("failed to take change sequence number: %w", err)
+		}
+		return fn(tx, last-int64(n)+1)
+	})
+}
+
+// touch records a change of a photo that is not a change of its own columns
+func (r *PhotoRepository) touch(tx *gorm.DB, localID string, seq int64) error {
+	return tx.Table(r.tableName).Unscoped().Where("local_id = ?", localID).Update("change_seq", seq).Error
+}
+
+// backfillChangeSeqs numbers photos recorded before change tracking, oldest first,
+// so every photo has its own change sequence number
+func (r *PhotoRepository) backfillChangeSeqs() error {
+	var localIDs []string
+	if err := r.db.Table(r.tableName).
+		Where("change_seq = 0").
+		Order("creation_time, local_id").
+		Pluck("local_id", &localIDs).Error; err != nil {
+		return fmt.Errorf("failed to find photos without change sequence: %w", err)
+	}
+	if len(localIDs) == 0 {
+		return nil
+	}
+	if err := r.withChangeSeqs(len(localIDs), func(tx *gorm.DB, first int64) error {
+		for i, localID := range localIDs {
+			seq := first + int64(i)
+			if err := tx.Table(r.tableName).Where("local_id = ?", localID).
+				Updates(map[string]interface{}{"created_seq": seq, "change_seq": seq}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to backfill change sequence: %w", err)
+	}
+	return nil
+}
+
+// ListChangedSince returns photos changed after a change sequence number, including photos in the trash,
+// in change order
+func (r *PhotoRepository) ListChangedSince(since int64, limit int) ([]models.Photo, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var photos []models.Photo
+	if err := r.db.Table(r.tableName).Unscoped().
+		Where("change_seq > ?", since).
+		Order("change_seq").
+		Limit(limit).
+		Find(&photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to list changed photos: %w", err)
+	}
+	return photos, nil
+}
+
+// ListTombstonesSince returns photos purged after a change sequence number, in change order
+func (r *PhotoRepository) ListTombstonesSince(since int64, limit int) ([]models.PhotoTombstone, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var tombstones []models.PhotoTombstone
+	if err := r.db.Table(r.tombstonesTable).
+		Where("change_seq > ?", since).
+		Order("change_seq").
+		Limit(limit).
+		Find(&tombstones).Error; err != nil {
+		return nil, fmt.Errorf("failed to list purged photos: %w", err)
+	}
+	return tombstones, nil
+}
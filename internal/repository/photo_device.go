@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// FindByLocalIDs finds the photos with the given local_ids; unknown local_ids are skipped
+func (r *PhotoRepository) FindByLocalIDs(localIDs []string) ([]models.Photo, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var photos []models.Photo
+	if len(localIDs) == 0 {
+		return photos, nil
+	}
+	if err := r.db.Table(r.tableName).Where("local_id IN ?", localIDs).Order("local_id").Find(&photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to find photos: %w", err)
+	}
+	return photos, nil
+}
+
+// MarkDeviceDeleted records that photos were deleted from the device library
+// Photos already marked keep the time they were first reported; photos in the trash are left alone
+func (r *PhotoRepository) MarkDeviceDeleted(localIDs []string, at time.Time) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if len(localIDs) == 0 {
+		return nil
+	}
+	if err := r.db.Table(r.tableName).Model(&models.Photo{}).
+		Where("local_id IN ? AND device_deleted_at IS NULL", localIDs).
+		Update("device_deleted_at", at).Error; err != nil {
+		return fmt.Errorf("failed to mark photos deleted from device: %w", err)
+	}
+	return nil
+}
+
+// ClearDeviceDeleted records that photos are present in the device library again
+func (r *PhotoRepository) ClearDeviceDeleted(localIDs []string) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if len(localIDs) == 0 {
+		return nil
+	}
+	if err := r.db.Table(r.tableName).Model(&models.Photo{}).
+		Where("local_id IN ? AND device_deleted_at IS NOT NULL", localIDs).
+		Update("device_deleted_at", nil).Error; err != nil {
+		return fmt.Errorf("failed to clear device deletion: %w", err)
+	}
+	return nil
+}
+
+// ListDeviceDeletedBefore returns the photos first reported as deleted from the device before a cutoff
+func (r *PhotoRepository) ListDeviceDeletedBefore(before time.Time) ([]models.Photo, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var photos []models.Photo
+	if err := r.db.Table(r.tableName).
+		Where("device_deleted_at IS NOT NULL AND device_deleted_at < ?", before).
+		Order("device_deleted_at, local_id").
+		Find(&photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to list photos deleted from device: %w", err)
+	}
+	return photos, nil
+}
@@ -0,0 +1,277 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// legacyPhotoFileRow holds the JSON columns that tracked uploaded files before photo_files existed
+type legacyPhotoFileRow struct {
+	LocalID            string
+	UploadedExtensions string
+	UploadedFiles      string
+	UpdatedAt          time.Time
+}
+
+// legacyUploadedFile is the per-extension entry of the legacy uploaded_files JSON column
+type legacyUploadedFile struct {
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// ensureFilesTable creates the photo files table, converting the legacy
+// uploaded_extensions/uploaded_files JSON columns the first time it is created
+// Must be called after the photo table itself has been migrated
+func (r *PhotoRepository) ensureFilesTable() error {
+	migrator := r.db.Migrator()
+	existed := migrator.HasTable(r.filesTable)
+	hadRole := existed && migrator.HasColumn(r.filesTable, "role")
+
+	// Creating the table and converting the legacy columns is one transaction, so a failed
+	// conversion leaves no table behind and is retried the next time the table is needed
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(r.filesTable).AutoMigrate(&models.PhotoFile{}); err != nil {
+			return fmt.Errorf("failed to migrate photo files table: %w", err)
+		}
+
+		// One file record per photo, role and extension; upserts rely on this index.
+		// It replaces the per-extension index used before resources had roles
+		if err := tx.Exec(fmt.Sprintf("DROP INDEX IF EXISTS idx_%s_local_id_extension", r.filesTable)).Error; err != nil {
+			return fmt.Errorf("failed to drop photo files index: %w", err)
+		}
+		if err := tx.Exec(fmt.Sprintf(
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_local_id_role_extension ON %s (local_id, role, extension)",
+			r.filesTable, r.filesTable,
+		)).Error; err != nil {
+			return fmt.Errorf("failed to create photo files index: %w", err)
+		}
+
+		if !existed {
+			if err := r.migrateLegacyUploadedFiles(tx); err != nil {
+				return err
+			}
+		}
+		if hadRole {
+			return nil
+		}
+		return r.backfillFileRoles(tx)
+	})
+}
+
+// backfillFileRoles assigns roles to files recorded before resources had roles
+// Rows default to the photo role; adjustment sidecars and videos uploaded next to
+// an image asset (the motion component of a Live Photo) are given their own roles
+func (r *PhotoRepository) backfillFileRoles(tx *gorm.DB) error {
+	if err := tx.Table(r.filesTable).
+		Where("extension = ?", "aae").
+		Update("role", "adjustment_data").Error; err != nil {
+		return fmt.Errorf("failed to backfill adjustment data roles: %w", err)
+	}
+
+	videoExtensions := []string{"mov", "mp4", "m4v"}
+	imageAssets := tx.Table(r.tableName).Select("local_id").
+		Where("LOWER(file_type) NOT IN ? AND LOWER(file_type) NOT LIKE ?", videoExtensions, "video/%")
+	if err := tx.Table(r.filesTable).
+		Where("extension IN ? AND local_id IN (?)", videoExtensions, imageAssets).
+		Update("role", "paired_video").Error; err != nil {
+		return fmt.Errorf("failed to backfill paired video roles: %w", err)
+	}
+	return nil
+}
+
+// migrateLegacyUploadedFiles copies the JSON tracking columns of the photo table into photo_files
+// The legacy columns are left in place but are no longer read or written. Rows whose columns
+// cannot be parsed are logged and skipped, so one damaged row does not lose every other record
+func (r *PhotoRepository) migrateLegacyUploadedFiles(tx *gorm.DB) error {
+	migrator := tx.Migrator()
+	if !migrator.HasColumn(r.tableName, "uploaded_extensions") {
+		return nil
+	}
+	hasFiles := migrator.HasColumn(r.tableName, "uploaded_files")
+
+	columns := "local_id, uploaded_extensions, updated_at"
+	if hasFiles {
+		columns += ", uploaded_files"
+	}
+
+	var rows []legacyPhotoFileRow
+	if err := tx.Table(r.tableName).Select(columns).
+		Where("uploaded_extensions IS NOT NULL AND uploaded_extensions NOT IN ('', '[]')").
+		Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to read legacy uploaded extensions: %w", err)
+	}
+
+	var files []models.PhotoFile
+	for _, row := range rows {
+		var extensions []string
+		if err := json.Unmarshal([]byte(row.UploadedExtensions), &extensions); err != nil {
+			tx.Logger.Warn(context.Background(), "skipping uploaded extensions of %s in %s: %v", row.LocalID, r.tableName, err)
+			continue
+		}
+
+		// Without the details the files are still recorded, only without size and hash
+		details := make(map[string]legacyUploadedFile)
+		if row.UploadedFiles != "" && row.UploadedFiles != "{}" {
+			if err := json.Unmarshal([]byte(row.UploadedFiles), &details); err != nil {
+				tx.Logger.Warn(context.Background(), "skipping uploaded file details of %s in %s: %v", row.LocalID, r.tableName, err)
+				details = make(map[string]legacyUploadedFile)
+			}
+		}
+
+		for _, ext := range extensions {
+			file := models.PhotoFile{
+				LocalID:    row.LocalID,
+				Extension:  ext,
+				UploadedAt: row.UpdatedAt,
+			}
+			if detail, ok := details[ext]; ok {
+				file.Size = detail.Size
+				file.SHA256 = detail.SHA256
+				file.UploadedAt = detail.UploadedAt
+			}
+			files = append(files, file)
+		}
+	}
+
+	// Extensions already recorded under any role are kept as they are, so converting again after
+	// roles were backfilled does not add a second, photo-role record for the same file
+	var recorded []models.PhotoFile
+	if err := tx.Table(r.filesTable).Select("local_id, extension").Find(&recorded).Error; err != nil {
+		return fmt.Errorf("failed to read recorded photo files: %w", err)
+	}
+	if len(recorded) > 0 {
+		seen := make(map[[2]string]bool, len(recorded))
+		for _, file := range recorded {
+			seen[[2]string{file.LocalID, file.Extension}] = true
+		}
+		pending := files[:0]
+		for _, file := range files {
+			if !seen[[2]string{file.LocalID, file.Extension}] {
+				pending = append(pending, file)
+			}
+		}
+		files = pending
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+	if err := tx.Table(r.filesTable).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		CreateInBatches(files, 100).Error; err != nil {
+		return fmt.Errorf("failed to migrate legacy uploaded files: %w", err)
+	}
+	return nil
+}
+
+// AddUploadedFile records an uploaded file, replacing any previous record for the same role and extension
+// This is a single upsert, so concurrent uploads of the same photo cannot lose each other's records
+func (r *PhotoRepository) AddUploadedFile(file *models.PhotoFile) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if err := r.withChangeSeq(func(tx *gorm.DB, seq int64) error {
+		file.ChangeSeq = seq
+		if err := tx.Table(r.filesTable).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "local_id"}, {Name: "role"}, {Name: "extension"}},
+			DoUpdates: clause.AssignmentColumns([]string{"size", "sha256", "mime_type", "content_mismatch", "device", "version", "change_seq", "uploaded_at", "updated_at"}),
+		}).Create(file).Error; err != nil {
+			return err
+		}
+		return r.touch(tx, file.LocalID, seq)
+	}); err != nil {
+		return fmt.Errorf("failed to record uploaded file: %w", err)
+	}
+	return nil
+}
+
+// GetFiles returns the uploaded file records of a photo in upload order
+func (r *PhotoRepository) GetFiles(localID string) ([]models.PhotoFile, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var files []models.PhotoFile
+	if err := r.db.Table(r.filesTable).Where("local_id = ?", localID).Order("id").Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to get photo files: %w", err)
+	}
+	return files, nil
+}
+
+// GetUploadedExtensions returns the list of uploaded extensions for a photo
+// An extension uploaded under several roles is listed once
+func (r *PhotoRepository) GetUploadedExtensions(localID string) ([]string, error) {
+	byLocalID, err := r.GetUploadedExtensionsByLocalIDs([]string{localID})
+	if err != nil {
+		return nil, err
+	}
+	extensions, ok := byLocalID[localID]
+	if !ok {
+		return make([]string, 0), nil
+	}
+	return extensions, nil
+}
+
+// GetUploadedExtensionsByLocalIDs returns uploaded extensions for several photos in one query
+// Photos without uploaded files are absent from the result
+func (r *PhotoRepository) GetUploadedExtensionsByLocalIDs(localIDs []string) (map[string][]string, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]string)
+	if len(localIDs) == 0 {
+		return result, nil
+	}
+
+	var files []models.PhotoFile
+	if err := r.db.Table(r.filesTable).
+		Select("local_id, extension").
+		Where("local_id IN ?", localIDs).
+		Order("id").
+		Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to get uploaded extensions: %w", err)
+	}
+
+	seen := make(map[string]map[string]bool)
+	for _, file := range files {
+		if seen[file.LocalID] == nil {
+			seen[file.LocalID] = make(map[string]bool)
+		}
+		if seen[file.LocalID][file.Extension] {
+			continue
+		}
+		seen[file.LocalID][file.Extension] = true
+		result[file.LocalID] = append(result[file.LocalID], file.Extension)
+	}
+	return result, nil
+}
+
+// GetFilesByLocalIDs returns the uploaded file records of several photos in one query
+// Photos without uploaded files are absent from the result
+func (r *PhotoRepository) GetFilesByLocalIDs(localIDs []string) (map[string][]models.PhotoFile, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]models.PhotoFile)
+	if len(localIDs) == 0 {
+		return result, nil
+	}
+
+	var files []models.PhotoFile
+	if err := r.db.Table(r.filesTable).Where("local_id IN ?", localIDs).Order("id").Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to get photo files: %w", err)
+	}
+	for _, file := range files {
+		result[file.LocalID] = append(result[file.LocalID], file)
+	}
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+func TestMigrateLegacyUploadedFiles(t *testing.T) {
+	db := newTestDB(t)
+
+	// The photo table as created before photo_files, with the JSON tracking columns
+	if err := db.Exec(`CREATE TABLE photos_user_1 (
+		local_id text PRIMARY KEY,
+		creation_time datetime NOT NULL,
+		file_path text NOT NULL,
+		file_name text NOT NULL,
+		file_type text NOT NULL,
+		file_count integer DEFAULT 0,
+		uploaded_extensions text DEFAULT '[]',
+		uploaded_files text,
+		created_at datetime,
+		updated_at datetime,
+		deleted_at datetime
+	)`).Error; err != nil {
+		t.Fatal(err)
+	}
+	updatedAt := time.Date(2025, 12, 10, 12, 0, 0, 0, time.UTC)
+	rows := []struct {
+		localID    string
+		fileType   string
+		extensions string
+		files      string
+	}{
+		{"live", "jpg", `["jpg","mov"]`, `{"jpg":{"size":100,"sha256":"aa","uploaded_at":"2025-12-10T10:00:00Z"}}`},
+		{"edited", "heic", `["heic","aae"]`, `{}`},
+		{"bad-details", "png", `["png"]`, `{"png":`},
+		{"bad-extensions", "jpg", `["jpg"`, ``},
+		{"none", "jpg", `[]`, ``},
+	}
+	for i, row := range rows {
+		if err := db.Exec(
+			"INSERT INTO photos_user_1 (local_id, creation_time, file_path, file_name, file_type, uploaded_extensions, uploaded_files, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			row.localID, updatedAt, "./storage/photo/1/2025/12/10", testNamer{}.GenerateFilename(i+1), row.fileType, row.extensions, row.files, updatedAt, updatedAt,
+		).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := NewPhotoRepository(db, &models.Device{ID: 1, UserID: 1, Original: true}, testNamer{})
+	if err := repo.ensureTableExists(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := storedFiles(t, repo)
+
+	type file struct {
+		localID, role, extension string
+		size                     int64
+		sha256                   string
+		uploadedAt               time.Time
+	}
+	var got []file
+	for _, f := range first {
+		got = append(got, file{f.LocalID, f.Role, f.Extension, f.Size, f.SHA256, f.UploadedAt.UTC()})
+	}
+	want := []file{
+		{"live", "photo", "jpg", 100, "aa", time.Date(2025, 12, 10, 10, 0, 0, 0, time.UTC)},
+		{"live", "paired_video", "mov", 0, "", updatedAt},
+		{"edited", "photo", "heic", 0, "", updatedAt},
+		{"edited", "adjustment_data", "aae", 0, "", updatedAt},
+		{"bad-details", "photo", "png", 0, "", updatedAt},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("migrated files =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// Neither migrating the table again nor converting the legacy columns again changes the records
+	migratedPhotoTables.Delete(repo.tableName)
+	if err := repo.ensureTableExists(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.migrateLegacyUploadedFiles(db); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second := storedFiles(t, repo); !reflect.DeepEqual(second, first) {
+		t.Errorf("files after a second run =\n%+v\nwant\n%+v", second, first)
+	}
+}
+
+// storedFiles returns the photo_files rows of a repository in insertion order
+func storedFiles(t *testing.T, repo *PhotoRepository) []models.PhotoFile {
+	t.Helper()
+	var files []models.PhotoFile
+	if err := repo.db.Table(repo.filesTable).Order("id").Find(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
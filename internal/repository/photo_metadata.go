@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"fmt"
+
+	"gorm.io/gorm/clause"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// ensureMetadataTable creates the photo metadata table
+func (r *PhotoRepository) ensureMetadataTable() error {
+	migrator := r.db.Migrator()
+	staleRoles := migrator.HasTable(r.metadataTable) && !migrator.HasColumn(r.metadataTable, "role")
+
+	if err := r.db.Table(r.metadataTable).AutoMigrate(&models.PhotoMetadata{}); err != nil {
+		return fmt.Errorf("failed to migrate photo metadata table: %w", err)
+	}
+
+	// Records written before resources had roles cannot be matched to a file;
+	// they are dropped and extracted again when next requested
+	if staleRoles {
+		if err := r.db.Exec(fmt.Sprintf("DELETE FROM %s", r.metadataTable)).Error; err != nil {
+			return fmt.Errorf("failed to reset photo metadata: %w", err)
+		}
+	}
+
+	// One metadata record per photo, role and extension; upserts rely on this index
+	if err := r.db.Exec(fmt.Sprintf("DROP INDEX IF EXISTS idx_%s_local_id_extension", r.metadataTable)).Error; err != nil {
+		return fmt.Errorf("failed to drop photo metadata index: %w", err)
+	}
+	if err := r.db.Exec(fmt.Sprintf(
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_local_id_role_extension ON %s (local_id, role, extension)",
+		r.metadataTable, r.metadataTable,
+	)).Error; err != nil {
+		return fmt.Errorf("failed to create photo metadata index: %w", err)
+	}
+	return nil
+}
+
+// SaveMetadata records the metadata of an uploaded file, replacing any previous record for the same role and extension
+func (r *PhotoRepository) SaveMetadata(metadata *models.PhotoMetadata) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if err := r.db.Table(r.metadataTable).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "local_id"}, {Name: "role"}, {Name: "extension"}},
+		UpdateAll: true,
+	}).Create(metadata).Error; err != nil {
+		return fmt.Errorf("failed to save photo metadata: %w", err)
+	}
+	return nil
+}
+
+// GetMetadata returns the metadata records of a photo, one per file it was extracted from
+func (r *PhotoRepository) GetMetadata(localID string) ([]models.PhotoMetadata, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var metadata []models.PhotoMetadata
+	if err := r.db.Table(r.metadataTable).Where("local_id = ?", localID).Order("id").Find(&metadata).Error; err != nil {
+		return nil, fmt.Errorf("failed to get photo metadata: %w", err)
+	}
+	return metadata, nil
+}
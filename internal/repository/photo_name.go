@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// takeNameSequences takes the next n file name sequence numbers of a directory inside tx and returns the first
+// The counter is shared by all of the user's devices, whose photos are stored side by side
+// A directory without a counter yet starts after the highest number in use there, photos in the trash included
+// tx must already hold the database write lock (withChangeSeqs takes it first), so that no other
+// transaction reads the same counter or names in between
+func (r *PhotoRepository) takeNameSequences(tx *gorm.DB, filePath string, n int) (int, error) {
+	var counters []models.NameSequence
+	if err := tx.Where("user_id = ? AND file_path = ?", r.userID, filePath).Limit(1).Find(&counters).Error; err != nil {
+		return 0, fmt.Errorf("failed to read name sequence: %w", err)
+	}
+	start := 0
+	if len(counters) == 0 {
+		highest, err := r.highestSequence(tx, filePath)
+		if err != nil {
+			return 0, err
+		}
+		start = highest
+	}
+
+	var last int
+	if err := tx.Raw(
+		"INSERT INTO name_sequences (user_id, file_path, value) VALUES (?, ?, ?) "+
+			"ON CONFLICT (user_id, file_path) DO UPDATE SET value = value + ? RETURNING value",
+		r.userID, filePath, start+n, n,
+	).Scan(&last).Error; err != nil {
+		return 0, fmt.Errorf("failed to take name sequence number: %w", err)
+	}
+	return last - n + 1, nil
+}
+
+// highestSequence returns the highest file name sequence number in use in a directory, 0 if none
+// The directories of a date are shared by all of the user's devices, so every device library is searched
+func (r *PhotoRepository) highestSequence(tx *gorm.DB, filePath string) (int, error) {
+	var devices []models.Device
+	if err := tx.Where("user_id = ?", r.userID).Find(&devices).Error; err != nil {
+		return 0, fmt.Errorf("failed to list devices: %w", err)
+	}
+	tables := []string{r.tableName}
+	for i := range devices {
+		table := fmt.Sprintf("photos_user_%d%s", r.userID, photoTableSuffix(&devices[i]))
+		if table != r.tableName && tx.Migrator().HasTable(table) {
+			tables = append(tables, table)
+		}
+	}
+
+	highest := 0
+	for _, table := range tables {
+		var fileNames []string
+		if err := tx.Table(table).Where("file_path = ?", filePath).Pluck("file_name", &fileNames).Error; err != nil {
+			return 0, fmt.Errorf("failed to get file names: %w", err)
+		}
+		for _, fileName := range fileNames {
+			if sequence, ok := r.namer.ParseSequence(fileName); ok && sequence > highest {
+				highest = sequence
+			}
+		}
+	}
+	return highest, nil
+}
+
+// duplicateName is a photo that was given the name of an earlier photo in the same directory
+type duplicateName struct {
+	LocalID  string
+	FilePath string
+}
+
+// ensureUniqueNames creates the unique index on (file_path, file_name)
+// Before names were allocated transactionally, concurrent indexing could give two photos the same name.
+// All but the first indexed of them are renamed; their file, metadata and version records are dropped,
+// since the files on disk were shared, so clients see them as not uploaded and upload them again
+func (r *PhotoRepository) ensureUniqueNames() error {
+	indexName := fmt.Sprintf("idx_%s_file_path_file_name", r.tableName)
+	if r.db.Migrator().HasIndex(r.tableName, indexName) {
+		return nil
+	}
+
+	var duplicates []duplicateName
+	if err := r.db.Raw(fmt.Sprintf(
+		"SELECT p.local_id, p.file_path FROM %[1]s p WHERE EXISTS ("+
+			"SELECT 1 FROM %[1]s q WHERE q.file_path = p.file_path AND q.file_name = p.file_name "+
+			"AND (q.created_seq < p.created_seq OR (q.created_seq = p.created_seq AND q.local_id < p.local_id))"+
+			") ORDER BY p.created_seq, p.local_id",
+		r.tableName,
+	)).Scan(&duplicates).Error; err != nil {
+		return fmt.Errorf("failed to find duplicate photo names: %w", err)
+	}
+
+	if len(duplicates) > 0 {
+		if err := r.withChangeSeqs(len(duplicates), func(tx *gorm.DB, first int64) error {
+			for i, duplicate := range duplicates {
+				sequence, err := r.takeNameSequences(tx, duplicate.FilePath, 1)
+				if err != nil {
+					return err
+				}
+				if err := tx.Table(r.tableName).Where("local_id = ?", duplicate.LocalID).
+					Updates(map[string]interface{}{
+						"file_name":  r.namer.GenerateFilename(sequence),
+						"file_count": 0,
+						"change_seq": first + int64(i),
+					}).Error; err != nil {
+					return err
+				}
+				if err := tx.Table(r.filesTable).Where("local_id = ?", duplicate.LocalID).Delete(&models.PhotoFile{}).Error; err != nil {
+					return err
+				}
+				if err := tx.Table(r.metadataTable).Where("local_id = ?", duplicate.LocalID).Delete(&models.PhotoMetadata{}).Error; err != nil {
+					return err
+				}
+				if err := tx.Table(r.versionsTable).Where("local_id = ?", duplicate.LocalID).Delete(&models.PhotoVersion{}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to rename duplicate photo names: %w", err)
+		}
+	}
+
+	if err := r.db.Exec(fmt.Sprintf(
+		"CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (file_path, file_name)",
+		indexName, r.tableName,
+	)).Error; err != nil {
+		return fmt.Errorf("failed to create photo names index: %w", err)
+	}
+	return nil
+}
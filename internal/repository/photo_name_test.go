@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// testNamer names photos IMG_0001, IMG_0002, ... like the service's PhotoNaming
+type testNamer struct{}
+
+func (testNamer) GenerateFilename(sequenceNumber int) string {
+	return fmt.Sprintf("IMG_%04d", sequenceNumber)
+}
+
+func (testNamer) ParseSequence(fileName string) (int, bool) {
+	number, err := strconv.Atoi(strings.TrimPrefix(fileName, "IMG_"))
+	return number, err == nil && number > 0
+}
+
+func TestCreateNamedConcurrently(t *testing.T) {
+	db := newTestDB(t)
+	devices := []*models.Device{
+		{UserID: 1, Identifier: "phone", Original: true},
+		{UserID: 1, Identifier: "tablet"},
+	}
+	for _, device := range devices {
+		if err := db.Create(device).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	repos := []*PhotoRepository{
+		NewPhotoRepository(db, devices[0], testNamer{}),
+		NewPhotoRepository(db, devices[1], testNamer{}),
+	}
+
+	// A photo named before the directory had a counter; numbering continues after it
+	const filePath = "./storage/photo/1/2025/12/10"
+	day := time.Date(2025, 12, 10, 0, 0, 0, 0, time.UTC)
+	if err := repos[0].Create(&models.Photo{LocalID: "legacy", CreationTime: day, FilePath: filePath, FileName: "IMG_0007", FileType: "jpg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both devices index the same date at once, in batches given in creation time order
+	const workers, batches, batchSize = 8, 4, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*batches)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			repo := repos[w%len(repos)]
+			for b := 0; b < batches; b++ {
+				photos := make([]*models.Photo, batchSize)
+				for i := range photos {
+					photos[i] = &models.Photo{
+						LocalID:      fmt.Sprintf("w%d-b%d-%d", w, b, i),
+						CreationTime: day.Add(time.Duration(w*batches*batchSize+b*batchSize+i) * time.Minute),
+						FilePath:     filePath,
+						FileType:     "jpg",
+					}
+				}
+				if err := repo.CreateNamed(photos); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var photos []models.Photo
+	for _, repo := range repos {
+		var stored []models.Photo
+		if err := db.Table(repo.tableName).Where("local_id != ?", "legacy").Find(&stored).Error; err != nil {
+			t.Fatal(err)
+		}
+		photos = append(photos, stored...)
+	}
+	if len(photos) != workers*batches*batchSize {
+		t.Fatalf("stored %d photos, want %d", len(photos), workers*batches*batchSize)
+	}
+
+	// Names are unique across both devices and numbered without gaps after the existing photo
+	sequences := make([]int, 0, len(photos))
+	batchPhotos := make(map[string][]models.Photo)
+	for _, photo := range photos {
+		sequence, ok := testNamer{}.ParseSequence(photo.FileName)
+		if !ok {
+			t.Fatalf("photo %s has name %q", photo.LocalID, photo.FileName)
+		}
+		sequences = append(sequences, sequence)
+		batch := photo.LocalID[:strings.LastIndex(photo.LocalID, "-")]
+		batchPhotos[batch] = append(batchPhotos[batch], photo)
+	}
+	sort.Ints(sequences)
+	for i, sequence := range sequences {
+		if sequence != 8+i {
+			t.Fatalf("sequence numbers = %v, want 8 to %d without gaps or duplicates", sequences, 7+len(sequences))
+		}
+	}
+
+	// Within a batch, names are consecutive and follow creation time
+	for batch, photos := range batchPhotos {
+		sort.Slice(photos, func(i, j int) bool { return photos[i].CreationTime.Before(photos[j].CreationTime) })
+		first, _ := testNamer{}.ParseSequence(photos[0].FileName)
+		for i, photo := range photos {
+			if sequence, _ := (testNamer{}).ParseSequence(photo.FileName); sequence != first+i {
+				t.Errorf("batch %s: %s taken at %s is %s, want IMG_%04d", batch, photo.LocalID, photo.CreationTime.Format(time.Kitchen), photo.FileName, first+i)
+			}
+		}
+	}
+}
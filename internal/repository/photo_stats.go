@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// PhotoStats summarizes a photo library
+type PhotoStats struct {
+	Photos       int64      // Photos outside the trash
+	Trashed      int64      // Photos in the trash
+	Files        int64      // Uploaded files of the photos outside the trash
+	Bytes        int64      // Total size of those files
+	LastUploadAt *time.Time // When the latest of those files was uploaded; nil if there are none
+}
+
+// Stats counts the photos and uploaded files of the library
+func (r *PhotoRepository) Stats() (*PhotoStats, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+
+	var stats PhotoStats
+	if err := r.db.Table(r.tableName).Model(&models.Photo{}).Count(&stats.Photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to count photos: %w", err)
+	}
+	if err := r.db.Table(r.tableName).Unscoped().Where("deleted_at IS NOT NULL").Count(&stats.Trashed).Error; err != nil {
+		return nil, fmt.Errorf("failed to count photos in trash: %w", err)
+	}
+
+	activePhotos := r.db.Table(r.tableName).Select("local_id").Where("deleted_at IS NULL")
+	var totals struct {
+		Files int64
+		Bytes int64
+	}
+	if err := r.db.Table(r.filesTable).
+		Select("COUNT(*) AS files, COALESCE(SUM(size), 0) AS bytes").
+		Where("local_id IN (?)", activePhotos).
+		Scan(&totals).Error; err != nil {
+		return nil, fmt.Errorf("failed to count photo files: %w", err)
+	}
+	stats.Files, stats.Bytes = totals.Files, totals.Bytes
+
+	var latest []models.PhotoFile
+	if err := r.db.Table(r.filesTable).
+		Where("local_id IN (?)", activePhotos).
+		Order("uploaded_at DESC").
+		Limit(1).
+		Find(&latest).Error; err != nil {
+		return nil, fmt.Errorf("failed to find latest upload: %w", err)
+	}
+	if len(latest) > 0 {
+		stats.LastUploadAt = &latest[0].UploadedAt
+	}
+	return &stats, nil
+}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// SoftDelete moves a photo to the trash by setting its deleted_at
+// Returns false if there is no photo with this local_id outside the trash
+func (r *PhotoRepository) SoftDelete(localID string) (bool, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return false, err
+	}
+	deleted := false
+	err := r.withChangeSeq(func(tx *gorm.DB, seq int64) error {
+		result := tx.Table(r.tableName).Model(&models.Photo{}).
+			Where("local_id = ?", localID).
+			Updates(map[string]interface{}{"deleted_at": time.Now(), "change_seq": seq})
+		deleted = result.RowsAffected > 0
+		return result.Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete photo: %w", err)
+	}
+	return deleted, nil
+}
+
+// Restore takes a photo out of the trash
+// A restored photo is no longer considered deleted from the device either
+// Returns false if the photo is not in the trash
+func (r *PhotoRepository) Restore(localID string) (bool, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return false, err
+	}
+	restored := false
+	err := r.withChangeSeq(func(tx *gorm.DB, seq int64) error {
+		result := tx.Table(r.tableName).Unscoped().
+			Where("local_id = ? AND deleted_at IS NOT NULL", localID).
+			Updates(map[string]interface{}{"deleted_at": nil, "device_deleted_at": nil, "change_seq": seq})
+		restored = result.RowsAffected > 0
+		return result.Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to restore photo: %w", err)
+	}
+	return restored, nil
+}
+
+// FindDeleted finds a photo in the trash by local_id
+// Returns nil without an error if the photo is not in the trash
+func (r *PhotoRepository) FindDeleted(localID string) (*models.Photo, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var photo models.Photo
+	if err := r.db.Table(r.tableName).Unscoped().
+		Where("local_id = ? AND deleted_at IS NOT NULL", localID).
+		First(&photo).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find deleted photo: %w", err)
+	}
+	return &photo, nil
+}
+
+// FindDeletedByLocalIDs finds the photos in the trash with the given local_ids; others are skipped
+func (r *PhotoRepository) FindDeletedByLocalIDs(localIDs []string) ([]models.Photo, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var photos []models.Photo
+	if len(localIDs) == 0 {
+		return photos, nil
+	}
+	if err := r.db.Table(r.tableName).Unscoped().
+		Where("local_id IN ? AND deleted_at IS NOT NULL", localIDs).
+		Order("local_id").
+		Find(&photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to find deleted photos: %w", err)
+	}
+	return photos, nil
+}
+
+// ListDeleted returns the photos in the trash, most recently deleted first
+// With a non-zero before, only photos deleted before that time are returned
+func (r *PhotoRepository) ListDeleted(before time.Time) ([]models.Photo, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	query := r.db.Table(r.tableName).Unscoped().Where("deleted_at IS NOT NULL")
+	if !before.IsZero() {
+		query = query.Where("deleted_at < ?", before)
+	}
+	var photos []models.Photo
+	if err := query.Order("deleted_at DESC, local_id").Find(&photos).Error; err != nil {
+		return nil, fmt.Errorf("failed to list deleted photos: %w", err)
+	}
+	return photos, nil
+}
+
+// Purge permanently removes a photo in the trash together with its file, metadata and version records
+// A tombstone keeps the removal visible to clients syncing changes
+func (r *PhotoRepository) Purge(localID string) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	err := r.withChangeSeq(func(tx *gorm.DB, seq int64) error {
+		if err := tx.Table(r.filesTable).Where("local_id = ?", localID).Delete(&models.PhotoFile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(r.metadataTable).Where("local_id = ?", localID).Delete(&models.PhotoMetadata{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(r.versionsTable).Where("local_id = ?", localID).Delete(&models.PhotoVersion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(r.tableName).Unscoped().
+			Where("local_id = ? AND deleted_at IS NOT NULL", localID).
+			Delete(&models.Photo{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(r.tombstonesTable).Save(&models.PhotoTombstone{LocalID: localID, ChangeSeq: seq, PurgedAt: time.Now()}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge photo: %w", err)
+	}
+	return nil
+}
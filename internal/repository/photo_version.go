@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// ensureVersionsTable creates the photo versions table
+func (r *PhotoRepository) ensureVersionsTable() error {
+	if err := r.db.Table(r.versionsTable).AutoMigrate(&models.PhotoVersion{}); err != nil {
+		return fmt.Errorf("failed to migrate photo versions table: %w", err)
+	}
+
+	// One record per version of a file
+	if err := r.db.Exec(fmt.Sprintf(
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_local_id_role_extension_version ON %s (local_id, role, extension, version)",
+		r.versionsTable, r.versionsTable,
+	)).Error; err != nil {
+		return fmt.Errorf("failed to create photo versions index: %w", err)
+	}
+	return nil
+}
+
+// AddVersion records a replaced version of a file
+func (r *PhotoRepository) AddVersion(version *models.PhotoVersion) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if err := r.db.Table(r.versionsTable).Create(version).Error; err != nil {
+		return fmt.Errorf("failed to record photo version: %w", err)
+	}
+	return nil
+}
+
+// GetVersions returns the replaced versions of all files of a photo, oldest first
+func (r *PhotoRepository) GetVersions(localID string) ([]models.PhotoVersion, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var versions []models.PhotoVersion
+	if err := r.db.Table(r.versionsTable).
+		Where("local_id = ?", localID).
+		Order("role, extension, version").
+		Find(&versions).Error; err != nil {
+		return nil, fmt.Errorf("failed to get photo versions: %w", err)
+	}
+	return versions, nil
+}
+
+// FindVersion finds one replaced version of a file
+// Returns nil without an error if the version is not kept
+func (r *PhotoRepository) FindVersion(localID, role, extension string, version int) (*models.PhotoVersion, error) {
+	if err := r.ensureTableExists(); err != nil {
+		return nil, err
+	}
+	var record models.PhotoVersion
+	if err := r.db.Table(r.versionsTable).
+		Where("local_id = ? AND role = ? AND extension = ? AND version = ?", localID, role, extension, version).
+		First(&record).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find photo version: %w", err)
+	}
+	return &record, nil
+}
+
+// DeleteVersion removes the record of a replaced version
+func (r *PhotoRepository) DeleteVersion(id uint) error {
+	if err := r.ensureTableExists(); err != nil {
+		return err
+	}
+	if err := r.db.Table(r.versionsTable).Delete(&models.PhotoVersion{}, id).Error; err != nil {
+		return fmt.Errorf("failed to delete photo version: %w", err)
+	}
+	return nil
+}
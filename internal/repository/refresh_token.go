@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// CreateRefreshToken stores a new refresh token of a family
+func (r *TokenRepository) CreateRefreshToken(userID, deviceID uint, familyID, value string, expiresAt time.Time) error {
+	token := &models.RefreshToken{
+		UserID:    userID,
+		DeviceID:  deviceID,
+		FamilyID:  familyID,
+		TokenHash: tokenDigest(value),
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if err := r.db.Create(token).Error; err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+	return nil
+}
+
+// RotateRefreshToken exchanges the current refresh token of a family for next
+// Returns the presented token and whether it was exchanged. A token that was already exchanged or has
+// expired is returned unchanged, so the caller can tell reuse from expiry; nil means there is no such token
+func (r *TokenRepository) RotateRefreshToken(value, next string, nextExpiresAt time.Time) (*models.RefreshToken, bool, error) {
+	now := time.Now()
+	var token models.RefreshToken
+	rotated := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Marking the token used first takes the database write lock, so concurrent exchanges of one token
+		// cannot both succeed
+		result := tx.Model(&models.RefreshToken{}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenDigest(value), now).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if err := tx.Where("token_hash = ?", tokenDigest(value)).First(&token).Error; err != nil {
+			return err
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		rotated = true
+		return tx.Create(&models.RefreshToken{
+			UserID:    token.UserID,
+			DeviceID:  token.DeviceID,
+			FamilyID:  token.FamilyID,
+			TokenHash: tokenDigest(next),
+			CreatedAt: now,
+			ExpiresAt: nextExpiresAt,
+		}).Error
+	})
+	if err == gorm.ErrRecordNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	return &token, rotated, nil
+}
+
+// DeleteFamily deletes the refresh tokens of a family and the access tokens issued to it
+func (r *TokenRepository) DeleteFamily(familyID string) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("family_id = ?", familyID).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("family_id = ?", familyID).Delete(&models.Token{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete token family: %w", err)
+	}
+	return nil
+}
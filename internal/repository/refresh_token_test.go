@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	repo := NewTokenRepository(newTestDB(t))
+	hour := time.Now().Add(time.Hour)
+	if err := repo.CreateRefreshToken(1, 2, "family", "current", hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateRefreshToken(1, 2, "stale", "expired", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The current token is exchanged once and the new token joins its family
+	used, rotated, err := repo.RotateRefreshToken("current", "next", hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if used == nil || !rotated || used.FamilyID != "family" || used.DeviceID != 2 {
+		t.Fatalf("rotate current = %+v, %v, want family token rotated", used, rotated)
+	}
+
+	// Its replacement is now the current token of the family
+	next, rotated, err := repo.RotateRefreshToken("next", "after-next", hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next == nil || !rotated || next.FamilyID != "family" {
+		t.Fatalf("rotate next = %+v, %v, want family token rotated", next, rotated)
+	}
+
+	tests := []struct {
+		name       string
+		value      string
+		wantToken  bool
+		wantUsed   bool
+		wantFamily string
+	}{
+		{name: "exchanged token", value: "current", wantToken: true, wantUsed: true, wantFamily: "family"},
+		{name: "expired token", value: "expired", wantToken: true, wantUsed: false, wantFamily: "stale"},
+		{name: "unknown token", value: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used, rotated, err := repo.RotateRefreshToken(tt.value, "other-"+tt.value, hour)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.wantToken {
+				if used != nil || rotated {
+					t.Fatalf("rotate = %+v, %v, want nil", used, rotated)
+				}
+				return
+			}
+			if used == nil || rotated {
+				t.Fatalf("rotate = %+v, %v, want token not rotated", used, rotated)
+			}
+			if (used.UsedAt != nil) != tt.wantUsed || used.FamilyID != tt.wantFamily {
+				t.Errorf("token used_at = %v, family = %q, want used %v, family %q", used.UsedAt, used.FamilyID, tt.wantUsed, tt.wantFamily)
+			}
+		})
+	}
+}
+
+func TestClaimLegacyToken(t *testing.T) {
+	repo := NewTokenRepository(newTestDB(t))
+	hour := time.Now().Add(time.Hour)
+	tokens := map[string]*models.Token{
+		"legacy":  {UserID: 1, DeviceID: 3, ExpiresAt: hour},
+		"session": {UserID: 1, FamilyID: "family", ExpiresAt: hour},
+		"expired": {UserID: 1, ExpiresAt: time.Now().Add(-time.Minute)},
+	}
+	for value, token := range tokens {
+		if err := repo.Create(token, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token, err := repo.ClaimLegacyToken("legacy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token == nil || token.UserID != 1 || token.DeviceID != 3 {
+		t.Fatalf("claim legacy = %+v, want the token of device 3", token)
+	}
+	if found, _ := repo.FindValidToken("legacy"); found != nil {
+		t.Errorf("claimed token is still valid")
+	}
+
+	for _, value := range []string{"legacy", "session", "expired", "unknown"} {
+		token, err := repo.ClaimLegacyToken(value)
+		if err != nil {
+			t.Fatalf("claim %s: unexpected error: %v", value, err)
+		}
+		if token != nil {
+			t.Errorf("claim %s = %+v, want nil", value, token)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package repository
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -10,17 +12,25 @@ import (
 )
 
 // TokenRepository provides CRUD operations for tokens
+// Tokens are stored and looked up by their SHA-256 digest, so the database does not hold usable tokens
 type TokenRepository struct {
 	db *gorm.DB
 }
 
+// tokenDigest returns the hex SHA-256 digest a token is stored as
+func tokenDigest(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
 // NewTokenRepository creates a new TokenRepository
 func NewTokenRepository(db *gorm.DB) *TokenRepository {
 	return &TokenRepository{db: db}
 }
 
-// Create creates a new token
-func (r *TokenRepository) Create(token *models.Token) error {
+// Create stores a new token under the digest of its value
+func (r *TokenRepository) Create(token *models.Token, value string) error {
+	token.TokenHash = tokenDigest(value)
 	if err := r.db.Create(token).Error; err != nil {
 		return fmt.Errorf("failed to create token: %w", err)
 	}
@@ -30,7 +40,7 @@ func (r *TokenRepository) Create(token *models.Token) error {
 // FindByTokenValue finds a token by its value
 func (r *TokenRepository) FindByTokenValue(tokenValue string) (*models.Token, error) {
 	var token models.Token
-	if err := r.db.Where("token_value = ?", tokenValue).First(&token).Error; err != nil {
+	if err := r.db.Where("token_hash = ?", tokenDigest(tokenValue)).First(&token).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, nil
 		}
@@ -42,7 +52,7 @@ func (r *TokenRepository) FindByTokenValue(tokenValue string) (*models.Token, er
 // FindValidToken finds a valid (non-expired) token
 func (r *TokenRepository) FindValidToken(tokenValue string) (*models.Token, error) {
 	var token models.Token
-	if err := r.db.Where("token_value = ? AND expires_at > ?", tokenValue, time.Now()).First(&token).Error; err != nil {
+	if err := r.db.Where("token_hash = ? AND expires_at > ?", tokenDigest(tokenValue), time.Now()).First(&token).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, nil
 		}
@@ -53,17 +63,97 @@ func (r *TokenRepository) FindValidToken(tokenValue string) (*models.Token, erro
 
 // DeleteByTokenValue deletes a token by its value
 func (r *TokenRepository) DeleteByTokenValue(tokenValue string) error {
-	if err := r.db.Where("token_value = ?", tokenValue).Delete(&models.Token{}).Error; err != nil {
+	if err := r.db.Where("token_hash = ?", tokenDigest(tokenValue)).Delete(&models.Token{}).Error; err != nil {
 		return fmt.Errorf("failed to delete token: %w", err)
 	}
 	return nil
 }
 
-// DeleteExpiredTokens deletes all expired tokens
+// ClaimLegacyToken deletes an unexpired access token issued before refresh tokens and returns it
+// Returns nil if there is no such token or it was claimed already, so each token is claimed at most once
+func (r *TokenRepository) ClaimLegacyToken(tokenValue string) (*models.Token, error) {
+	var token models.Token
+	claimed := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("token_hash = ? AND expires_at > ? AND (family_id = '' OR family_id IS NULL)", tokenDigest(tokenValue), time.Now()).
+			First(&token).Error; err != nil {
+			return err
+		}
+		// The delete only matches a token that is not deleted yet, so concurrent claims cannot both succeed
+		result := tx.Delete(&token)
+		if result.Error != nil {
+			return result.Error
+		}
+		claimed = result.RowsAffected > 0
+		return nil
+	})
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim token: %w", err)
+	}
+	if !claimed {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+// DeleteByUserID deletes all access and refresh tokens of a user and returns how many unexpired sessions
+// there were: token families, plus access tokens issued before refresh tokens, which each stand alone
+func (r *TokenRepository) DeleteByUserID(userID uint) (int64, error) {
+	now := time.Now()
+	var sessions int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var families []string
+		if err := tx.Model(&models.RefreshToken{}).
+			Where("user_id = ? AND expires_at > ?", userID, now).
+			Distinct().Pluck("family_id", &families).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+
+		var accessFamilies []string
+		if err := tx.Model(&models.Token{}).
+			Where("user_id = ? AND expires_at > ? AND family_id != ''", userID, now).
+			Distinct().Pluck("family_id", &accessFamilies).Error; err != nil {
+			return err
+		}
+		var legacy int64
+		if err := tx.Model(&models.Token{}).
+			Where("user_id = ? AND expires_at > ? AND (family_id = '' OR family_id IS NULL)", userID, now).
+			Count(&legacy).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.Token{}).Error; err != nil {
+			return err
+		}
+
+		// A session's access token may outlive its refresh token and the other way round
+		seen := make(map[string]bool, len(families)+len(accessFamilies))
+		for _, family := range append(families, accessFamilies...) {
+			seen[family] = true
+		}
+		sessions = int64(len(seen)) + legacy
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete tokens for user: %w", err)
+	}
+	return sessions, nil
+}
+
+// DeleteExpiredTokens deletes all expired access and refresh tokens
 func (r *TokenRepository) DeleteExpiredTokens() error {
-	if err := r.db.Where("expires_at <= ?", time.Now()).Delete(&models.Token{}).Error; err != nil {
+	now := time.Now()
+	if err := r.db.Where("expires_at <= ?", now).Delete(&models.Token{}).Error; err != nil {
 		return fmt.Errorf("failed to delete expired tokens: %w", err)
 	}
+	if err := r.db.Where("expires_at <= ?", now).Delete(&models.RefreshToken{}).Error; err != nil {
+		return fmt.Errorf("failed to delete expired refresh tokens: %w", err)
+	}
 	return nil
 }
 
@@ -75,3 +165,43 @@ func (r *TokenRepository) GetTokensByUserID(userID uint) ([]models.Token, error)
 	}
 	return tokens, nil
 }
+
+// hashStoredTokens replaces the token_value column of tokens stored before only digests were kept
+// with their digests, so existing sessions stay valid
+func hashStoredTokens(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.Token{}) || !migrator.HasColumn(&models.Token{}, "token_value") {
+		return nil
+	}
+
+	var rows []struct {
+		ID         uint
+		TokenValue string
+	}
+	if err := db.Table("tokens").Select("id, token_value").Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to read stored tokens: %w", err)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if !tx.Migrator().HasColumn(&models.Token{}, "token_hash") {
+			if err := tx.Exec("ALTER TABLE tokens ADD COLUMN token_hash varchar(64)").Error; err != nil {
+				return err
+			}
+		}
+		for _, row := range rows {
+			if err := tx.Table("tokens").Where("id = ?", row.ID).Update("token_hash", tokenDigest(row.TokenValue)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to hash stored tokens: %w", err)
+	}
+
+	// Dropping the column recreates the table without its indexes; AutoMigrate creates them again
+	if err := migrator.DropColumn(&models.Token{}, "token_value"); err != nil {
+		return fmt.Errorf("failed to drop token values: %w", err)
+	}
+	return nil
+}
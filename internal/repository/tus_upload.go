@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// TusUploadRepository provides CRUD operations for tus uploads
+type TusUploadRepository struct {
+	db *gorm.DB
+}
+
+// NewTusUploadRepository creates a new TusUploadRepository
+func NewTusUploadRepository(db *gorm.DB) *TusUploadRepository {
+	return &TusUploadRepository{db: db}
+}
+
+// Create creates a new upload
+func (r *TusUploadRepository) Create(upload *models.TusUpload) error {
+	if err := r.db.Create(upload).Error; err != nil {
+		return fmt.Errorf("failed to create upload: %w", err)
+	}
+	return nil
+}
+
+// FindByID finds an upload by ID, scoped to its owner and device
+func (r *TusUploadRepository) FindByID(userID, deviceID uint, id string) (*models.TusUpload, error) {
+	var upload models.TusUpload
+	if err := r.db.Where("id = ? AND user_id = ? AND device_id = ?", id, userID, deviceID).First(&upload).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// UpdateOffset records the number of bytes received for an upload
+func (r *TusUploadRepository) UpdateOffset(id string, offset int64) error {
+	if err := r.db.Model(&models.TusUpload{}).Where("id = ?", id).Update("upload_offset", offset).Error; err != nil {
+		return fmt.Errorf("failed to update upload offset: %w", err)
+	}
+	return nil
+}
+
+// MarkFinished flags an upload whose file has been stored for its photo
+func (r *TusUploadRepository) MarkFinished(id string) error {
+	if err := r.db.Model(&models.TusUpload{}).Where("id = ?", id).Update("finished", true).Error; err != nil {
+		return fmt.Errorf("failed to mark upload finished: %w", err)
+	}
+	return nil
+}
+
+// Delete deletes an upload
+func (r *TusUploadRepository) Delete(id string) error {
+	if err := r.db.Where("id = ?", id).Delete(&models.TusUpload{}).Error; err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	return nil
+}
+
+// DeleteUpdatedBefore deletes uploads that have not received data since the cutoff,
+// including finished uploads completed before it
+func (r *TusUploadRepository) DeleteUpdatedBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("updated_at < ?", cutoff).Delete(&models.TusUpload{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete stale uploads: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
@@ -2,9 +2,6 @@ package service
 
 import (
 	"fmt"
-	"time"
-
-	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/ios-photo-backup/photo-backup-server/internal/config"
 	"github.com/ios-photo-backup/photo-backup-server/internal/models"
@@ -13,34 +10,40 @@ import (
 
 // AuthService handles authentication logic
 type AuthService struct {
-	userRepo  *repository.UserRepository
-	tokenRepo *repository.TokenRepository
-	jwtSecret string
+	userRepo     *repository.UserRepository
+	deviceRepo   *repository.DeviceRepository
+	tokenService *TokenService
 }
 
 // NewAuthService creates a new AuthService
-func NewAuthService(userRepo *repository.UserRepository, tokenRepo *repository.TokenRepository, jwtSecret string) *AuthService {
+func NewAuthService(userRepo *repository.UserRepository, deviceRepo *repository.DeviceRepository, tokenService *TokenService) *AuthService {
 	return &AuthService{
-		userRepo:  userRepo,
-		tokenRepo: tokenRepo,
-		jwtSecret: jwtSecret,
+		userRepo:     userRepo,
+		deviceRepo:   deviceRepo,
+		tokenService: tokenService,
 	}
 }
 
 // LoginRequest represents a login request
+// The device fields register the device logging in; the tokens are bound to it
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	DeviceLogin
 }
 
 // LoginResponse represents a login response
 type LoginResponse struct {
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
+	TokenPair
+	Device *models.Device `json:"device"`
 }
 
-// Login authenticates a user and returns a JWT token
+// Login authenticates a user, registers the device and returns an access token and a refresh token
 func (s *AuthService) Login(req *LoginRequest) (*LoginResponse, error) {
+	if err := req.DeviceLogin.normalize(); err != nil {
+		return nil, err
+	}
+
 	// Find user by username
 	user, err := s.userRepo.FindByUsername(req.Username)
 	if err != nil {
@@ -55,50 +58,19 @@ func (s *AuthService) Login(req *LoginRequest) (*LoginResponse, error) {
 		return nil, fmt.Errorf("invalid credentials")
 	}
 
-	// Generate JWT token
-	tokenString, expiresAt, err := s.generateToken(user)
+	device, err := s.deviceRepo.Register(user.ID, req.Identifier, req.Name, req.Model, req.ClaimOriginal)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %w", err)
+		return nil, err
 	}
 
-	// Save token to database
-	token := &models.Token{
-		UserID:    user.ID,
-		TokenValue: tokenString,
-		CreatedAt: time.Now(),
-		ExpiresAt: expiresAt,
-	}
-
-	if err := s.tokenRepo.Create(token); err != nil {
-		return nil, fmt.Errorf("failed to save token: %w", err)
+	// Start a session on the device
+	tokens, err := s.tokenService.Issue(user, device.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
 
 	return &LoginResponse{
-		Token:     tokenString,
-		ExpiresAt: expiresAt,
+		TokenPair: *tokens,
+		Device:    device,
 	}, nil
 }
-
-// generateToken generates a JWT token for a user
-func (s *AuthService) generateToken(user *models.User) (string, time.Time, error) {
-	// Token expires in 7 days
-	expiresAt := time.Now().Add(7 * 24 * time.Hour)
-
-	// Create token
-	claims := jwt.MapClaims{
-		"user_id":  user.ID,
-		"username": user.Username,
-		"exp":      expiresAt.Unix(),
-		"iat":      time.Now().Unix(),
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign token
-	tokenString, err := token.SignedString([]byte(s.jwtSecret))
-	if err != nil {
-		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
-	}
-
-	return tokenString, expiresAt, nil
-}
@@ -0,0 +1,674 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// Limits on ISO base media boxes loaded into memory
+const (
+	bmffMaxMetaSize = 16 << 20 // HEIF meta box, QuickTime keys/ilst/udta
+	bmffMaxExifSize = 4 << 20  // Exif item of a HEIF file
+)
+
+// quickTimeEpoch is the origin of QuickTime and MP4 timestamps
+var quickTimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// iso6709Pattern matches the decimal-degree form of ISO 6709 locations ("+37.3349-122.0090+030.000/")
+var iso6709Pattern = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+// bmffBox is one box of an ISO base media file; start and end delimit its payload
+type bmffBox struct {
+	typ        string
+	start, end int64
+}
+
+// walkBoxes calls fn for each box between start and end
+func walkBoxes(r io.ReaderAt, start, end int64, fn func(box bmffBox) error) error {
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return fmt.Errorf("failed to read box header: %w", err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		typ := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// Box extends to the end of its container
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return fmt.Errorf("failed to read box header: %w", err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		// A 64-bit size may be negative or overflow offset+size, so compare against the space left
+		if size < headerSize || size > end-offset {
+			return fmt.Errorf("%w: box %q exceeds its container", errMalformedMetadata, typ)
+		}
+
+		if err := fn(bmffBox{typ: typ, start: offset + headerSize, end: offset + size}); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// readBox loads the payload of a box, refusing boxes above limit bytes
+func readBox(r io.ReaderAt, box bmffBox, limit int64) ([]byte, error) {
+	size := box.end - box.start
+	if size > limit {
+		return nil, fmt.Errorf("%w: box %q too large", errMalformedMetadata, box.typ)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, box.start); err != nil {
+		return nil, fmt.Errorf("failed to read box %q: %w", box.typ, err)
+	}
+	return data, nil
+}
+
+// heifItemLocation is where the data of one HEIF item lives
+type heifItemLocation struct {
+	constructionMethod int
+	extents            [][2]int64 // Offset and length pairs
+}
+
+// heifMeta holds the parts of a HEIF meta box needed for metadata
+type heifMeta struct {
+	primaryItem uint32
+	itemTypes   map[uint32]string
+	locations   map[uint32]heifItemLocation
+	properties  []bmffBox           // ipco children, in order
+	association map[uint32][]uint16 // item ID -> 1-based ipco indexes
+	idatStart   int64               // Offset of idat payload within the meta payload, or -1
+}
+
+// extractHEIF reads dimensions from the primary item and the Exif item of a HEIF/HEIC file
+func extractHEIF(r io.ReaderAt, size int64, metadata *models.PhotoMetadata) error {
+	var metaBox *bmffBox
+	if err := walkBoxes(r, 0, size, func(box bmffBox) error {
+		if box.typ == "meta" && metaBox == nil {
+			metaBox = &box
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if metaBox == nil {
+		return fmt.Errorf("%w: no meta box", errMalformedMetadata)
+	}
+
+	data, err := readBox(r, *metaBox, bmffMaxMetaSize)
+	if err != nil {
+		return err
+	}
+	meta, err := parseHEIFMeta(data)
+	if err != nil {
+		return err
+	}
+
+	// Image size is an ispe property of the primary item
+	for _, index := range meta.association[meta.primaryItem] {
+		if int(index) > len(meta.properties) || index == 0 {
+			continue
+		}
+		property := meta.properties[index-1]
+		if property.typ == "ispe" && property.end-property.start >= 12 {
+			payload := data[property.start:property.end]
+			metadata.Width = int(binary.BigEndian.Uint32(payload[4:8]))
+			metadata.Height = int(binary.BigEndian.Uint32(payload[8:12]))
+		}
+	}
+
+	for id, typ := range meta.itemTypes {
+		if typ != "Exif" {
+			continue
+		}
+		exif, err := readHEIFItem(r, data, meta, meta.locations[id])
+		if err != nil {
+			return err
+		}
+		// The item starts with the offset of the TIFF header after a 4-byte field
+		if len(exif) < 4 {
+			return fmt.Errorf("%w: short Exif item", errMalformedMetadata)
+		}
+		headerOffset := int64(binary.BigEndian.Uint32(exif[0:4])) + 4
+		if headerOffset > int64(len(exif)) {
+			return fmt.Errorf("%w: invalid Exif header offset", errMalformedMetadata)
+		}
+		return parseExif(bytes.NewReader(exif), headerOffset, int64(len(exif))-headerOffset, metadata)
+	}
+	return nil
+}
+
+// parseHEIFMeta parses the pitm, iinf, iloc, iprp and idat boxes of a meta payload
+func parseHEIFMeta(data []byte) (*heifMeta, error) {
+	meta := &heifMeta{
+		itemTypes:   make(map[uint32]string),
+		locations:   make(map[uint32]heifItemLocation),
+		association: make(map[uint32][]uint16),
+		idatStart:   -1,
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: short meta box", errMalformedMetadata)
+	}
+	r := bytes.NewReader(data)
+
+	// meta is a full box: skip version and flags
+	err := walkBoxes(r, 4, int64(len(data)), func(box bmffBox) error {
+		payload := data[box.start:box.end]
+		switch box.typ {
+		case "pitm":
+			p := &byteParser{data: payload}
+			version := p.fullBox()
+			meta.primaryItem = p.uintN(itemIDSize(version, 1))
+			return p.err
+		case "iinf":
+			return parseIINF(data, box, meta)
+		case "iloc":
+			return parseILOC(payload, meta)
+		case "iprp":
+			return walkBoxes(r, box.start, box.end, func(child bmffBox) error {
+				switch child.typ {
+				case "ipco":
+					return walkBoxes(r, child.start, child.end, func(property bmffBox) error {
+						meta.properties = append(meta.properties, property)
+						return nil
+					})
+				case "ipma":
+					return parseIPMA(data[child.start:child.end], meta)
+				}
+				return nil
+			})
+		case "idat":
+			meta.idatStart = box.start
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// parseIINF reads the item types from an item information box
+func parseIINF(data []byte, box bmffBox, meta *heifMeta) error {
+	p := &byteParser{data: data[box.start:box.end]}
+	version := p.fullBox()
+	if version == 0 {
+		p.uintN(2)
+	} else {
+		p.uintN(4)
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	return walkBoxes(bytes.NewReader(data), box.start+int64(p.pos), box.end, func(entry bmffBox) error {
+		if entry.typ != "infe" {
+			return nil
+		}
+		p := &byteParser{data: data[entry.start:entry.end]}
+		version := p.fullBox()
+		if version < 2 {
+			// Item types are only present from version 2 on
+			return nil
+		}
+		id := p.uintN(itemIDSize(version, 3))
+		p.uintN(2) // item_protection_index
+		typ := p.bytes(4)
+		if p.err != nil {
+			return p.err
+		}
+		meta.itemTypes[id] = string(typ)
+		return nil
+	})
+}
+
+// parseILOC reads item locations from an item location box
+func parseILOC(payload []byte, meta *heifMeta) error {
+	p := &byteParser{data: payload}
+	version := p.fullBox()
+	sizes := p.uintN(2)
+	offsetSize := int(sizes >> 12 & 0xF)
+	lengthSize := int(sizes >> 8 & 0xF)
+	baseOffsetSize := int(sizes >> 4 & 0xF)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xF)
+	}
+	itemCount := p.uintN(itemIDSize(version, 2))
+
+	for i := uint32(0); i < itemCount && p.err == nil; i++ {
+		id := p.uintN(itemIDSize(version, 2))
+		location := heifItemLocation{}
+		if version == 1 || version == 2 {
+			location.constructionMethod = int(p.uintN(2) & 0xF)
+		}
+		p.uintN(2) // data_reference_index
+		baseOffset := int64(p.uintN64(baseOffsetSize))
+		extentCount := int(p.uintN(2))
+		for j := 0; j < extentCount && p.err == nil; j++ {
+			if indexSize > 0 {
+				p.uintN64(indexSize)
+			}
+			offset := int64(p.uintN64(offsetSize))
+			length := int64(p.uintN64(lengthSize))
+			location.extents = append(location.extents, [2]int64{baseOffset + offset, length})
+		}
+		meta.locations[id] = location
+	}
+	return p.err
+}
+
+// parseIPMA reads item property associations
+func parseIPMA(payload []byte, meta *heifMeta) error {
+	p := &byteParser{data: payload}
+	version := p.fullBox()
+	largeIndexes := p.flags&1 == 1
+	entryCount := p.uintN(4)
+
+	for i := uint32(0); i < entryCount && p.err == nil; i++ {
+		id := p.uintN(itemIDSize(version, 1))
+		count := int(p.uintN(1))
+		for j := 0; j < count && p.err == nil; j++ {
+			var index uint16
+			if largeIndexes {
+				index = uint16(p.uintN(2) & 0x7FFF)
+			} else {
+				index = uint16(p.uintN(1) & 0x7F)
+			}
+			meta.association[id] = append(meta.association[id], index)
+		}
+	}
+	return p.err
+}
+
+// readHEIFItem loads the data of an item from the file or from the idat box
+func readHEIFItem(r io.ReaderAt, metaData []byte, meta *heifMeta, location heifItemLocation) ([]byte, error) {
+	var item []byte
+	for _, extent := range location.extents {
+		offset, length := extent[0], extent[1]
+		if length < 0 || length > bmffMaxExifSize-int64(len(item)) {
+			return nil, fmt.Errorf("%w: Exif item too large", errMalformedMetadata)
+		}
+		chunk := make([]byte, length)
+		switch location.constructionMethod {
+		case 0:
+			if _, err := r.ReadAt(chunk, offset); err != nil {
+				return nil, fmt.Errorf("failed to read Exif item: %w", err)
+			}
+		case 1:
+			start := meta.idatStart + offset
+			if meta.idatStart < 0 || offset < 0 || start < meta.idatStart || length > int64(len(metaData))-start {
+				return nil, fmt.Errorf("%w: Exif item outside idat", errMalformedMetadata)
+			}
+			copy(chunk, metaData[start:start+length])
+		default:
+			return nil, fmt.Errorf("%w: unsupported item construction method", errMalformedMetadata)
+		}
+		item = append(item, chunk...)
+	}
+	return item, nil
+}
+
+// itemIDSize returns the size of item IDs and counts, which grow to 4 bytes from the given box version on
+func itemIDSize(version, largeFrom int) int {
+	if version >= largeFrom {
+		return 4
+	}
+	return 2
+}
+
+// extractQuickTime reads duration, dimensions, rotation and Apple metadata from a MOV/MP4 file
+func extractQuickTime(r io.ReaderAt, size int64, metadata *models.PhotoMetadata) error {
+	var moov *bmffBox
+	if err := walkBoxes(r, 0, size, func(box bmffBox) error {
+		if box.typ == "moov" && moov == nil {
+			moov = &box
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if moov == nil {
+		return fmt.Errorf("%w: no moov box", errMalformedMetadata)
+	}
+
+	var created time.Time
+	err := walkBoxes(r, moov.start, moov.end, func(box bmffBox) error {
+		switch box.typ {
+		case "mvhd":
+			data, err := readBox(r, box, 1024)
+			if err != nil {
+				return err
+			}
+			created = parseMVHD(data, metadata)
+		case "trak":
+			return walkBoxes(r, box.start, box.end, func(child bmffBox) error {
+				if child.typ != "tkhd" {
+					return nil
+				}
+				data, err := readBox(r, child, 1024)
+				if err != nil {
+					return err
+				}
+				parseTKHD(data, metadata)
+				return nil
+			})
+		case "meta":
+			data, err := readBox(r, box, bmffMaxMetaSize)
+			if err != nil {
+				return err
+			}
+			return parseQuickTimeMeta(data, metadata)
+		case "udta":
+			data, err := readBox(r, box, bmffMaxMetaSize)
+			if err != nil {
+				return err
+			}
+			return parseUDTA(data, metadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The movie header time is UTC; Apple's creationdate key carries the local offset and wins
+	if metadata.CapturedAt == nil && !created.IsZero() {
+		metadata.CapturedAt = &created
+		metadata.CapturedOffset = "+00:00"
+	}
+	return nil
+}
+
+// parseMVHD reads the duration and creation time from a movie header
+func parseMVHD(data []byte, metadata *models.PhotoMetadata) time.Time {
+	p := &byteParser{data: data}
+	version := p.fullBox()
+	var creation, timescale, duration uint64
+	if version == 1 {
+		creation = p.uintN64(8)
+		p.uintN64(8) // modification_time
+		timescale = uint64(p.uintN(4))
+		duration = p.uintN64(8)
+	} else {
+		creation = uint64(p.uintN(4))
+		p.uintN(4) // modification_time
+		timescale = uint64(p.uintN(4))
+		duration = uint64(p.uintN(4))
+	}
+	if p.err != nil {
+		return time.Time{}
+	}
+	if timescale > 0 {
+		metadata.Duration = round(float64(duration)/float64(timescale), 3)
+	}
+	if creation == 0 {
+		return time.Time{}
+	}
+	return quickTimeEpoch.Add(time.Duration(creation) * time.Second)
+}
+
+// parseTKHD reads the size and rotation of a video track
+func parseTKHD(data []byte, metadata *models.PhotoMetadata) {
+	p := &byteParser{data: data}
+	version := p.fullBox()
+	if version == 1 {
+		p.skip(8 + 8 + 4 + 4 + 8) // times, track_ID, reserved, duration
+	} else {
+		p.skip(4 + 4 + 4 + 4 + 4)
+	}
+	p.skip(8 + 2 + 2 + 2 + 2) // reserved, layer, alternate_group, volume, reserved
+	matrix := make([]int32, 9)
+	for i := range matrix {
+		matrix[i] = int32(p.uintN(4))
+	}
+	width := int(p.uintN(4) >> 16)
+	height := int(p.uintN(4) >> 16)
+	if p.err != nil || width == 0 || height == 0 {
+		// Audio and metadata tracks have no size
+		return
+	}
+
+	if width*height > metadata.Width*metadata.Height {
+		metadata.Width, metadata.Height = width, height
+		metadata.Orientation = matrixOrientation(matrix[0], matrix[1], matrix[3], matrix[4])
+	}
+}
+
+// matrixOrientation maps the rotation of a track matrix to an Exif orientation value
+func matrixOrientation(a, b, c, d int32) int {
+	const one = 1 << 16
+	switch {
+	case a == 0 && b == one && c == -one && d == 0:
+		return 6 // Rotated 90° clockwise
+	case a == -one && b == 0 && c == 0 && d == -one:
+		return 3 // Rotated 180°
+	case a == 0 && b == -one && c == one && d == 0:
+		return 8 // Rotated 90° counter-clockwise
+	}
+	return 1
+}
+
+// parseQuickTimeMeta reads Apple metadata from a QuickTime meta box (keys + ilst)
+func parseQuickTimeMeta(data []byte, metadata *models.PhotoMetadata) error {
+	// QuickTime meta boxes carry no version and flags; ISO ones do
+	start := int64(0)
+	if len(data) >= 8 && string(data[4:8]) != "hdlr" {
+		start = 4
+	}
+	r := bytes.NewReader(data)
+
+	var keys []string
+	values := make(map[string]string)
+	err := walkBoxes(r, start, int64(len(data)), func(box bmffBox) error {
+		switch box.typ {
+		case "keys":
+			p := &byteParser{data: data[box.start:box.end]}
+			p.fullBox()
+			count := p.uintN(4)
+			for i := uint32(0); i < count && p.err == nil; i++ {
+				size := p.uintN(4)
+				if size < 8 {
+					return fmt.Errorf("%w: invalid key size", errMalformedMetadata)
+				}
+				p.skip(4) // namespace
+				keys = append(keys, string(p.bytes(int(size)-8)))
+			}
+			return p.err
+		case "ilst":
+			return walkBoxes(r, box.start, box.end, func(item bmffBox) error {
+				index := binary.BigEndian.Uint32([]byte(item.typ))
+				if index == 0 || int(index) > len(keys) {
+					return nil
+				}
+				if value, ok := quickTimeDataValue(r, data, item); ok {
+					values[keys[index-1]] = value
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	setString(&metadata.Make, values["com.apple.quicktime.make"])
+	setString(&metadata.Model, values["com.apple.quicktime.model"])
+	setString(&metadata.Software, values["com.apple.quicktime.software"])
+	setString(&metadata.LensModel, values["com.apple.quicktime.camera.lens_model"])
+	if location, ok := values["com.apple.quicktime.location.ISO6709"]; ok {
+		parseISO6709(location, metadata)
+	}
+	if created, ok := values["com.apple.quicktime.creationdate"]; ok {
+		parseQuickTimeDate(created, metadata)
+	}
+	return nil
+}
+
+// quickTimeDataValue returns the UTF-8 value of the data box inside an ilst item
+func quickTimeDataValue(r io.ReaderAt, data []byte, item bmffBox) (string, bool) {
+	var value string
+	found := false
+	_ = walkBoxes(r, item.start, item.end, func(box bmffBox) error {
+		payload := data[box.start:box.end]
+		// data box: 4-byte type indicator (1 = UTF-8), 4-byte locale, value
+		if box.typ == "data" && !found && len(payload) >= 8 && binary.BigEndian.Uint32(payload[0:4]) == 1 {
+			value = string(payload[8:])
+			found = true
+		}
+		return nil
+	})
+	return value, found
+}
+
+// parseUDTA reads classic QuickTime user data (©mak, ©mod, ©swr, ©xyz, ©day) and nested meta boxes
+func parseUDTA(data []byte, metadata *models.PhotoMetadata) error {
+	r := bytes.NewReader(data)
+	return walkBoxes(r, 0, int64(len(data)), func(box bmffBox) error {
+		payload := data[box.start:box.end]
+		if box.typ == "meta" {
+			return parseQuickTimeMeta(payload, metadata)
+		}
+
+		// International text: 2-byte length, 2-byte language, text
+		if len(payload) < 4 || box.typ[0] != 0xA9 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(payload[0:2]))
+		if 4+size > len(payload) {
+			return nil
+		}
+		value := string(payload[4 : 4+size])
+		switch box.typ[1:] {
+		case "mak":
+			if metadata.Make == "" {
+				metadata.Make = value
+			}
+		case "mod":
+			if metadata.Model == "" {
+				metadata.Model = value
+			}
+		case "swr":
+			if metadata.Software == "" {
+				metadata.Software = value
+			}
+		case "xyz":
+			if metadata.Latitude == nil {
+				parseISO6709(value, metadata)
+			}
+		case "day":
+			if metadata.CapturedAt == nil {
+				parseQuickTimeDate(value, metadata)
+			}
+		}
+		return nil
+	})
+}
+
+// parseISO6709 sets coordinates from an ISO 6709 location string
+func parseISO6709(value string, metadata *models.PhotoMetadata) {
+	match := iso6709Pattern.FindStringSubmatch(value)
+	if match == nil {
+		return
+	}
+	latitude, errLatitude := strconv.ParseFloat(match[1], 64)
+	longitude, errLongitude := strconv.ParseFloat(match[2], 64)
+	if errLatitude != nil || errLongitude != nil {
+		return
+	}
+	metadata.Latitude = &latitude
+	metadata.Longitude = &longitude
+	if match[3] != "" {
+		if altitude, err := strconv.ParseFloat(match[3], 64); err == nil {
+			metadata.Altitude = &altitude
+		}
+	}
+}
+
+// parseQuickTimeDate sets the capture time from an ISO 8601 date with offset
+func parseQuickTimeDate(value string, metadata *models.PhotoMetadata) {
+	for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339, "2006-01-02T15:04:05Z0700"} {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		metadata.CapturedAt = &t
+		metadata.CapturedOffset = t.Format(exifOffsetTimeLayout)
+		return
+	}
+}
+
+// byteParser reads big-endian fields from a box payload, remembering the first error
+type byteParser struct {
+	data  []byte
+	pos   int
+	flags uint32 // Flags of the last full box header read
+	err   error
+}
+
+// bytes returns the next n bytes
+func (p *byteParser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n < 0 || p.pos+n > len(p.data) {
+		p.err = fmt.Errorf("%w: truncated box", errMalformedMetadata)
+		return nil
+	}
+	value := p.data[p.pos : p.pos+n]
+	p.pos += n
+	return value
+}
+
+// skip advances past n bytes
+func (p *byteParser) skip(n int) {
+	p.bytes(n)
+}
+
+// uintN reads an unsigned integer of n bytes (at most 4)
+func (p *byteParser) uintN(n int) uint32 {
+	return uint32(p.uintN64(n))
+}
+
+// uintN64 reads an unsigned integer of n bytes (0, 1, 2, 4 or 8)
+func (p *byteParser) uintN64(n int) uint64 {
+	value := p.bytes(n)
+	if p.err != nil {
+		return 0
+	}
+	switch n {
+	case 0:
+		return 0
+	case 1:
+		return uint64(value[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(value))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(value))
+	case 8:
+		return binary.BigEndian.Uint64(value)
+	}
+	p.err = fmt.Errorf("%w: unsupported field size %d", errMalformedMetadata, n)
+	return 0
+}
+
+// fullBox reads the version and flags of a full box header and returns the version
+func (p *byteParser) fullBox() int {
+	header := p.uintN(4)
+	p.flags = header & 0xFFFFFF
+	return int(header >> 24)
+}
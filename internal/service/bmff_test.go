@@ -0,0 +1,147 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// testBox encodes a box with a 32-bit size
+func testBox(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	data := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(data, typ...), body...)
+}
+
+// testLargeBox encodes a box header with a 64-bit size, followed by payload
+func testLargeBox(typ string, size uint64, payload []byte) []byte {
+	data := binary.BigEndian.AppendUint32(nil, 1)
+	data = append(data, typ...)
+	data = binary.BigEndian.AppendUint64(data, size)
+	return append(data, payload...)
+}
+
+func TestWalkBoxes(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []bmffBox
+		wantErr bool
+	}{
+		{
+			name: "sibling boxes",
+			data: append(testBox("ftyp", []byte("heic")), testBox("free")...),
+			want: []bmffBox{{typ: "ftyp", start: 8, end: 12}, {typ: "free", start: 20, end: 20}},
+		},
+		{
+			name: "size zero extends to the end",
+			data: append(testBox("ftyp"), 0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3),
+			want: []bmffBox{{typ: "ftyp", start: 8, end: 8}, {typ: "mdat", start: 16, end: 19}},
+		},
+		{
+			name: "64-bit size",
+			data: testLargeBox("mdat", 20, []byte{1, 2, 3, 4}),
+			want: []bmffBox{{typ: "mdat", start: 16, end: 20}},
+		},
+		{
+			name: "trailing bytes shorter than a header are ignored",
+			data: append(testBox("free"), 1, 2, 3),
+			want: []bmffBox{{typ: "free", start: 8, end: 8}},
+		},
+		{
+			name:    "size smaller than its header",
+			data:    []byte{0, 0, 0, 4, 'f', 'r', 'e', 'e'},
+			wantErr: true,
+		},
+		{
+			name:    "box exceeds its container",
+			data:    []byte{0, 0, 0, 64, 'f', 'r', 'e', 'e'},
+			wantErr: true,
+		},
+		{
+			name:    "64-bit size overflowing the offset",
+			data:    append(testBox("free"), testLargeBox("mdat", 1<<63-1, nil)...),
+			wantErr: true,
+		},
+		{
+			name:    "negative 64-bit size",
+			data:    testLargeBox("mdat", 1<<64-1, nil),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []bmffBox
+			err := walkBoxes(bytes.NewReader(tt.data), 0, int64(len(tt.data)), func(box bmffBox) error {
+				got = append(got, box)
+				return nil
+			})
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedMetadata) {
+					t.Fatalf("error = %v, want %v", err, errMalformedMetadata)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("boxes = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadHEIFItemRejectsOffsetsOutsideIdat(t *testing.T) {
+	metaData := make([]byte, 64)
+	meta := &heifMeta{idatStart: 32}
+
+	tests := []struct {
+		name   string
+		extent [2]int64
+	}{
+		{name: "negative offset", extent: [2]int64{-8, 4}},
+		{name: "offset overflowing the idat start", extent: [2]int64{1<<63 - 16, 4}},
+		{name: "length past the meta box", extent: [2]int64{16, 32}},
+		{name: "length overflowing the item limit", extent: [2]int64{0, 1<<63 - 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location := heifItemLocation{constructionMethod: 1, extents: [][2]int64{tt.extent}}
+			if _, err := readHEIFItem(bytes.NewReader(metaData), metaData, meta, location); !errors.Is(err, errMalformedMetadata) {
+				t.Fatalf("error = %v, want %v", err, errMalformedMetadata)
+			}
+		})
+	}
+}
+
+func FuzzWalkBoxes(f *testing.F) {
+	f.Add(append(testBox("ftyp", []byte("heic")), testBox("free")...))
+	f.Add(testLargeBox("mdat", 1<<63-1, nil))
+	f.Add(testBox("meta", make([]byte, 4), testBox("pitm", make([]byte, 6)), testBox("idat", []byte{1, 2})))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		size := int64(len(data))
+		_ = walkBoxes(bytes.NewReader(data), 0, size, func(box bmffBox) error {
+			if box.start < 0 || box.start > box.end || box.end > size {
+				t.Fatalf("box %q spans %d-%d of %d bytes", box.typ, box.start, box.end, size)
+			}
+			return nil
+		})
+
+		// The parsers below slice their input by box bounds and must not panic on any of it
+		metadata := &models.PhotoMetadata{}
+		if meta, err := parseHEIFMeta(data); err == nil {
+			for _, location := range meta.locations {
+				_, _ = readHEIFItem(bytes.NewReader(data), data, meta, location)
+			}
+		}
+		_ = parseQuickTimeMeta(data, metadata)
+		_ = parseUDTA(data, metadata)
+	})
+}
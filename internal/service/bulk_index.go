@@ -0,0 +1,70 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxBulkIndexPhotos is the most photos one bulk index request may contain
+const MaxBulkIndexPhotos = 5000
+
+// BulkIndexError explains why one photo of a bulk index request was rejected
+type BulkIndexError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// BulkIndexResult is the outcome for one photo of a bulk index request
+// Indexed photos carry the same fields as a /photos/index response; rejected ones carry Error
+type BulkIndexResult struct {
+	LocalID string `json:"local_id"`
+	Date    string `json:"date,omitempty"` // YYYY-MM-DD the photo is filed under, taken from its creation_time
+	*PhotoIndexResponse
+	Error *BulkIndexError `json:"error,omitempty"`
+}
+
+// BulkIndexPhotos indexes photos taken on any number of dates
+// Each photo is filed under the date of its creation_time, in the UTC offset it was sent with, and
+// all new photos are named in one transaction. A photo that fails validation is reported in its
+// result without affecting the others; results are in request order
+func (s *PhotoService) BulkIndexPhotos(userID uint, photos []PhotoIndexRequest) ([]BulkIndexResult, error) {
+	if len(photos) > MaxBulkIndexPhotos {
+		return nil, &ValidationError{Field: "photos", Reason: fmt.Sprintf("must not contain more than %d photos", MaxBulkIndexPhotos)}
+	}
+
+	results := make([]BulkIndexResult, len(photos))
+	entries := make([]indexEntry, 0, len(photos))
+	positions := make([]int, 0, len(photos))
+	for i, photo := range photos {
+		results[i].LocalID = photo.LocalID
+
+		err := validateIndexRequest(photo)
+		if err == nil && photo.CreationTime.IsZero() {
+			err = &ValidationError{Field: "creation_time", Reason: "is required"}
+		}
+		if err != nil {
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				return nil, err
+			}
+			results[i].Error = &BulkIndexError{Field: invalid.Field, Message: invalid.Error()}
+			continue
+		}
+
+		results[i].Date = photo.CreationTime.Format("2006-01-02")
+		entries = append(entries, indexEntry{
+			request: photo,
+			dirPath: s.naming.GetDirectoryPath(s.storageDir, userID, photo.CreationTime),
+		})
+		positions = append(positions, i)
+	}
+
+	responses, err := s.indexEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	for i := range responses {
+		results[positions[i]].PhotoIndexResponse = &responses[i]
+	}
+	return results, nil
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// Kinds of change reported by the changes feed
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// ChangedPhoto is the current state of a created or updated photo
+type ChangedPhoto struct {
+	CreationTime time.Time       `json:"creation_time"`
+	FileName     string          `json:"file_name"`
+	FileType     string          `json:"file_type"`
+	Resources    []PhotoResource `json:"resources"` // Uploaded files in upload order
+}
+
+// PhotoChange is the latest change of one photo after a cursor
+type PhotoChange struct {
+	ChangeSeq int64         `json:"change_seq"`
+	Action    string        `json:"action"` // ChangeCreated, ChangeUpdated or ChangeDeleted
+	LocalID   string        `json:"local_id"`
+	Photo     *ChangedPhoto `json:"photo,omitempty"` // Unset for deleted photos
+	Purged    bool          `json:"purged"`          // Deleted permanently rather than moved to the trash
+}
+
+// PhotoChangesResponse is a page of the changes feed
+type PhotoChangesResponse struct {
+	Changes []PhotoChange `json:"changes"`
+	Cursor  int64         `json:"cursor"` // Pass as since to continue after this page
+	HasMore bool          `json:"has_more"`
+}
+
+// GetChanges returns the photos created, updated or deleted after the change sequence number since,
+// in change order; each photo appears once, with its latest change
+// A since of 0 returns the whole library
+func (s *PhotoService) GetChanges(since int64, limit int) (*PhotoChangesResponse, error) {
+	if since < 0 {
+		return nil, &ValidationError{Field: "since", Reason: "must not be negative"}
+	}
+
+	// Fetch one extra record to find out whether another page exists
+	photos, err := s.photoRepo.ListChangedSince(since, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	tombstones, err := s.photoRepo.ListTombstonesSince(since, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &PhotoChangesResponse{Changes: make([]PhotoChange, 0, limit), Cursor: since}
+	var present []*models.Photo
+	for p, t := 0, 0; p < len(photos) || t < len(tombstones); {
+		if len(resp.Changes) == limit {
+			resp.HasMore = true
+			break
+		}
+		if t == len(tombstones) || (p < len(photos) && photos[p].ChangeSeq < tombstones[t].ChangeSeq) {
+			photo := &photos[p]
+			p++
+			change := PhotoChange{ChangeSeq: photo.ChangeSeq, Action: ChangeUpdated, LocalID: photo.LocalID}
+			switch {
+			case photo.DeletedAt.Valid:
+				change.Action = ChangeDeleted
+			case photo.CreatedSeq > since:
+				change.Action = ChangeCreated
+			}
+			if change.Action != ChangeDeleted {
+				present = append(present, photo)
+			}
+			resp.Changes = append(resp.Changes, change)
+			continue
+		}
+		tombstone := tombstones[t]
+		t++
+		resp.Changes = append(resp.Changes, PhotoChange{
+			ChangeSeq: tombstone.ChangeSeq,
+			Action:    ChangeDeleted,
+			LocalID:   tombstone.LocalID,
+			Purged:    true,
+		})
+	}
+	if n := len(resp.Changes); n > 0 {
+		resp.Cursor = resp.Changes[n-1].ChangeSeq
+	}
+
+	localIDs := make([]string, len(present))
+	for i, photo := range present {
+		localIDs[i] = photo.LocalID
+	}
+	files, err := s.photoRepo.GetFilesByLocalIDs(localIDs)
+	if err != nil {
+		return nil, err
+	}
+	byLocalID := make(map[string]*ChangedPhoto, len(present))
+	for _, photo := range present {
+		changed := &ChangedPhoto{
+			CreationTime: photo.CreationTime,
+			FileName:     photo.FileName,
+			FileType:     photo.FileType,
+			Resources:    make([]PhotoResource, 0, len(files[photo.LocalID])),
+		}
+		for i := range files[photo.LocalID] {
+			changed.Resources = append(changed.Resources, s.photoResource(photo, &files[photo.LocalID][i]))
+		}
+		byLocalID[photo.LocalID] = changed
+	}
+	for i := range resp.Changes {
+		resp.Changes[i].Photo = byLocalID[resp.Changes[i].LocalID]
+	}
+	return resp, nil
+}
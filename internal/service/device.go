@@ -0,0 +1,154 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+// ErrDeviceNotFound is returned for a device the user has not registered
+var ErrDeviceNotFound = errors.New("device not found")
+
+// maxDeviceFieldLength bounds the device identifier, name and model accepted from clients
+const maxDeviceFieldLength = 255
+
+// deviceSeenInterval is how often the last seen time of a device is updated while it makes requests
+const deviceSeenInterval = time.Minute
+
+// DeviceLogin identifies the device a user logs in from; all fields are optional
+type DeviceLogin struct {
+	Identifier string `json:"device_id"`    // Stable per device, e.g. identifierForVendor
+	Name       string `json:"device_name"`  // e.g. "Alice's iPhone"
+	Model      string `json:"device_model"` // e.g. "iPhone15,2"
+
+	// Take over the original device, which holds the photos backed up before devices were registered,
+	// if it has no identifier yet; sent by a client upgrading from a version that did not identify itself
+	ClaimOriginal bool `json:"claim_original"`
+}
+
+// normalize trims the fields and checks they can be stored
+func (d *DeviceLogin) normalize() error {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"device_id", &d.Identifier},
+		{"device_name", &d.Name},
+		{"device_model", &d.Model},
+	}
+	for _, field := range fields {
+		*field.value = strings.TrimSpace(*field.value)
+		switch {
+		case len(*field.value) > maxDeviceFieldLength:
+			return &ValidationError{Field: field.name, Reason: fmt.Sprintf("must be at most %d bytes", maxDeviceFieldLength)}
+		case !utf8.ValidString(*field.value):
+			return &ValidationError{Field: field.name, Reason: "must be valid UTF-8"}
+		case strings.ContainsFunc(*field.value, unicode.IsControl):
+			return &ValidationError{Field: field.name, Reason: "must not contain control characters"}
+		}
+	}
+	return nil
+}
+
+// DeviceService manages the devices of users and their photo libraries
+type DeviceService struct {
+	deviceRepo *repository.DeviceRepository
+	photoRepo  func(device *models.Device) *repository.PhotoRepository
+}
+
+// NewDeviceService creates a new DeviceService
+// photoRepo returns the PhotoRepository of a device, as created per request by the handlers
+func NewDeviceService(deviceRepo *repository.DeviceRepository, photoRepo func(device *models.Device) *repository.PhotoRepository) *DeviceService {
+	return &DeviceService{
+		deviceRepo: deviceRepo,
+		photoRepo:  photoRepo,
+	}
+}
+
+// Current returns the device a request with a token issued for deviceID comes from, and records it was seen
+// Tokens issued before devices were registered (deviceID 0) belong to the user's original device
+func (s *DeviceService) Current(userID, deviceID uint) (*models.Device, error) {
+	var device *models.Device
+	var err error
+	if deviceID == 0 {
+		device, err = s.deviceRepo.FindOriginal(userID)
+	} else {
+		device, err = s.deviceRepo.FindByID(userID, deviceID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	if now := time.Now(); now.Sub(device.LastSeenAt) >= deviceSeenInterval {
+		if err := s.deviceRepo.Touch(device.ID, now); err != nil {
+			return nil, err
+		}
+		device.LastSeenAt = now
+	}
+	return device, nil
+}
+
+// Find returns one of the user's devices, or ErrDeviceNotFound
+func (s *DeviceService) Find(userID, deviceID uint) (*models.Device, error) {
+	device, err := s.deviceRepo.FindByID(userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, ErrDeviceNotFound
+	}
+	return device, nil
+}
+
+// DeviceStats summarizes the photo library of a device
+type DeviceStats struct {
+	Photos       int64      `json:"photos"`  // Photos outside the trash
+	Trashed      int64      `json:"trashed"` // Photos in the trash
+	Files        int64      `json:"files"`   // Uploaded files of the photos outside the trash
+	Bytes        int64      `json:"bytes"`   // Total size of those files
+	LastUploadAt *time.Time `json:"last_upload_at,omitempty"`
+}
+
+// DeviceInfo describes a device of the user and its photo library
+type DeviceInfo struct {
+	models.Device
+	Current bool        `json:"current"` // The device the request came from
+	Stats   DeviceStats `json:"stats"`
+}
+
+// ListDevices returns the devices of a user with the stats of their photo libraries, in registration order
+func (s *DeviceService) ListDevices(userID, currentID uint) ([]DeviceInfo, error) {
+	devices, err := s.deviceRepo.ListByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]DeviceInfo, 0, len(devices))
+	for i := range devices {
+		stats, err := s.photoRepo(&devices[i]).Stats()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, DeviceInfo{
+			Device:  devices[i],
+			Current: devices[i].ID == currentID,
+			Stats: DeviceStats{
+				Photos:       stats.Photos,
+				Trashed:      stats.Trashed,
+				Files:        stats.Files,
+				Bytes:        stats.Bytes,
+				LastUploadAt: stats.LastUploadAt,
+			},
+		})
+	}
+	return infos, nil
+}
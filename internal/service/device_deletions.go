@@ -0,0 +1,250 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+// Deletion policies: what happens to a photo reported as deleted from the device library
+const (
+	DeletionKeep  = "keep"  // Keep the photo on the server forever
+	DeletionTrash = "trash" // Move the photo to the trash right away
+	DeletionGrace = "grace" // Move the photo to the trash once it has been missing for the grace period
+)
+
+// DeletionPolicies lists all deletion policies
+var DeletionPolicies = []string{DeletionKeep, DeletionTrash, DeletionGrace}
+
+// Actions taken for a photo reported as deleted from the device
+const (
+	DeletionActionKept      = "kept"
+	DeletionActionTrashed   = "trashed"
+	DeletionActionScheduled = "scheduled"
+)
+
+// ErrUserNotFound is returned when the account of an authenticated request no longer exists
+var ErrUserNotFound = errors.New("user not found")
+
+// DeletionPolicy is a user's policy for photos deleted from the device library
+type DeletionPolicy struct {
+	Mode      string `json:"mode"`
+	GraceDays int    `json:"grace_days"` // Days a photo may be missing before it is moved to the trash (grace mode)
+}
+
+// Validate checks a client-supplied policy
+func (p DeletionPolicy) Validate() error {
+	known := false
+	for _, mode := range DeletionPolicies {
+		if p.Mode == mode {
+			known = true
+		}
+	}
+	if !known {
+		return &ValidationError{Field: "mode", Reason: "must be one of " + strings.Join(DeletionPolicies, ", ")}
+	}
+	if p.GraceDays < 1 {
+		return &ValidationError{Field: "grace_days", Reason: "must be at least 1"}
+	}
+	return nil
+}
+
+// GracePeriod returns how long a photo may be missing from the device before it is moved to the trash
+func (p DeletionPolicy) GracePeriod() time.Duration {
+	return time.Duration(p.GraceDays) * 24 * time.Hour
+}
+
+// userDeletionPolicy returns the deletion policy stored for a user
+// Accounts created before policies existed keep their photos
+func userDeletionPolicy(user *models.User) DeletionPolicy {
+	policy := DeletionPolicy{Mode: user.DeletionPolicy, GraceDays: user.DeletionGraceDays}
+	if policy.Mode == "" {
+		policy.Mode = DeletionKeep
+	}
+	return policy
+}
+
+// DeletionPolicyService reads and changes the deletion policies of users
+type DeletionPolicyService struct {
+	userRepo *repository.UserRepository
+}
+
+// NewDeletionPolicyService creates a new DeletionPolicyService
+func NewDeletionPolicyService(userRepo *repository.UserRepository) *DeletionPolicyService {
+	return &DeletionPolicyService{userRepo: userRepo}
+}
+
+// findUser returns a user, or ErrUserNotFound
+func (s *DeletionPolicyService) findUser(userID uint) (*models.User, error) {
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// GetPolicy returns the deletion policy of a user
+func (s *DeletionPolicyService) GetPolicy(userID uint) (DeletionPolicy, error) {
+	user, err := s.findUser(userID)
+	if err != nil {
+		return DeletionPolicy{}, err
+	}
+	return userDeletionPolicy(user), nil
+}
+
+// SetPolicy validates and stores the deletion policy of a user
+func (s *DeletionPolicyService) SetPolicy(userID uint, policy DeletionPolicy) (DeletionPolicy, error) {
+	if err := policy.Validate(); err != nil {
+		return DeletionPolicy{}, err
+	}
+	user, err := s.findUser(userID)
+	if err != nil {
+		return DeletionPolicy{}, err
+	}
+	user.DeletionPolicy = policy.Mode
+	user.DeletionGraceDays = policy.GraceDays
+	if err := s.userRepo.Update(user); err != nil {
+		return DeletionPolicy{}, err
+	}
+	return policy, nil
+}
+
+// DeviceDeletionReport tells the server which photos are gone from the device library,
+// either as the full set of local_ids still present for a date or as a list of deleted local_ids
+type DeviceDeletionReport struct {
+	Date            string   `json:"date"`              // YYYY-MM-DD, as used when indexing
+	LocalIDs        []string `json:"local_ids"`         // Every local_id of Date still on the device
+	DeletedLocalIDs []string `json:"deleted_local_ids"` // local_ids deleted from the device
+}
+
+// validate checks a report before any photo is touched
+func (r DeviceDeletionReport) validate(naming *PhotoNaming) error {
+	switch {
+	case r.Date == "" && r.LocalIDs != nil:
+		return &ValidationError{Field: "date", Reason: "is required with local_ids"}
+	case r.Date != "" && r.LocalIDs == nil:
+		return &ValidationError{Field: "local_ids", Reason: "is required with date (send [] if no photo of the date is left)"}
+	case r.Date == "" && len(r.DeletedLocalIDs) == 0:
+		return &ValidationError{Field: "deleted_local_ids", Reason: "must not be empty without date and local_ids"}
+	}
+	if r.Date != "" {
+		if _, err := naming.ParseDate(r.Date); err != nil {
+			return &ValidationError{Field: "date", Reason: "must be in YYYY-MM-DD format"}
+		}
+	}
+	for _, localID := range r.LocalIDs {
+		if err := ValidateLocalID(localID); err != nil {
+			return err
+		}
+	}
+	for _, localID := range r.DeletedLocalIDs {
+		if err := ValidateLocalID(localID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MissingPhoto is a photo reported as deleted from the device and what the policy did with it
+type MissingPhoto struct {
+	LocalID  string     `json:"local_id"`
+	Action   string     `json:"action"`              // DeletionActionKept, DeletionActionTrashed or DeletionActionScheduled
+	DeleteAt *time.Time `json:"delete_at,omitempty"` // When a scheduled photo is moved to the trash
+}
+
+// DeviceDeletionResponse describes how a deletion report was applied
+type DeviceDeletionResponse struct {
+	Policy  DeletionPolicy `json:"policy"`
+	Missing []MissingPhoto `json:"missing"`
+}
+
+// ApplyDeviceDeletions applies a user's deletion policy to the photos a report shows as deleted
+// Photos a report shows as present are no longer considered deleted, cancelling a scheduled deletion
+// local_ids unknown to the server, or already in the trash, are ignored
+func (s *PhotoService) ApplyDeviceDeletions(policy DeletionPolicy, report DeviceDeletionReport) (*DeviceDeletionResponse, error) {
+	if err := report.validate(s.naming); err != nil {
+		return nil, err
+	}
+
+	missing := make(map[string]bool)
+	if report.Date != "" {
+		stored, err := s.photoRepo.GetLocalIDs(report.Date)
+		if err != nil {
+			return nil, err
+		}
+		present := make(map[string]bool, len(report.LocalIDs))
+		for _, localID := range report.LocalIDs {
+			present[localID] = true
+		}
+		for _, localID := range stored {
+			if !present[localID] {
+				missing[localID] = true
+			}
+		}
+		if err := s.photoRepo.ClearDeviceDeleted(report.LocalIDs); err != nil {
+			return nil, err
+		}
+	}
+	for _, localID := range report.DeletedLocalIDs {
+		missing[localID] = true
+	}
+
+	localIDs := make([]string, 0, len(missing))
+	for localID := range missing {
+		localIDs = append(localIDs, localID)
+	}
+	if policy.Mode == DeletionGrace {
+		if err := s.photoRepo.MarkDeviceDeleted(localIDs, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	photos, err := s.photoRepo.FindByLocalIDs(localIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &DeviceDeletionResponse{Policy: policy, Missing: make([]MissingPhoto, 0, len(photos))}
+	for _, photo := range photos {
+		item := MissingPhoto{LocalID: photo.LocalID, Action: DeletionActionKept}
+		switch policy.Mode {
+		case DeletionTrash:
+			if _, err := s.TrashPhoto(photo.LocalID); err != nil {
+				return nil, fmt.Errorf("failed to move %s to trash: %w", photo.LocalID, err)
+			}
+			item.Action = DeletionActionTrashed
+		case DeletionGrace:
+			if photo.DeviceDeletedAt != nil {
+				deleteAt := photo.DeviceDeletedAt.Add(policy.GracePeriod())
+				item.Action = DeletionActionScheduled
+				item.DeleteAt = &deleteAt
+			}
+		}
+		resp.Missing = append(resp.Missing, item)
+	}
+	return resp, nil
+}
+
+// TrashMissingPhotos moves photos first reported as deleted from the device before a cutoff to the trash
+// Returns the number of photos moved
+func (s *PhotoService) TrashMissingPhotos(before time.Time) (int, error) {
+	photos, err := s.photoRepo.ListDeviceDeletedBefore(before)
+	if err != nil {
+		return 0, err
+	}
+
+	trashed := 0
+	for _, photo := range photos {
+		if _, err := s.TrashPhoto(photo.LocalID); err != nil {
+			return trashed, err
+		}
+		trashed++
+	}
+	return trashed, nil
+}
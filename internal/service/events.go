@@ -0,0 +1,104 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of events pushed to a user's event stream
+const (
+	EventPhotoIndexed    = "photo_indexed"    // A photo was indexed and assigned a file name
+	EventUploadCompleted = "upload_completed" // A file of a photo was stored, by any upload method
+	EventChunkMerged     = "chunk_merged"     // The chunks of a chunked upload were merged
+	EventPhotoDeleted    = "photo_deleted"    // A photo was moved to the trash or purged from it
+	EventPhotoRestored   = "photo_restored"   // A photo was restored from the trash
+)
+
+// eventBufferSize is how many events may wait for a subscriber before it is dropped
+const eventBufferSize = 64
+
+// Event is a change to one of a user's photos
+type Event struct {
+	Type      string    `json:"type"`
+	DeviceID  uint      `json:"device_id"` // Device whose photo library changed
+	LocalID   string    `json:"local_id"`
+	FileName  string    `json:"file_name,omitempty"` // Stored name without extension
+	Role      string    `json:"role,omitempty"`
+	Extension string    `json:"extension,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	Chunks    int       `json:"chunks,omitempty"` // Number of merged chunks (chunk_merged)
+	Purged    bool      `json:"purged,omitempty"` // Removed permanently rather than moved to the trash (photo_deleted)
+	Time      time.Time `json:"time"`
+}
+
+// EventBroker fans events out to the open event streams of each user
+// A subscriber that falls eventBufferSize events behind is dropped, so a stalled
+// connection never blocks an upload; its stream ends and the client resyncs
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan Event]struct{}
+}
+
+// NewEventBroker creates a new EventBroker
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[uint]map[chan Event]struct{})}
+}
+
+// Subscribe opens a stream of a user's events
+// The channel is closed when the subscriber is dropped or the returned function is called
+func (b *EventBroker) Subscribe(userID uint) (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	b.mu.Lock()
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(userID, ch)
+	}
+}
+
+// remove closes a subscriber's channel unless it was already removed; b.mu must be held
+func (b *EventBroker) remove(userID uint, ch chan Event) {
+	if _, ok := b.subscribers[userID][ch]; !ok {
+		return
+	}
+	delete(b.subscribers[userID], ch)
+	if len(b.subscribers[userID]) == 0 {
+		delete(b.subscribers, userID)
+	}
+	close(ch)
+}
+
+// Publish sends an event to every open stream of a user without waiting for them
+func (b *EventBroker) Publish(userID uint, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[userID] {
+		select {
+		case ch <- event:
+		default:
+			b.remove(userID, ch)
+		}
+	}
+}
+
+// publish sends an event to the user's event streams, if events are enabled
+func (s *PhotoService) publish(event Event) {
+	if s.events == nil {
+		return
+	}
+	event.DeviceID = s.photoRepo.DeviceID()
+	s.events.Publish(s.photoRepo.UserID(), event)
+}
@@ -0,0 +1,342 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// errMalformedMetadata is returned when embedded metadata cannot be parsed
+var errMalformedMetadata = errors.New("malformed metadata")
+
+// TIFF tags read from IFD0, the Exif IFD and the GPS IFD
+const (
+	tagImageWidth        = 0x0100
+	tagImageLength       = 0x0101
+	tagMake              = 0x010F
+	tagModel             = 0x0110
+	tagOrientation       = 0x0112
+	tagSoftware          = 0x0131
+	tagDateTime          = 0x0132
+	tagExifIFD           = 0x8769
+	tagGPSIFD            = 0x8825
+	tagExposureTime      = 0x829A
+	tagFNumber           = 0x829D
+	tagISO               = 0x8827
+	tagDateTimeOriginal  = 0x9003
+	tagOffsetTimeOrig    = 0x9011
+	tagFocalLength       = 0x920A
+	tagPixelXDimension   = 0xA002
+	tagPixelYDimension   = 0xA003
+	tagFocalLength35mm   = 0xA405
+	tagLensModel         = 0xA434
+	tagGPSLatitudeRef    = 0x0001
+	tagGPSLatitude       = 0x0002
+	tagGPSLongitudeRef   = 0x0003
+	tagGPSLongitude      = 0x0004
+	tagGPSAltitudeRef    = 0x0005
+	tagGPSAltitude       = 0x0006
+	exifMaxIFDEntries    = 1000
+	exifMaxValueSize     = 64 << 10
+	exifDateTimeLayout   = "2006:01:02 15:04:05"
+	exifOffsetTimeLayout = "-07:00"
+)
+
+// tiffTypeSizes maps TIFF field types to the size of one value in bytes
+var tiffTypeSizes = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	6:  1, // SBYTE
+	7:  1, // UNDEFINED
+	8:  2, // SSHORT
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+}
+
+// tiffEntry is one IFD entry
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // Raw value bytes
+}
+
+// tiffReader reads a TIFF structure (a TIFF file or an embedded Exif block)
+// All offsets are relative to the start of the TIFF header
+type tiffReader struct {
+	r     io.ReaderAt
+	base  int64
+	size  int64
+	order binary.ByteOrder
+}
+
+// newTIFFReader checks the TIFF header at base and returns a reader for it
+func newTIFFReader(r io.ReaderAt, base, size int64) (*tiffReader, uint32, error) {
+	t := &tiffReader{r: r, base: base, size: size}
+	header, err := t.read(0, 8)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch string(header[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("%w: no TIFF header", errMalformedMetadata)
+	}
+	return t, t.order.Uint32(header[4:8]), nil
+}
+
+// read returns n bytes at a TIFF offset
+func (t *tiffReader) read(offset int64, n int) ([]byte, error) {
+	if offset < 0 || n < 0 || offset+int64(n) > t.size {
+		return nil, fmt.Errorf("%w: offset out of range", errMalformedMetadata)
+	}
+	buf := make([]byte, n)
+	if _, err := t.r.ReadAt(buf, t.base+offset); err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return buf, nil
+}
+
+// readIFD reads the entries of the IFD at offset
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]tiffEntry, error) {
+	countBytes, err := t.read(int64(offset), 2)
+	if err != nil {
+		return nil, err
+	}
+	count := int(t.order.Uint16(countBytes))
+	if count > exifMaxIFDEntries {
+		return nil, fmt.Errorf("%w: too many IFD entries", errMalformedMetadata)
+	}
+	raw, err := t.read(int64(offset)+2, count*12)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[uint16]tiffEntry, count)
+	for i := 0; i < count; i++ {
+		field := raw[i*12 : i*12+12]
+		entry := tiffEntry{
+			typ:   t.order.Uint16(field[2:4]),
+			count: t.order.Uint32(field[4:8]),
+		}
+		typeSize, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		size := int64(typeSize) * int64(entry.count)
+		if size > exifMaxValueSize {
+			continue
+		}
+		if size <= 4 {
+			entry.value = field[8 : 8+size]
+		} else if entry.value, err = t.read(int64(t.order.Uint32(field[8:12])), int(size)); err != nil {
+			// Skip values pointing outside the block rather than failing the whole IFD
+			continue
+		}
+		entries[t.order.Uint16(field[0:2])] = entry
+	}
+	return entries, nil
+}
+
+// ascii returns an ASCII value without trailing NULs and spaces
+func (t *tiffReader) ascii(entries map[uint16]tiffEntry, tag uint16) string {
+	entry, ok := entries[tag]
+	if !ok || (entry.typ != 2 && entry.typ != 7) {
+		return ""
+	}
+	value := string(entry.value)
+	if i := strings.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// integer returns the first value of an integer field
+func (t *tiffReader) integer(entries map[uint16]tiffEntry, tag uint16) (uint32, bool) {
+	entry, ok := entries[tag]
+	if !ok || entry.count == 0 {
+		return 0, false
+	}
+	switch entry.typ {
+	case 1, 7:
+		return uint32(entry.value[0]), true
+	case 3:
+		return uint32(t.order.Uint16(entry.value)), true
+	case 4:
+		return t.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+// rational returns the i-th value of a rational field as a float
+func (t *tiffReader) rational(entries map[uint16]tiffEntry, tag uint16, i int) (float64, bool) {
+	entry, ok := entries[tag]
+	if !ok || (entry.typ != 5 && entry.typ != 10) || uint32(i) >= entry.count || len(entry.value) < i*8+8 {
+		return 0, false
+	}
+	value := entry.value[i*8 : i*8+8]
+	var num, den float64
+	if entry.typ == 5 {
+		num, den = float64(t.order.Uint32(value[0:4])), float64(t.order.Uint32(value[4:8]))
+	} else {
+		num, den = float64(int32(t.order.Uint32(value[0:4]))), float64(int32(t.order.Uint32(value[4:8])))
+	}
+	if den == 0 {
+		return 0, false
+	}
+	return num / den, true
+}
+
+// parseExif reads a TIFF structure and fills in metadata fields it carries
+// Fields already set (e.g. dimensions read from the container) are kept
+func parseExif(r io.ReaderAt, base, size int64, metadata *models.PhotoMetadata) error {
+	t, ifd0Offset, err := newTIFFReader(r, base, size)
+	if err != nil {
+		return err
+	}
+	ifd0, err := t.readIFD(ifd0Offset)
+	if err != nil {
+		return err
+	}
+
+	setString(&metadata.Make, t.ascii(ifd0, tagMake))
+	setString(&metadata.Model, t.ascii(ifd0, tagModel))
+	setString(&metadata.Software, t.ascii(ifd0, tagSoftware))
+	if orientation, ok := t.integer(ifd0, tagOrientation); ok && orientation >= 1 && orientation <= 8 {
+		metadata.Orientation = int(orientation)
+	}
+
+	exif := map[uint16]tiffEntry{}
+	if offset, ok := t.integer(ifd0, tagExifIFD); ok {
+		if exif, err = t.readIFD(offset); err != nil {
+			return err
+		}
+	}
+
+	setString(&metadata.LensModel, t.ascii(exif, tagLensModel))
+	if value, ok := t.rational(exif, tagExposureTime, 0); ok {
+		metadata.ExposureTime = value
+	}
+	if value, ok := t.rational(exif, tagFNumber, 0); ok {
+		metadata.FNumber = round(value, 2)
+	}
+	if value, ok := t.integer(exif, tagISO); ok {
+		metadata.ISO = int(value)
+	}
+	if value, ok := t.rational(exif, tagFocalLength, 0); ok {
+		metadata.FocalLength = round(value, 2)
+	}
+	if value, ok := t.integer(exif, tagFocalLength35mm); ok {
+		metadata.FocalLength35mm = int(value)
+	}
+
+	if metadata.Width == 0 || metadata.Height == 0 {
+		width, okWidth := t.integer(exif, tagPixelXDimension)
+		height, okHeight := t.integer(exif, tagPixelYDimension)
+		if !okWidth || !okHeight {
+			width, okWidth = t.integer(ifd0, tagImageWidth)
+			height, okHeight = t.integer(ifd0, tagImageLength)
+		}
+		if okWidth && okHeight {
+			metadata.Width, metadata.Height = int(width), int(height)
+		}
+	}
+
+	// DateTimeOriginal is the capture time; DateTime is the last modification
+	captured := t.ascii(exif, tagDateTimeOriginal)
+	if captured == "" {
+		captured = t.ascii(ifd0, tagDateTime)
+	}
+	if captured != "" && metadata.CapturedAt == nil {
+		offset := t.ascii(exif, tagOffsetTimeOrig)
+		if capturedAt, ok := parseExifTime(captured, offset); ok {
+			metadata.CapturedAt = &capturedAt
+			if _, err := time.Parse(exifOffsetTimeLayout, offset); err == nil {
+				metadata.CapturedOffset = offset
+			}
+		}
+	}
+
+	if offset, ok := t.integer(ifd0, tagGPSIFD); ok {
+		gps, err := t.readIFD(offset)
+		if err != nil {
+			return err
+		}
+		parseGPS(t, gps, metadata)
+	}
+	return nil
+}
+
+// parseGPS fills in coordinates from a GPS IFD
+func parseGPS(t *tiffReader, gps map[uint16]tiffEntry, metadata *models.PhotoMetadata) {
+	latitude, okLatitude := gpsCoordinate(t, gps, tagGPSLatitude)
+	longitude, okLongitude := gpsCoordinate(t, gps, tagGPSLongitude)
+	if okLatitude && okLongitude {
+		if t.ascii(gps, tagGPSLatitudeRef) == "S" {
+			latitude = -latitude
+		}
+		if t.ascii(gps, tagGPSLongitudeRef) == "W" {
+			longitude = -longitude
+		}
+		metadata.Latitude = &latitude
+		metadata.Longitude = &longitude
+	}
+
+	if altitude, ok := t.rational(gps, tagGPSAltitude, 0); ok {
+		if ref, ok := t.integer(gps, tagGPSAltitudeRef); ok && ref == 1 {
+			altitude = -altitude
+		}
+		altitude = round(altitude, 2)
+		metadata.Altitude = &altitude
+	}
+}
+
+// gpsCoordinate converts a degrees/minutes/seconds GPS field to decimal degrees
+func gpsCoordinate(t *tiffReader, gps map[uint16]tiffEntry, tag uint16) (float64, bool) {
+	degrees, ok := t.rational(gps, tag, 0)
+	if !ok {
+		return 0, false
+	}
+	minutes, _ := t.rational(gps, tag, 1)
+	seconds, _ := t.rational(gps, tag, 2)
+	return round(degrees+minutes/60+seconds/3600, 7), true
+}
+
+// parseExifTime parses an Exif date and optional "+08:00" offset
+// Without a valid offset the wall-clock time is returned in UTC
+func parseExifTime(value, offset string) (time.Time, bool) {
+	location := time.UTC
+	if zone, err := time.Parse(exifOffsetTimeLayout, offset); err == nil {
+		_, seconds := zone.Zone()
+		location = time.FixedZone("", seconds)
+	}
+	t, err := time.ParseInLocation(exifDateTimeLayout, value, location)
+	if err != nil || t.Year() < 1900 {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// setString sets a string field unless the value is empty
+func setString(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+// round rounds a value to the given number of decimal places
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// testTIFFField is one IFD entry of a TIFF structure built by buildTIFF
+type testTIFFField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// encodeIFD encodes an IFD placed at offset, followed by the values that do not fit in an entry
+func encodeIFD(offset uint32, fields []testTIFFField) []byte {
+	order := binary.LittleEndian
+	dataOffset := offset + 2 + uint32(len(fields))*12 + 4
+	entries := order.AppendUint16(nil, uint16(len(fields)))
+	var data []byte
+	for _, field := range fields {
+		entries = order.AppendUint16(entries, field.tag)
+		entries = order.AppendUint16(entries, field.typ)
+		entries = order.AppendUint32(entries, field.count)
+		if len(field.value) <= 4 {
+			value := make([]byte, 4)
+			copy(value, field.value)
+			entries = append(entries, value...)
+			continue
+		}
+		entries = order.AppendUint32(entries, dataOffset+uint32(len(data)))
+		data = append(data, field.value...)
+	}
+	entries = order.AppendUint32(entries, 0) // No next IFD
+	return append(entries, data...)
+}
+
+// buildTIFF builds a little-endian TIFF structure with IFD0 and, if given, an Exif IFD
+func buildTIFF(ifd0 []testTIFFField, exif []testTIFFField) []byte {
+	if exif != nil {
+		// The pointer's value does not change the size of IFD0, so encode it once to find the Exif IFD offset
+		ifd0 = append(ifd0, testTIFFField{tag: tagExifIFD, typ: 4, count: 1, value: make([]byte, 4)})
+		exifOffset := 8 + uint32(len(encodeIFD(8, ifd0)))
+		ifd0[len(ifd0)-1].value = binary.LittleEndian.AppendUint32(nil, exifOffset)
+	}
+	data := []byte("II*\x00\x08\x00\x00\x00")
+	data = append(data, encodeIFD(8, ifd0)...)
+	if exif != nil {
+		data = append(data, encodeIFD(uint32(len(data)), exif)...)
+	}
+	return data
+}
+
+func asciiField(tag uint16, value string) testTIFFField {
+	return testTIFFField{tag: tag, typ: 2, count: uint32(len(value) + 1), value: append([]byte(value), 0)}
+}
+
+func shortField(tag uint16, values ...uint16) testTIFFField {
+	var value []byte
+	for _, v := range values {
+		value = binary.LittleEndian.AppendUint16(value, v)
+	}
+	return testTIFFField{tag: tag, typ: 3, count: uint32(len(values)), value: value}
+}
+
+func rationalField(tag uint16, num, den uint32) testTIFFField {
+	value := binary.LittleEndian.AppendUint32(nil, num)
+	return testTIFFField{tag: tag, typ: 5, count: 1, value: binary.LittleEndian.AppendUint32(value, den)}
+}
+
+func TestParseExif(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		check   func(t *testing.T, metadata *models.PhotoMetadata)
+	}{
+		{
+			name: "camera and capture time",
+			data: buildTIFF(
+				[]testTIFFField{asciiField(tagMake, "Apple"), asciiField(tagModel, "iPhone 15 Pro"), shortField(tagOrientation, 6)},
+				[]testTIFFField{
+					rationalField(tagFNumber, 178, 100),
+					rationalField(tagExposureTime, 1, 120),
+					shortField(tagISO, 64),
+					asciiField(tagDateTimeOriginal, "2024:03:05 10:00:00"),
+					asciiField(tagOffsetTimeOrig, "+08:00"),
+				},
+			),
+			check: func(t *testing.T, metadata *models.PhotoMetadata) {
+				if metadata.Make != "Apple" || metadata.Model != "iPhone 15 Pro" {
+					t.Errorf("make/model = %q/%q", metadata.Make, metadata.Model)
+				}
+				if metadata.Orientation != 6 {
+					t.Errorf("orientation = %d, want 6", metadata.Orientation)
+				}
+				if metadata.FNumber != 1.78 || metadata.ISO != 64 {
+					t.Errorf("f_number/iso = %v/%d", metadata.FNumber, metadata.ISO)
+				}
+				if metadata.ExposureTime != 1.0/120 {
+					t.Errorf("exposure_time = %v", metadata.ExposureTime)
+				}
+				if metadata.CapturedAt == nil || metadata.CapturedAt.UTC().Hour() != 2 || metadata.CapturedOffset != "+08:00" {
+					t.Errorf("captured_at = %v %q", metadata.CapturedAt, metadata.CapturedOffset)
+				}
+			},
+		},
+		{
+			name: "rational tag with a short type",
+			data: buildTIFF(nil, []testTIFFField{shortField(tagFNumber, 1, 2, 3)}),
+			check: func(t *testing.T, metadata *models.PhotoMetadata) {
+				if metadata.FNumber != 0 {
+					t.Errorf("f_number = %v, want 0", metadata.FNumber)
+				}
+			},
+		},
+		{
+			name: "rational with a zero denominator",
+			data: buildTIFF(nil, []testTIFFField{rationalField(tagFocalLength, 686, 0)}),
+			check: func(t *testing.T, metadata *models.PhotoMetadata) {
+				if metadata.FocalLength != 0 {
+					t.Errorf("focal_length = %v, want 0", metadata.FocalLength)
+				}
+			},
+		},
+		{
+			name:    "no TIFF header",
+			data:    []byte("XX*\x00\x08\x00\x00\x00"),
+			wantErr: true,
+		},
+		{
+			name:    "IFD offset out of range",
+			data:    []byte("II*\x00\xff\xff\x00\x00"),
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			data:    []byte("II*"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := &models.PhotoMetadata{}
+			err := parseExif(bytes.NewReader(tt.data), 0, int64(len(tt.data)), metadata)
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedMetadata) {
+					t.Fatalf("error = %v, want %v", err, errMalformedMetadata)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, metadata)
+		})
+	}
+}
+
+func TestParseExifSkipsValueOutsideBlock(t *testing.T) {
+	// A Make value pointing past the end must not fail the IFD or hide the other tags
+	data := buildTIFF([]testTIFFField{
+		{tag: tagMake, typ: 2, count: 100, value: make([]byte, 100)},
+		shortField(tagOrientation, 3),
+	}, nil)
+	size := int64(8 + 2 + 2*12 + 4) // Only the IFD itself, not the Make value
+
+	metadata := &models.PhotoMetadata{}
+	if err := parseExif(bytes.NewReader(data), 0, size, metadata); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.Make != "" || metadata.Orientation != 3 {
+		t.Errorf("make/orientation = %q/%d, want \"\"/3", metadata.Make, metadata.Orientation)
+	}
+}
+
+func FuzzParseExif(f *testing.F) {
+	f.Add(buildTIFF(
+		[]testTIFFField{asciiField(tagMake, "Apple"), shortField(tagOrientation, 6)},
+		[]testTIFFField{rationalField(tagFNumber, 178, 100), asciiField(tagDateTimeOriginal, "2024:03:05 10:00:00")},
+	))
+	f.Add(buildTIFF(nil, []testTIFFField{shortField(tagFNumber, 1, 2, 3)}))
+	f.Add([]byte("MM\x00*\x00\x00\x00\x08"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = parseExif(bytes.NewReader(data), 0, int64(len(data)), &models.PhotoMetadata{})
+	})
+}
@@ -1,10 +1,17 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ios-photo-backup/photo-backup-server/internal/config"
@@ -13,61 +20,346 @@ import (
 // FileStorage handles file storage operations
 type FileStorage struct {
 	config *config.Config
+
+	locksMu sync.Mutex
+	locks   map[string]*pathLock // Per-path locks shared by all requests
+}
+
+// pathLock is a reference-counted mutex for one path
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
 }
 
 // NewFileStorage creates a new FileStorage instance
 func NewFileStorage(cfg *config.Config) *FileStorage {
 	return &FileStorage{
 		config: cfg,
+		locks:  make(map[string]*pathLock),
+	}
+}
+
+// LockPath serializes work on a path across concurrent requests
+// Call the returned function to release the lock
+func (fs *FileStorage) LockPath(path string) func() {
+	lock := fs.acquirePathLock(path)
+	lock.mu.Lock()
+	return func() { fs.releasePathLock(path, lock) }
+}
+
+// TryLockPath is like LockPath but returns false instead of waiting when the path is busy
+func (fs *FileStorage) TryLockPath(path string) (func(), bool) {
+	lock := fs.acquirePathLock(path)
+	if !lock.mu.TryLock() {
+		fs.locksMu.Lock()
+		fs.dropPathLock(path, lock)
+		fs.locksMu.Unlock()
+		return nil, false
+	}
+	return func() { fs.releasePathLock(path, lock) }, true
+}
+
+// acquirePathLock returns the lock for a path, taking a reference to it
+func (fs *FileStorage) acquirePathLock(path string) *pathLock {
+	fs.locksMu.Lock()
+	defer fs.locksMu.Unlock()
+
+	lock, ok := fs.locks[path]
+	if !ok {
+		lock = &pathLock{}
+		fs.locks[path] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+// releasePathLock unlocks a path lock and drops the reference taken for it
+func (fs *FileStorage) releasePathLock(path string, lock *pathLock) {
+	fs.locksMu.Lock()
+	defer fs.locksMu.Unlock()
+
+	lock.mu.Unlock()
+	fs.dropPathLock(path, lock)
+}
+
+// dropPathLock drops a reference, forgetting the lock once unused; locksMu must be held
+func (fs *FileStorage) dropPathLock(path string, lock *pathLock) {
+	lock.refs--
+	if lock.refs == 0 {
+		delete(fs.locks, path)
+	}
+}
+
+// WriteOptions controls how FileStorage writes a file
+type WriteOptions struct {
+	// ExpectedSHA256 is the hex digest the content must match; empty skips verification
+	ExpectedSHA256 string
+	// ExpectedSize is the size in bytes the content must have; 0 skips verification
+	ExpectedSize int64
+	// Extension the file is stored under; when set, the content type is detected
+	// from the leading bytes and compared with it
+	Extension string
+	// RejectContentMismatch fails the write if the content does not match Extension
+	RejectContentMismatch bool
+	// ArchivePath is where the file being replaced is kept, if it exists and the new
+	// content differs from CurrentSHA256; empty replaces the file without keeping it
+	ArchivePath string
+	// CurrentSHA256 is the hex digest of the file being replaced, if known
+	CurrentSHA256 string
+}
+
+// WriteResult describes a file written by FileStorage
+type WriteResult struct {
+	Size            int64
+	SHA256          string // Hex-encoded SHA-256 of the content
+	MimeType        string // Detected content type; only set when WriteOptions.Extension is
+	ContentMismatch bool   // Content does not match WriteOptions.Extension
+	Archived        bool   // The replaced file was kept at WriteOptions.ArchivePath
+}
+
+// ChecksumMismatchError is returned when written content does not match the expected hash
+// The destination file is left untouched when this error is returned
+type ChecksumMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected sha256 %s, got %s", e.Expected, e.Actual)
+}
+
+// SizeMismatchError is returned when written content does not have the expected size
+// The destination file is left untouched when this error is returned
+type SizeMismatchError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("size mismatch: expected %d bytes, got %d", e.Expected, e.Actual)
+}
+
+// verify checks a write result against the options
+func (o WriteOptions) verify(result *WriteResult) error {
+	if o.ExpectedSize > 0 && o.ExpectedSize != result.Size {
+		return &SizeMismatchError{Expected: o.ExpectedSize, Actual: result.Size}
+	}
+	if o.ExpectedSHA256 != "" && !strings.EqualFold(o.ExpectedSHA256, result.SHA256) {
+		return &ChecksumMismatchError{Expected: strings.ToLower(o.ExpectedSHA256), Actual: result.SHA256}
+	}
+	if o.RejectContentMismatch && result.ContentMismatch {
+		return &ContentTypeMismatchError{Extension: o.Extension, Detected: result.MimeType}
 	}
+	return nil
 }
 
+// TempFilePrefix is the name prefix of in-progress writes
+// Such files sit next to their destination and are removed on failure
+const TempFilePrefix = ".upload-"
+
 // SaveFile saves a file to the specified path
-func (fs *FileStorage) SaveFile(filePath string, data []byte) error {
+func (fs *FileStorage) SaveFile(filePath string, data []byte, opts WriteOptions) (*WriteResult, error) {
+	return fs.SaveFileStream(filePath, bytes.NewReader(data), opts)
+}
+
+// SaveFileStream saves a file from an io.Reader (streaming)
+func (fs *FileStorage) SaveFileStream(filePath string, reader io.Reader, opts WriteOptions) (*WriteResult, error) {
+	return fs.writeAtomic(filePath, opts, func(w io.Writer) error {
+		if _, err := io.Copy(w, reader); err != nil {
+			return fmt.Errorf("failed to stream file: %w", err)
+		}
+		return nil
+	})
+}
+
+// writeAtomic writes a file through a temp file in the destination directory
+// Content is hashed while written, fsynced, verified and only then renamed over
+// the destination; on any failure the temp file is removed and a previous
+// version of the destination is left untouched
+func (fs *FileStorage) writeAtomic(filePath string, opts WriteOptions, write func(w io.Writer) error) (*WriteResult, error) {
 	// Ensure directory exists
 	dir := filepath.Dir(filePath)
 	if err := config.EnsureDir(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Create temp file in the destination directory so the final rename is atomic
+	tmp, err := os.CreateTemp(dir, TempFilePrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	// Write while hashing and keeping the leading bytes for content detection
+	hasher := sha256.New()
+	head := &headWriter{}
+	counter := &countingWriter{w: io.MultiWriter(tmp, hasher, head)}
+	if err := write(counter); err != nil {
+		return nil, err
+	}
+
+	result := &WriteResult{Size: counter.n, SHA256: hex.EncodeToString(hasher.Sum(nil))}
+	if opts.Extension != "" {
+		result.MimeType, result.ContentMismatch = sniffContent(opts.Extension, head.head)
+	}
+	if err := opts.verify(result); err != nil {
+		return nil, err
+	}
+
+	// Flush content to disk before it becomes visible under the final name
+	if err := tmp.Chmod(0644); err != nil {
+		return nil, fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if opts.ArchivePath != "" && !strings.EqualFold(opts.CurrentSHA256, result.SHA256) {
+		if result.Archived, err = fs.archive(filePath, opts.ArchivePath); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return nil, fmt.Errorf("failed to move file into place: %w", err)
+	}
+	renamed = true
+
+	// Persist the rename itself
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// archive keeps the current content of a file at archivePath before it is replaced
+// The file is hard-linked, so the destination never goes missing; a copy is made
+// where linking is not possible. Returns false if there is no file to keep
+func (fs *FileStorage) archive(filePath, archivePath string) (bool, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check file: %w", err)
+	}
+
+	dir := filepath.Dir(archivePath)
+	if err := config.EnsureDir(dir, 0755); err != nil {
+		return false, fmt.Errorf("failed to create version directory: %w", err)
+	}
+	// A leftover from an interrupted upload is replaced
+	if err := os.Remove(archivePath); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to remove stale version: %w", err)
 	}
 
-	// Write file
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+	if err := os.Link(filePath, archivePath); err != nil {
+		if err := fs.CopyFile(filePath, archivePath); err != nil {
+			return false, fmt.Errorf("failed to keep previous version: %w", err)
+		}
+		return true, nil
+	}
+	if err := syncDir(dir); err != nil {
+		return false, err
 	}
+	return true, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
 
+// syncDir fsyncs a directory so that entries renamed into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
 	return nil
 }
 
-// SaveFileStream saves a file from an io.Reader (streaming)
-func (fs *FileStorage) SaveFileStream(filePath string, reader io.Reader) error {
+// WriteAt replaces the content of a file from offset onwards with data from reader
+// Anything already past offset is discarded first, so a retried write never leaves
+// stale bytes behind. The file is fsynced before returning; if reading fails midway,
+// the bytes received up to that point are kept, synced and counted in the result
+func (fs *FileStorage) WriteAt(filePath string, offset int64, reader io.Reader) (int64, error) {
 	// Ensure directory exists
-	dir := filepath.Dir(filePath)
-	if err := config.EnsureDir(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	if err := config.EnsureDir(filepath.Dir(filePath), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// Create file
-	dst, err := os.Create(filePath)
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("failed to truncate file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek file: %w", err)
 	}
-	defer dst.Close()
 
-	// Stream copy
-	if _, err := io.Copy(dst, reader); err != nil {
-		return fmt.Errorf("failed to stream file: %w", err)
+	n, copyErr := io.Copy(file, reader)
+	if err := file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync file: %w", err)
 	}
+	if copyErr != nil {
+		return n, fmt.Errorf("failed to write file: %w", copyErr)
+	}
+	return n, nil
+}
 
+// Truncate truncates a file to the given size
+func (fs *FileStorage) Truncate(filePath string, size int64) error {
+	if err := os.Truncate(filePath, size); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
 	return nil
 }
 
-// ReadFile reads a file from the specified path
-func (fs *FileStorage) ReadFile(filePath string) ([]byte, error) {
-	data, err := os.ReadFile(filePath)
+// OpenFile opens a file for reading and returns its info
+// The caller must close the returned file
+func (fs *FileStorage) OpenFile(filePath string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	info, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to open file: %w", os.ErrNotExist)
 	}
-	return data, nil
+
+	return file, info, nil
 }
 
 // FileExists checks if a file exists
@@ -94,6 +386,29 @@ func (fs *FileStorage) DeleteFile(filePath string) error {
 	return nil
 }
 
+// MoveFile moves a file to dst, creating its directory and replacing any file there
+// Returns false if there is no file at src
+func (fs *FileStorage) MoveFile(src, dst string) (bool, error) {
+	if _, err := os.Stat(src); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check file: %w", err)
+	}
+
+	dir := filepath.Dir(dst)
+	if err := config.EnsureDir(dir, 0755); err != nil {
+		return false, fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return false, fmt.Errorf("failed to move file: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // GetFileSize returns the size of a file
 func (fs *FileStorage) GetFileSize(filePath string) (int64, error) {
 	info, err := os.Stat(filePath)
@@ -112,12 +427,8 @@ func (fs *FileStorage) SetFileTimes(filePath string, atime, mtime time.Time) err
 }
 
 // CopyFile copies a file from src to dst
+// dst is replaced atomically, so it is either the old or the complete new content
 func (fs *FileStorage) CopyFile(src, dst string) error {
-	// Ensure destination directory exists
-	if err := config.EnsureDir(filepath.Dir(dst), 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
 	// Copy file
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -125,14 +436,13 @@ func (fs *FileStorage) CopyFile(src, dst string) error {
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
-	}
-	defer dstFile.Close()
-
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("failed to copy file: %w", err)
+	if _, err := fs.writeAtomic(dst, WriteOptions{}, func(w io.Writer) error {
+		if _, err := io.Copy(w, srcFile); err != nil {
+			return fmt.Errorf("failed to copy file: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return nil
@@ -149,6 +459,57 @@ func (fs *FileStorage) GetChunkPath(filePath string, chunkNumber int) string {
 	return filepath.Join(chunkDir, fmt.Sprintf("chunk_%03d", chunkNumber))
 }
 
+// Upload limits. A chunked upload may not declare more chunks than a file of MaxUploadSize split into
+// chunks of MinChunkSize, which bounds the per-chunk bookkeeping of a session
+const (
+	MaxUploadSize   int64 = 16 << 30 // 16GB, the largest file a chunked or tus upload may declare
+	MinChunkSize    int64 = 1 << 20  // 1MB
+	MaxUploadChunks       = int(MaxUploadSize / MinChunkSize)
+)
+
+// ChunkSession records the parameters a chunked upload was started with
+// It is kept as session.json in the chunk directory
+type ChunkSession struct {
+	TotalChunks    int       `json:"total_chunks"`
+	TotalSize      int64     `json:"total_size,omitempty"` // 0 if not declared
+	ExpectedSHA256 string    `json:"sha256,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// getChunkSessionPath returns the path of the session file of a chunked upload
+func (fs *FileStorage) getChunkSessionPath(filePath string) string {
+	return filepath.Join(fs.GetChunkDir(filePath), "session.json")
+}
+
+// LoadChunkSession reads the session of a chunked upload, returning nil if there is none
+func (fs *FileStorage) LoadChunkSession(filePath string) (*ChunkSession, error) {
+	data, err := os.ReadFile(fs.getChunkSessionPath(filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read chunk session: %w", err)
+	}
+
+	var session ChunkSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse chunk session: %w", err)
+	}
+	return &session, nil
+}
+
+// SaveChunkSession writes the session of a chunked upload
+func (fs *FileStorage) SaveChunkSession(filePath string, session *ChunkSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk session: %w", err)
+	}
+	if _, err := fs.SaveFile(fs.getChunkSessionPath(filePath), data, WriteOptions{}); err != nil {
+		return fmt.Errorf("failed to write chunk session: %w", err)
+	}
+	return nil
+}
+
 // SaveChunk saves a single chunk to the chunk directory
 func (fs *FileStorage) SaveChunk(filePath string, chunkNumber int, data []byte) error {
 	chunkDir := fs.GetChunkDir(filePath)
@@ -160,8 +521,8 @@ func (fs *FileStorage) SaveChunk(filePath string, chunkNumber int, data []byte)
 
 	chunkPath := fs.GetChunkPath(filePath, chunkNumber)
 
-	// Write chunk file
-	if err := os.WriteFile(chunkPath, data, 0644); err != nil {
+	// Write chunk file; a retried chunk replaces the previous attempt atomically
+	if _, err := fs.SaveFile(chunkPath, data, WriteOptions{}); err != nil {
 		return fmt.Errorf("failed to write chunk %d: %w", chunkNumber, err)
 	}
 
@@ -169,35 +530,32 @@ func (fs *FileStorage) SaveChunk(filePath string, chunkNumber int, data []byte)
 }
 
 // MergeChunks merges all chunks into the final file
-func (fs *FileStorage) MergeChunks(filePath string, totalChunks int) error {
-	// Ensure destination directory exists
-	dir := filepath.Dir(filePath)
-	if err := config.EnsureDir(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
+// The merged content is verified before it replaces the destination
+func (fs *FileStorage) MergeChunks(filePath string, totalChunks int, opts WriteOptions) (*WriteResult, error) {
+	return fs.writeAtomic(filePath, opts, func(w io.Writer) error {
+		// Merge chunks in order
+		for i := 0; i < totalChunks; i++ {
+			if _, err := fs.copyChunk(w, filePath, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	// Create destination file
-	dst, err := os.Create(filePath)
+// copyChunk copies one stored chunk into w
+func (fs *FileStorage) copyChunk(w io.Writer, filePath string, chunkNumber int) (int64, error) {
+	chunk, err := os.Open(fs.GetChunkPath(filePath, chunkNumber))
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
+		return 0, fmt.Errorf("failed to read chunk %d: %w", chunkNumber, err)
 	}
-	defer dst.Close()
-
-	// Merge chunks in order
-	for i := 0; i < totalChunks; i++ {
-		chunkPath := fs.GetChunkPath(filePath, i)
+	defer chunk.Close()
 
-		chunkData, err := os.ReadFile(chunkPath)
-		if err != nil {
-			return fmt.Errorf("failed to read chunk %d: %w", i, err)
-		}
-
-		if _, err := dst.Write(chunkData); err != nil {
-			return fmt.Errorf("failed to write chunk %d: %w", i, err)
-		}
+	n, err := io.Copy(w, chunk)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write chunk %d: %w", chunkNumber, err)
 	}
-
-	return nil
+	return n, nil
 }
 
 // CleanupChunks removes all chunk files for a given file path
@@ -211,28 +569,52 @@ func (fs *FileStorage) CleanupChunks(filePath string) error {
 	return nil
 }
 
-// GetUploadedChunks returns the list of uploaded chunk numbers
+// GetUploadedChunks returns the sorted list of uploaded chunk numbers
 func (fs *FileStorage) GetUploadedChunks(filePath string) ([]int, error) {
+	sizes, err := fs.GetUploadedChunkSizes(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make([]int, 0, len(sizes))
+	for chunkNum := range sizes {
+		chunks = append(chunks, chunkNum)
+	}
+	sort.Ints(chunks)
+
+	return chunks, nil
+}
+
+// GetUploadedChunkSizes returns the size of each uploaded chunk by chunk number
+func (fs *FileStorage) GetUploadedChunkSizes(filePath string) (map[int]int64, error) {
 	chunkDir := fs.GetChunkDir(filePath)
 
 	entries, err := os.ReadDir(chunkDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return []int{}, nil
+			return map[int]int64{}, nil
 		}
 		return nil, fmt.Errorf("failed to read chunk directory: %w", err)
 	}
 
-	var chunks []int
+	sizes := make(map[int]int64)
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
 		var chunkNum int
-		if _, err := fmt.Sscanf(entry.Name(), "chunk_%d", &chunkNum); err == nil {
-			chunks = append(chunks, chunkNum)
+		if _, err := fmt.Sscanf(entry.Name(), "chunk_%d", &chunkNum); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get chunk info: %w", err)
 		}
+		sizes[chunkNum] = info.Size()
 	}
 
-	return chunks, nil
+	return sizes, nil
 }
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+)
+
+// newTestFileStorage creates a FileStorage rooted in a temporary directory
+func newTestFileStorage(t *testing.T) *FileStorage {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.StorageDir = t.TempDir()
+	return NewFileStorage(cfg)
+}
+
+func TestMergeChunksOutOfOrderAndRetried(t *testing.T) {
+	fs := newTestFileStorage(t)
+	path := filepath.Join(fs.config.StorageDir, "photo", "1", "IMG_0001.mov")
+	chunks := [][]byte{[]byte("first-"), []byte("second-"), []byte("third")}
+
+	// Chunks arrive out of order, and chunk 1 is sent twice; the retry replaces the first attempt
+	for _, step := range []struct {
+		number int
+		data   []byte
+	}{{2, chunks[2]}, {1, []byte("stale-")}, {0, chunks[0]}, {1, chunks[1]}} {
+		if err := fs.SaveChunk(path, step.number, step.data); err != nil {
+			t.Fatalf("save chunk %d: %v", step.number, err)
+		}
+	}
+
+	received, err := fs.GetUploadedChunks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, []int{0, 1, 2}) {
+		t.Fatalf("received chunks = %v, want [0 1 2]", received)
+	}
+
+	want := bytes.Join(chunks, nil)
+	sum := sha256.Sum256(want)
+	result, err := fs.MergeChunks(path, len(chunks), WriteOptions{ExpectedSHA256: hex.EncodeToString(sum[:]), ExpectedSize: int64(len(want))})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) || result.Size != int64(len(want)) {
+		t.Errorf("merged %q (%d bytes), want %q", got, result.Size, want)
+	}
+}
+
+func TestMergeChunksMissingChunk(t *testing.T) {
+	fs := newTestFileStorage(t)
+	path := filepath.Join(fs.config.StorageDir, "photo", "1", "IMG_0001.mov")
+	for _, number := range []int{0, 2} {
+		if err := fs.SaveChunk(path, number, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := fs.MergeChunks(path, 3, WriteOptions{}); err == nil {
+		t.Fatal("merge with a missing chunk succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("destination exists after a failed merge: %v", err)
+	}
+}
+
+func TestMergeChunksChecksumMismatch(t *testing.T) {
+	fs := newTestFileStorage(t)
+	path := filepath.Join(fs.config.StorageDir, "photo", "1", "IMG_0001.mov")
+	if err := fs.SaveChunk(path, 0, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	var mismatch *ChecksumMismatchError
+	if _, err := fs.MergeChunks(path, 1, WriteOptions{ExpectedSHA256: hex.EncodeToString(make([]byte, 32))}); !errors.As(err, &mismatch) {
+		t.Fatalf("error = %v, want a checksum mismatch", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("destination exists after a checksum mismatch: %v", err)
+	}
+}
+
+func TestOpenChunkSession(t *testing.T) {
+	fs := newTestFileStorage(t)
+	s := &PhotoService{fileStorage: fs}
+	path := filepath.Join(fs.config.StorageDir, "photo", "1", "IMG_0001.mov")
+	hash := hex.EncodeToString(make([]byte, 32))
+
+	// The first chunk starts the session; size and hash are recorded from whichever chunk sends them
+	if _, err := s.openChunkSession(path, 3, 0, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	session, err := s.openChunkSession(path, 3, 100, hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.TotalChunks != 3 || session.TotalSize != 100 || session.ExpectedSHA256 != hash {
+		t.Fatalf("session = %+v", session)
+	}
+
+	tests := []struct {
+		name        string
+		totalChunks int
+		totalSize   int64
+		sha256      string
+		wantErr     error
+	}{
+		{name: "same parameters", totalChunks: 3, totalSize: 100, sha256: hash},
+		{name: "parameters left out", totalChunks: 3},
+		{name: "different total_chunks", totalChunks: 4, wantErr: ErrChunkSessionConflict},
+		{name: "different total_size", totalChunks: 3, totalSize: 200, wantErr: ErrChunkSessionConflict},
+		{name: "different sha256", totalChunks: 3, sha256: hex.EncodeToString(bytes.Repeat([]byte{1}, 32)), wantErr: ErrChunkSessionConflict},
+		{name: "no chunks", totalChunks: 0, wantErr: ErrInvalidChunkCount},
+		{name: "too many chunks", totalChunks: MaxUploadChunks + 1, wantErr: ErrInvalidChunkCount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.openChunkSession(path, tt.totalChunks, tt.totalSize, tt.sha256)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Rejected chunks leave the session unchanged
+	session, err = fs.LoadChunkSession(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.TotalChunks != 3 || session.TotalSize != 100 || session.ExpectedSHA256 != hash {
+		t.Errorf("session after conflicts = %+v", session)
+	}
+}
+
+func TestMissingChunks(t *testing.T) {
+	tests := []struct {
+		name        string
+		received    []int
+		totalChunks int
+		limit       int
+		want        []int
+	}{
+		{name: "none received", totalChunks: 3, limit: 10, want: []int{0, 1, 2}},
+		{name: "gaps", received: []int{0, 2, 4}, totalChunks: 6, limit: 10, want: []int{1, 3, 5}},
+		{name: "complete", received: []int{0, 1, 2}, totalChunks: 3, limit: 10, want: []int{}},
+		{name: "limited", received: []int{1}, totalChunks: MaxUploadChunks, limit: 3, want: []int{0, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingChunks(tt.received, tt.totalChunks, tt.limit); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missing = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+// Kinds of leftovers removed by the Janitor
+const (
+	CleanupChunkDir  = "chunk_dir"  // <file>.chunks directory of an abandoned chunked upload
+	CleanupTusUpload = "tus_upload" // Data of an abandoned tus upload
+	CleanupTempFile  = "temp_file"  // Interrupted atomic write, preview or multipart temp file
+)
+
+// CleanupItem is one leftover found by a sweep
+type CleanupItem struct {
+	Kind    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// CleanupReport summarizes a sweep
+type CleanupReport struct {
+	Items  []CleanupItem
+	Bytes  int64 // Total size of Items
+	Failed int   // Items that could not be removed
+}
+
+// Janitor removes leftovers of abandoned uploads from the storage directory:
+// chunk directories, tus upload data and temp files not modified within a maximum age
+type Janitor struct {
+	storageDir string
+	uploadRepo *repository.TusUploadRepository
+	logger     *logger.Logger
+}
+
+// NewJanitor creates a new Janitor
+func NewJanitor(storageDir string, uploadRepo *repository.TusUploadRepository, appLogger *logger.Logger) *Janitor {
+	return &Janitor{
+		storageDir: storageDir,
+		uploadRepo: uploadRepo,
+		logger:     appLogger,
+	}
+}
+
+// Run sweeps once immediately and then every interval until ctx is done
+// An interval of 0 or less disables the janitor
+func (j *Janitor) Run(ctx context.Context, interval, maxAge time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := j.Sweep(maxAge, false)
+		if err != nil {
+			j.logger.Error("Upload cleanup failed", logger.String("error", err.Error()))
+		} else if len(report.Items) > 0 || report.Failed > 0 {
+			j.logger.Info("Upload cleanup complete",
+				logger.Int("removed", len(report.Items)-report.Failed),
+				logger.Int("failed", report.Failed),
+				logger.Int64("bytes", report.Bytes))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep finds leftovers not modified within maxAge and, unless dryRun is set, removes them
+func (j *Janitor) Sweep(maxAge time.Duration, dryRun bool) (*CleanupReport, error) {
+	cutoff := time.Now().Add(-maxAge)
+	report := &CleanupReport{}
+
+	// Chunk directories and interrupted writes next to stored photos, kept versions and trashed files
+	for _, area := range []string{"photo", versionDirName, trashDirName} {
+		if err := j.sweepTree(filepath.Join(j.storageDir, area), cutoff, dryRun, report, func(path string, entry fs.DirEntry) string {
+			if entry.IsDir() && strings.HasSuffix(entry.Name(), ".chunks") {
+				return CleanupChunkDir
+			}
+			if !entry.IsDir() && strings.HasPrefix(entry.Name(), TempFilePrefix) {
+				return CleanupTempFile
+			}
+			return ""
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Previews being written when the server stopped
+	if err := j.sweepTree(filepath.Join(j.storageDir, "thumbnail"), cutoff, dryRun, report, func(path string, entry fs.DirEntry) string {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), thumbnailTempPrefix) {
+			return CleanupTempFile
+		}
+		return ""
+	}); err != nil {
+		return nil, err
+	}
+
+	// Multipart form files spooled by the server (TMPDIR)
+	if err := j.sweepTree(filepath.Join(j.storageDir, "tmp"), cutoff, dryRun, report, func(path string, entry fs.DirEntry) string {
+		if !entry.IsDir() {
+			return CleanupTempFile
+		}
+		return ""
+	}); err != nil {
+		return nil, err
+	}
+
+	// Unfinished tus uploads; the data file is rewritten on every PATCH
+	if err := j.sweepTree(filepath.Join(j.storageDir, tusUploadDirName), cutoff, dryRun, report, func(path string, entry fs.DirEntry) string {
+		if !entry.IsDir() {
+			return CleanupTusUpload
+		}
+		return ""
+	}); err != nil {
+		return nil, err
+	}
+	if j.uploadRepo != nil && !dryRun {
+		// Also drops records whose data file is already gone
+		if _, err := j.uploadRepo.DeleteUpdatedBefore(cutoff); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// sweepTree walks root and removes every entry that classify names as a leftover
+// and that has not been modified since cutoff; a missing root is skipped
+func (j *Janitor) sweepTree(root string, cutoff time.Time, dryRun bool, report *CleanupReport, classify func(path string, entry fs.DirEntry) string) error {
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		kind := classify(path, entry)
+		if kind == "" {
+			return nil
+		}
+
+		// A directory's mtime changes whenever an entry is added, replaced or removed
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		size := info.Size()
+		if entry.IsDir() {
+			if size, err = dirSize(path); err != nil {
+				return err
+			}
+		}
+
+		report.Items = append(report.Items, CleanupItem{Kind: kind, Path: path, Size: size, ModTime: info.ModTime()})
+		report.Bytes += size
+
+		if !dryRun {
+			if err := j.remove(kind, path); err != nil {
+				report.Failed++
+				j.logger.Warn("Failed to remove upload leftover",
+					logger.String("path", path),
+					logger.String("error", err.Error()))
+			}
+		}
+
+		if entry.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sweep %s: %w", root, err)
+	}
+	return nil
+}
+
+// remove deletes one leftover
+func (j *Janitor) remove(kind, path string) error {
+	if kind == CleanupTusUpload && j.uploadRepo != nil {
+		// The data file is named after the upload ID
+		if err := j.uploadRepo.Delete(filepath.Base(path)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+// dirSize returns the total size of the regular files below a directory
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %w", dir, err)
+	}
+	return size, nil
+}
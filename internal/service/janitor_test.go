@@ -0,0 +1,71 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSweepTempFiles(t *testing.T) {
+	storageDir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	files := []struct {
+		path    string
+		recent  bool
+		removed bool
+	}{
+		{path: "photo/1/2025/12/10/" + TempFilePrefix + "1", removed: true},
+		{path: "version/1/2025/12/10/" + TempFilePrefix + "2", removed: true},
+		{path: "trash/1/photo/2025/12/10/" + TempFilePrefix + "3", removed: true},
+		{path: "trash/1/version/2025/12/10/" + TempFilePrefix + "4", removed: true},
+		{path: "photo/1/2025/12/10/" + TempFilePrefix + "5", recent: true},
+		{path: "photo/1/2025/12/10/IMG_0001.jpg"},
+		{path: "version/1/2025/12/10/IMG_0001.v1.jpg"},
+		{path: "trash/1/photo/2025/12/10/IMG_0002.jpg"},
+	}
+	var want []string
+	for _, file := range files {
+		path := filepath.Join(storageDir, file.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !file.recent {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if file.removed {
+			want = append(want, path)
+		}
+	}
+
+	report, err := NewJanitor(storageDir, nil, nil).Sweep(24*time.Hour, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, item := range report.Items {
+		if item.Kind != CleanupTempFile {
+			t.Errorf("%s removed as %s, want %s", item.Path, item.Kind, CleanupTempFile)
+		}
+		got = append(got, item.Path)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("removed %v, want %v", got, want)
+	}
+
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(storageDir, file.path))
+		if exists := err == nil; exists == file.removed {
+			t.Errorf("%s: exists = %v after the sweep", file.path, exists)
+		}
+	}
+}
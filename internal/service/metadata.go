@@ -0,0 +1,242 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// ExtractMetadata reads camera, exposure, location and capture time metadata from a stored file
+// The format is detected from the content; JPEG, HEIC/HEIF, TIFF/DNG and MOV/MP4 are supported.
+// Returns nil without an error for other formats
+func ExtractMetadata(filePath string) (*models.PhotoMetadata, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	metadata := &models.PhotoMetadata{}
+	switch DetectContentType(head[:n]) {
+	case "image/jpeg":
+		err = extractJPEG(file, metadata)
+	case "image/heic", "image/heif", mimeHEICSequence, mimeHEIFSequence:
+		err = extractHEIF(file, info.Size(), metadata)
+	case "image/tiff", "image/x-adobe-dng":
+		err = parseExif(file, 0, info.Size(), metadata)
+	case "video/quicktime", "video/mp4", "video/x-m4v":
+		err = extractQuickTime(file, info.Size(), metadata)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// extractJPEG reads the Exif APP1 segment and the frame size of a JPEG file
+func extractJPEG(file *os.File, metadata *models.PhotoMetadata) error {
+	reader := bufio.NewReader(file)
+	if _, err := reader.Discard(2); err != nil { // SOI
+		return fmt.Errorf("failed to read JPEG: %w", err)
+	}
+
+	var exif []byte
+	width, height := 0, 0
+	for {
+		marker, err := nextJPEGMarker(reader)
+		if err != nil {
+			return err
+		}
+		// Markers without a payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+		// Image data follows start of scan; everything of interest comes before it
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+
+		var lengthBytes [2]byte
+		if _, err := io.ReadFull(reader, lengthBytes[:]); err != nil {
+			return fmt.Errorf("failed to read JPEG segment: %w", err)
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes[:])) - 2
+		if length < 0 {
+			return fmt.Errorf("%w: invalid JPEG segment length", errMalformedMetadata)
+		}
+
+		switch {
+		case marker == 0xE1 && exif == nil:
+			segment := make([]byte, length)
+			if _, err := io.ReadFull(reader, segment); err != nil {
+				return fmt.Errorf("failed to read JPEG segment: %w", err)
+			}
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				exif = segment[6:]
+			}
+		case isJPEGFrameMarker(marker) && width == 0:
+			segment := make([]byte, length)
+			if _, err := io.ReadFull(reader, segment); err != nil {
+				return fmt.Errorf("failed to read JPEG segment: %w", err)
+			}
+			if len(segment) >= 5 {
+				height = int(binary.BigEndian.Uint16(segment[1:3]))
+				width = int(binary.BigEndian.Uint16(segment[3:5]))
+			}
+		default:
+			if _, err := reader.Discard(length); err != nil {
+				return fmt.Errorf("failed to read JPEG segment: %w", err)
+			}
+		}
+	}
+
+	if width > 0 && height > 0 {
+		metadata.Width, metadata.Height = width, height
+	}
+	if exif != nil {
+		return parseExif(bytes.NewReader(exif), 0, int64(len(exif)), metadata)
+	}
+	return nil
+}
+
+// nextJPEGMarker skips to the next marker and returns its code
+func nextJPEGMarker(reader *bufio.Reader) (byte, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read JPEG marker: %w", err)
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("%w: expected JPEG marker", errMalformedMetadata)
+	}
+	// Any number of 0xFF fill bytes may precede the marker code
+	for b == 0xFF {
+		if b, err = reader.ReadByte(); err != nil {
+			return 0, fmt.Errorf("failed to read JPEG marker: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// isJPEGFrameMarker reports whether a marker starts a frame (SOF0-SOF15 except DHT, JPG and DAC)
+func isJPEGFrameMarker(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+// extractMetadataSafely runs ExtractMetadata, turning a parser panic on malformed content into an error
+func extractMetadataSafely(filePath string) (metadata *models.PhotoMetadata, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metadata, err = nil, fmt.Errorf("%w: %v", errMalformedMetadata, r)
+		}
+	}()
+	return ExtractMetadata(filePath)
+}
+
+// recordMetadata extracts and stores the metadata of an uploaded file
+// Files in unsupported formats are skipped. Metadata is best effort: a file that cannot be parsed
+// gets a record holding only the error, so it is not parsed again on every request
+func (s *PhotoService) recordMetadata(photo *models.Photo, role, fileExtension, fullPath string) (*models.PhotoMetadata, error) {
+	metadata, err := extractMetadataSafely(fullPath)
+	if err != nil {
+		metadata = &models.PhotoMetadata{ExtractionError: err.Error()}
+	} else if metadata == nil {
+		return nil, nil
+	}
+
+	metadata.LocalID = photo.LocalID
+	metadata.Role = role
+	metadata.Extension = fileExtension
+	metadata.ExtractedAt = time.Now()
+	if err := s.photoRepo.SaveMetadata(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// PhotoMetadataResponse describes the metadata of a photo across its uploaded files
+type PhotoMetadataResponse struct {
+	LocalID      string              `json:"local_id"`
+	CreationTime time.Time           `json:"creation_time"` // As sent by the client when indexing
+	Files        []PhotoFileMetadata `json:"files"`
+}
+
+// PhotoFileMetadata is the metadata extracted from one uploaded file
+type PhotoFileMetadata struct {
+	models.PhotoMetadata
+	// Seconds the client's creation time is ahead of the embedded capture time;
+	// omitted when the file has no capture time with a known offset
+	CreationTimeDelta *float64 `json:"creation_time_delta,omitempty"`
+}
+
+// GetPhotoMetadata returns the metadata of every uploaded file of a photo
+// Files uploaded before metadata extraction existed are extracted on first request
+func (s *PhotoService) GetPhotoMetadata(localID string) (*PhotoMetadataResponse, error) {
+	photo, err := s.FindPhoto(localID)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := s.photoRepo.GetMetadata(localID)
+	if err != nil {
+		return nil, err
+	}
+	extracted := make(map[string]bool, len(records))
+	for _, record := range records {
+		extracted[record.Role+"/"+record.Extension] = true
+	}
+
+	files, err := s.photoRepo.GetFiles(localID)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if extracted[file.Role+"/"+file.Extension] {
+			continue
+		}
+		fullPath, err := s.resolvePhotoPath(photo, file.Role, file.Extension)
+		if err != nil {
+			return nil, err
+		}
+		metadata, err := s.recordMetadata(photo, file.Role, file.Extension, fullPath)
+		if err != nil {
+			return nil, err
+		}
+		if metadata != nil {
+			records = append(records, *metadata)
+		}
+	}
+
+	resp := &PhotoMetadataResponse{
+		LocalID:      photo.LocalID,
+		CreationTime: photo.CreationTime,
+		Files:        make([]PhotoFileMetadata, 0, len(records)),
+	}
+	for _, record := range records {
+		file := PhotoFileMetadata{PhotoMetadata: record}
+		if record.CapturedAt != nil && record.CapturedOffset != "" {
+			delta := photo.CreationTime.Sub(*record.CapturedAt).Seconds()
+			file.CreationTimeDelta = &delta
+		}
+		resp.Files = append(resp.Files, file)
+	}
+	return resp, nil
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"mime"
+	"strings"
+)
+
+// extensionMimeTypes covers photo library formats missing from the system MIME tables
+var extensionMimeTypes = map[string]string{
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"heic": "image/heic",
+	"heif": "image/heif",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"dng":  "image/x-adobe-dng",
+	"tif":  "image/tiff",
+	"tiff": "image/tiff",
+	"mov":  "video/quicktime",
+	"mp4":  "video/mp4",
+	"m4v":  "video/x-m4v",
+	"aae":  "application/x-plist",
+}
+
+// MimeTypeForExtension returns the MIME type for a file extension (without dot)
+func MimeTypeForExtension(fileExtension string) string {
+	ext := strings.ToLower(fileExtension)
+	if mimeType, ok := extensionMimeTypes[ext]; ok {
+		return mimeType
+	}
+	if mimeType := mime.TypeByExtension("." + ext); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
@@ -1,20 +1,36 @@
 package service
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/ios-photo-backup/photo-backup-server/internal/models"
 	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
 )
 
+// Errors returned by PhotoService that handlers map to specific HTTP statuses
+var (
+	ErrPhotoNotFound        = errors.New("photo not found")
+	ErrFileNotFound         = errors.New("file not found")
+	ErrThumbnailUnavailable = errors.New("no uploaded file supports thumbnails")
+	ErrChunkSessionNotFound = errors.New("no chunk upload session")
+	ErrChunkSessionConflict = errors.New("chunk upload session was started with different parameters")
+	ErrInvalidChunkCount    = errors.New("total_chunks must be between 1 and the maximum number of chunks")
+)
+
 // PhotoService handles photo operations
 type PhotoService struct {
 	photoRepo     *repository.PhotoRepository
 	naming        *PhotoNaming
 	fileStorage   *FileStorage
+	thumbnails    *ThumbnailService
+	events        *EventBroker
 	storageDir    string
 }
 
@@ -23,31 +39,109 @@ func NewPhotoService(
 	photoRepo *repository.PhotoRepository,
 	naming *PhotoNaming,
 	fileStorage *FileStorage,
+	thumbnails *ThumbnailService,
+	events *EventBroker,
 	storageDir string,
 ) *PhotoService {
 	return &PhotoService{
 		photoRepo:   photoRepo,
 		naming:      naming,
 		fileStorage: fileStorage,
+		thumbnails:  thumbnails,
+		events:      events,
 		storageDir:  storageDir,
 	}
 }
 
 // PhotoIndexRequest represents a photo indexing request
 type PhotoIndexRequest struct {
-	LocalID       string    `json:"local_id"`
-	CreationTime  time.Time `json:"creation_time"`
-	FileType      string    `json:"file_type"` // File extension (e.g., "jpg", "heic", "png")
+	LocalID      string          `json:"local_id"`
+	CreationTime time.Time       `json:"creation_time"`
+	FileType     string          `json:"file_type"`           // File extension (e.g., "jpg", "heic", "png")
+	Resources    []IndexResource `json:"resources,omitempty"` // Optional files the asset consists of
+}
+
+// IndexResource declares one file of an asset when indexing
+type IndexResource struct {
+	Role     string `json:"role"`      // Empty to infer it from the file type
+	FileType string `json:"file_type"` // File extension
 }
 
 // PhotoIndexResponse represents a photo indexing response
 type PhotoIndexResponse struct {
-	LocalID            string   `json:"local_id"`
-	UploadedExtensions []string `json:"uploaded_extensions"`
+	LocalID            string                `json:"local_id"`
+	UploadedExtensions []string              `json:"uploaded_extensions"`
+	Resources          []IndexResourceStatus `json:"resources"`         // Declared and uploaded resources
+	Trashed            bool                  `json:"trashed,omitempty"` // In the trash; uploads are refused until it is restored
+}
+
+// IndexResourceStatus reports whether one resource of an asset has been uploaded, and which version the server has
+type IndexResourceStatus struct {
+	Role      string `json:"role"`
+	Extension string `json:"extension"`
+	Uploaded  bool   `json:"uploaded"`
+	Version   int    `json:"version,omitempty"` // Current version on the server
+	SHA256    string `json:"sha256,omitempty"`  // Hash of the current version
+}
+
+// indexResourceStatuses merges the resources declared by the client with those already uploaded
+// Declared resources come first in the order sent, followed by any other uploaded files
+func indexResourceStatuses(photo *models.Photo, declared []IndexResource, files []models.PhotoFile) []IndexResourceStatus {
+	uploaded := make(map[string]*models.PhotoFile, len(files))
+	for i := range files {
+		uploaded[files[i].Role+"/"+files[i].Extension] = &files[i]
+	}
+
+	statuses := make([]IndexResourceStatus, 0, len(declared)+len(files))
+	listed := make(map[string]bool, len(declared)+len(files))
+	add := func(role, ext string) {
+		key := role + "/" + ext
+		if listed[key] {
+			return
+		}
+		listed[key] = true
+		status := IndexResourceStatus{Role: role, Extension: ext}
+		if file, ok := uploaded[key]; ok {
+			status.Uploaded = true
+			status.Version = file.Version
+			status.SHA256 = file.SHA256
+		}
+		statuses = append(statuses, status)
+	}
+	for _, resource := range declared {
+		ext := strings.ToLower(resource.FileType)
+		add(resourceRole(photo, resource.Role, ext), ext)
+	}
+	for _, file := range files {
+		add(file.Role, file.Extension)
+	}
+	return statuses
+}
+
+// validateIndexRequest checks a photo to index before any record is touched
+func validateIndexRequest(photo PhotoIndexRequest) error {
+	if err := ValidateLocalID(photo.LocalID); err != nil {
+		return err
+	}
+	for _, resource := range photo.Resources {
+		if err := ValidateResourceRole(resource.Role); err != nil {
+			return err
+		}
+		if err := validateExtensionSyntax(strings.ToLower(resource.FileType)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // IndexPhotos indexes a batch of photos and assigns filenames
 func (s *PhotoService) IndexPhotos(userID uint, dateStr string, photos []PhotoIndexRequest) ([]PhotoIndexResponse, error) {
+	for _, photo := range photos {
+		if err := validateIndexRequest(photo); err != nil {
+			return nil, err
+		}
+	}
+
 	// Parse date
 	date, err := s.naming.ParseDate(dateStr)
 	if err != nil {
@@ -61,12 +155,6 @@ func (s *PhotoService) IndexPhotos(userID uint, dateStr string, photos []PhotoIn
 	// This is a placeholder - actual implementation would scan directory
 	// and check against database
 
-	// Get existing photo count for this date
-	existingCount, err := s.photoRepo.GetCountByDate(dateStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get existing photo count: %w", err)
-	}
-
 	// Sort photos by creation time
 	sortedPhotos := make([]PhotoIndexRequest, len(photos))
 	copy(sortedPhotos, photos)
@@ -74,193 +162,810 @@ func (s *PhotoService) IndexPhotos(userID uint, dateStr string, photos []PhotoIn
 		return sortedPhotos[i].CreationTime.Before(sortedPhotos[j].CreationTime)
 	})
 
-	// Assign filenames
-	var responses []PhotoIndexResponse
-	nextSequence := s.naming.GetNextSequenceNumber(existingCount)
+	entries := make([]indexEntry, len(sortedPhotos))
+	for i, photo := range sortedPhotos {
+		entries[i] = indexEntry{request: photo, dirPath: dirPath}
+	}
+	return s.indexEntries(entries)
+}
 
-	for _, photo := range sortedPhotos {
-		// Check if photo already exists (re-index logic)
-		existingPhoto, err := s.photoRepo.FindByLocalID(photo.LocalID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to check existing photo: %w", err)
+// indexEntry is a photo to index together with the directory it is stored in
+type indexEntry struct {
+	request PhotoIndexRequest
+	dirPath string
+}
+
+// indexEntries indexes validated photos and returns their responses in the same order
+// New photos are created in one transaction and named in creation time order within their directory;
+// a local_id listed twice is created once
+func (s *PhotoService) indexEntries(entries []indexEntry) ([]PhotoIndexResponse, error) {
+	responses := make([]PhotoIndexResponse, len(entries))
+	records := make([]*models.Photo, len(entries))
+	created := make(map[string]*models.Photo)
+	var newPhotos []*models.Photo
+
+	// Look up the existing records and uploaded files of all entries at once
+	localIDs := make([]string, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !seen[entry.request.LocalID] {
+			seen[entry.request.LocalID] = true
+			localIDs = append(localIDs, entry.request.LocalID)
 		}
+	}
+	uploadedExtensions, err := s.photoRepo.GetUploadedExtensionsByLocalIDs(localIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get uploaded extensions: %w", err)
+	}
+	uploadedFiles, err := s.photoRepo.GetFilesByLocalIDs(localIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get uploaded files: %w", err)
+	}
+	existingPhotos, err := s.photoRepo.FindByLocalIDs(localIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check existing photos: %w", err)
+	}
+	existing := make(map[string]*models.Photo, len(existingPhotos))
+	var returned []string
+	for i := range existingPhotos {
+		existing[existingPhotos[i].LocalID] = &existingPhotos[i]
+		// Indexing again means the photo is back in (or never left) the device library
+		if existingPhotos[i].DeviceDeletedAt != nil {
+			returned = append(returned, existingPhotos[i].LocalID)
+		}
+	}
+	if err := s.photoRepo.ClearDeviceDeleted(returned); err != nil {
+		return nil, err
+	}
 
-		// Get uploaded extensions for this photo
-		uploadedExtensions, err := s.photoRepo.GetUploadedExtensions(photo.LocalID)
+	// A photo deleted on the server stays deleted until it is restored from the trash
+	trashed := make(map[string]*models.Photo)
+	if len(existing) < len(localIDs) {
+		trashedPhotos, err := s.photoRepo.FindDeletedByLocalIDs(localIDs)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get uploaded extensions: %w", err)
+			return nil, fmt.Errorf("failed to check trashed photos: %w", err)
+		}
+		for i := range trashedPhotos {
+			trashed[trashedPhotos[i].LocalID] = &trashedPhotos[i]
 		}
+	}
 
-		if existingPhoto != nil {
-			// Photo already exists, return existing photo info
-			responses = append(responses, PhotoIndexResponse{
-				LocalID:            photo.LocalID,
-				UploadedExtensions: uploadedExtensions,
-			})
-			continue
+	for i, entry := range entries {
+		photo := entry.request
+		responses[i].LocalID = photo.LocalID
+		responses[i].UploadedExtensions = uploadedExtensions[photo.LocalID]
+		if responses[i].UploadedExtensions == nil {
+			responses[i].UploadedExtensions = make([]string, 0)
 		}
 
-		// Generate filename (without extension)
-		filename := s.naming.GenerateFilename(nextSequence)
-		nextSequence++
-
-		// Create photo record
-		photoRecord := &models.Photo{
-			LocalID:       photo.LocalID,
-			CreationTime:  photo.CreationTime,
-			FilePath:      dirPath,
-			FileName:      filename,
-			FileType:      photo.FileType,
-			FileCount:     0,
+		if record, ok := created[photo.LocalID]; ok {
+			records[i] = record
+			continue
+		}
+		if record, ok := existing[photo.LocalID]; ok {
+			records[i] = record
+			continue
+		}
+		if record, ok := trashed[photo.LocalID]; ok {
+			records[i] = record
+			responses[i].Trashed = true
+			continue
 		}
 
-		// Save to database
-		if err := s.photoRepo.Create(photoRecord); err != nil {
-			return nil, fmt.Errorf("failed to create photo record: %w", err)
+		// New photo; its filename is assigned when the record is created
+		record := &models.Photo{
+			LocalID:      photo.LocalID,
+			CreationTime: photo.CreationTime,
+			FilePath:     entry.dirPath,
+			FileType:     photo.FileType,
+			FileCount:    0,
 		}
+		records[i] = record
+		created[photo.LocalID] = record
+		newPhotos = append(newPhotos, record)
+	}
 
-		// Response with uploaded extensions (empty for new photos)
-		responses = append(responses, PhotoIndexResponse{
-			LocalID:            photo.LocalID,
-			UploadedExtensions: uploadedExtensions,
-		})
+	// Name new photos in the order they were taken
+	sort.SliceStable(newPhotos, func(i, j int) bool {
+		return newPhotos[i].CreationTime.Before(newPhotos[j].CreationTime)
+	})
+	if err := s.photoRepo.CreateNamed(newPhotos); err != nil {
+		return nil, fmt.Errorf("failed to create photo records: %w", err)
+	}
+	for _, record := range newPhotos {
+		s.publish(Event{Type: EventPhotoIndexed, LocalID: record.LocalID, FileName: record.FileName})
 	}
 
+	for i, entry := range entries {
+		responses[i].Resources = indexResourceStatuses(records[i], entry.request.Resources, uploadedFiles[entry.request.LocalID])
+	}
 	return responses, nil
 }
 
-// UploadPhoto uploads a photo file
-func (s *PhotoService) UploadPhoto(userID uint, localID, fileExtension, fileType string, fileData []byte) error {
-	// Find photo record
+// FindPhoto returns the indexed photo with the given local_id
+func (s *PhotoService) FindPhoto(localID string) (*models.Photo, error) {
 	photo, err := s.photoRepo.FindByLocalID(localID)
 	if err != nil {
-		return fmt.Errorf("failed to find photo: %w", err)
+		return nil, fmt.Errorf("failed to find photo: %w", err)
 	}
 	if photo == nil {
-		return fmt.Errorf("photo not found")
+		return nil, ErrPhotoNotFound
 	}
+	return photo, nil
+}
 
-	// Build full file path with extension
-	fullPath := photo.FilePath + photo.FileName + "." + fileExtension
+// photoFilePath builds the stored file path for one resource of a photo
+func (s *PhotoService) photoFilePath(photo *models.Photo, role, fileExtension string) string {
+	return photo.FilePath + s.naming.ResourceFileName(photo.FileName, role) + "." + fileExtension
+}
 
-	// Save file (always overwrites if exists)
-	if err := s.fileStorage.SaveFile(fullPath, fileData); err != nil {
-		return fmt.Errorf("failed to save file: %w", err)
+// resolvePhotoPath builds the stored file path for one resource of a photo,
+// verifying that the extension is well formed and the path stays inside the user's directory
+func (s *PhotoService) resolvePhotoPath(photo *models.Photo, role, fileExtension string) (string, error) {
+	if err := validateExtensionSyntax(fileExtension); err != nil {
+		return "", err
 	}
+	fullPath := s.photoFilePath(photo, role, fileExtension)
+	if err := s.fileStorage.CheckUnderUserPhotoDir(s.photoRepo.UserID(), fullPath); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
 
-	// Set file timestamps using photo's creation time
-	if err := s.fileStorage.SetFileTimes(fullPath, photo.CreationTime, photo.CreationTime); err != nil {
-		return fmt.Errorf("failed to set file times: %w", err)
+// validateUpload checks the client-supplied parameters of an upload
+func (s *PhotoService) validateUpload(req UploadRequest) error {
+	if err := ValidateLocalID(req.LocalID); err != nil {
+		return err
 	}
+	if err := ValidateResourceRole(req.Role); err != nil {
+		return err
+	}
+	return s.fileStorage.ValidateExtension(req.FileExtension)
+}
 
-	// Add extension to tracking list
-	if err := s.photoRepo.AddUploadedExtension(localID, fileExtension); err != nil {
-		return fmt.Errorf("failed to update extension list: %w", err)
+// prepareUpload validates an upload and resolves the photo, role and path it is stored under
+func (s *PhotoService) prepareUpload(req UploadRequest) (*models.Photo, UploadRequest, string, error) {
+	if err := s.validateUpload(req); err != nil {
+		return nil, req, "", err
 	}
 
-	// Update file count
-	if err := s.photoRepo.UpdateFileCount(localID, 1); err != nil {
-		return fmt.Errorf("failed to update file count: %w", err)
+	// Find photo record
+	photo, err := s.FindPhoto(req.LocalID)
+	if err != nil {
+		return nil, req, "", err
 	}
+	req.Role = resourceRole(photo, req.Role, req.FileExtension)
 
-	return nil
+	// Build full file path with role and extension
+	fullPath, err := s.resolvePhotoPath(photo, req.Role, req.FileExtension)
+	if err != nil {
+		return nil, req, "", err
+	}
+	if err := s.checkResourceConflict(photo, req.Role, req.FileExtension); err != nil {
+		return nil, req, "", err
+	}
+	return photo, req, fullPath, nil
 }
 
-// UploadPhotoStream uploads a photo file using streaming (no memory buffering)
-func (s *PhotoService) UploadPhotoStream(userID uint, localID, fileExtension, fileType string, reader io.Reader) error {
-	// Find photo record
+// lockUpload takes the lock that serializes writes to an upload's path and checks, under it,
+// that the photo is still live: TrashPhoto may have hidden it while the request was waiting
+func (s *PhotoService) lockUpload(localID, fullPath string) (func(), error) {
+	unlock := s.fileStorage.LockPath(fullPath)
 	photo, err := s.photoRepo.FindByLocalID(localID)
 	if err != nil {
-		return fmt.Errorf("failed to find photo: %w", err)
+		unlock()
+		return nil, err
 	}
 	if photo == nil {
-		return fmt.Errorf("photo not found")
+		unlock()
+		return nil, ErrPhotoNotFound
 	}
+	return unlock, nil
+}
 
-	// Build full file path with extension
-	fullPath := photo.FilePath + photo.FileName + "." + fileExtension
+// uploadWriteOptions returns the verification applied when storing an upload
+func (s *PhotoService) uploadWriteOptions(req UploadRequest) WriteOptions {
+	return WriteOptions{
+		ExpectedSHA256:        req.ExpectedSHA256,
+		Extension:             req.FileExtension,
+		RejectContentMismatch: s.fileStorage.RejectsContentMismatch(),
+	}
+}
 
-	// Save file using streaming (always overwrites if exists)
-	if err := s.fileStorage.SaveFileStream(fullPath, reader); err != nil {
-		return fmt.Errorf("failed to save file: %w", err)
+// refreshThumbnails regenerates previews in the background after a decodable original is stored
+// Previews show the edited render if there is one, so a new primary image leaves them alone then
+func (s *PhotoService) refreshThumbnails(photo *models.Photo, role, fileExtension, fullPath string) {
+	if s.thumbnails == nil || !s.thumbnails.CanGenerate(fileExtension) {
+		return
+	}
+	if role != RoleFullSizeRender && (role != RolePhoto || s.hasPreviewSource(photo, RoleFullSizeRender)) {
+		return
 	}
+	s.thumbnails.GenerateAsync(fullPath, photo.FilePath, photo.FileName)
+}
+
+// UploadRequest describes a file being uploaded for an indexed photo
+type UploadRequest struct {
+	LocalID        string
+	Role           string // Resource role; empty to infer it from the extension
+	FileExtension  string // Lowercase extension the file is stored under (e.g., "heic")
+	FileType       string // File type as sent by the client
+	ExpectedSHA256 string // Optional hex digest the content must match
+	Device         string // Optional name of the uploading device
+}
 
+// UploadResult describes a stored upload
+type UploadResult struct {
+	*WriteResult
+	Role     string // Role the file was stored under
+	FileName string // Stored name without extension, e.g. IMG_E0001
+	FilePath string // Full path of the stored file
+	Version  int    // Version number of the stored content
+}
+
+// finishUpload records a file that has been written to its final path
+// current is the record of the file it replaced, if any
+func (s *PhotoService) finishUpload(photo *models.Photo, req UploadRequest, fullPath string, current *models.PhotoFile, result *WriteResult) (*UploadResult, error) {
 	// Set file timestamps using photo's creation time
 	if err := s.fileStorage.SetFileTimes(fullPath, photo.CreationTime, photo.CreationTime); err != nil {
-		return fmt.Errorf("failed to set file times: %w", err)
+		return nil, fmt.Errorf("failed to set file times: %w", err)
 	}
 
-	// Add extension to tracking list
-	if err := s.photoRepo.AddUploadedExtension(localID, fileExtension); err != nil {
-		return fmt.Errorf("failed to update extension list: %w", err)
+	// Keep the replaced content as a version if it changed
+	version, err := s.nextVersion(photo, current, result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record previous version: %w", err)
 	}
 
+	// Record the file with its size, hash and detected content type
+	if err := s.photoRepo.AddUploadedFile(&models.PhotoFile{
+		LocalID:         photo.LocalID,
+		Role:            req.Role,
+		Extension:       req.FileExtension,
+		Size:            result.Size,
+		SHA256:          result.SHA256,
+		MimeType:        result.MimeType,
+		ContentMismatch: result.ContentMismatch,
+		Device:          req.Device,
+		Version:         version,
+		UploadedAt:      time.Now(),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update extension list: %w", err)
+	}
+
+	// Record embedded camera, location and capture time metadata. The file is already stored, so
+	// a failure must not fail the upload; a missing record is extracted again on first request
+	_, _ = s.recordMetadata(photo, req.Role, req.FileExtension, fullPath)
+
 	// Update file count
-	if err := s.photoRepo.UpdateFileCount(localID, 1); err != nil {
-		return fmt.Errorf("failed to update file count: %w", err)
+	if err := s.photoRepo.UpdateFileCount(photo.LocalID, 1); err != nil {
+		return nil, fmt.Errorf("failed to update file count: %w", err)
 	}
 
-	return nil
+	s.refreshThumbnails(photo, req.Role, req.FileExtension, fullPath)
+
+	fileName := s.naming.ResourceFileName(photo.FileName, req.Role)
+	s.publish(Event{
+		Type:      EventUploadCompleted,
+		LocalID:   photo.LocalID,
+		FileName:  fileName,
+		Role:      req.Role,
+		Extension: req.FileExtension,
+		Size:      result.Size,
+		SHA256:    result.SHA256,
+		Version:   version,
+	})
+
+	return &UploadResult{
+		WriteResult: result,
+		Role:        req.Role,
+		FileName:    fileName,
+		FilePath:    fullPath,
+		Version:     version,
+	}, nil
 }
 
-// UploadPhotoChunk uploads a chunk of a photo file
-func (s *PhotoService) UploadPhotoChunk(userID uint, localID, fileExtension string, chunkNumber, totalChunks int, chunkData []byte) (bool, error) {
-	// Find photo record
-	photo, err := s.photoRepo.FindByLocalID(localID)
+// UploadPhoto uploads a photo file
+// If req.ExpectedSHA256 is set, content that does not match it is rejected
+// with a *ChecksumMismatchError and any existing file is kept
+func (s *PhotoService) UploadPhoto(userID uint, req UploadRequest, fileData []byte) (*UploadResult, error) {
+	photo, req, fullPath, err := s.prepareUpload(req)
 	if err != nil {
-		return false, fmt.Errorf("failed to find photo: %w", err)
+		return nil, err
 	}
-	if photo == nil {
-		return false, fmt.Errorf("photo not found")
+
+	// Uploads of the same file are serialized so that versions are numbered consistently
+	unlock, err := s.lockUpload(photo.LocalID, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	opts, current, err := s.versionedWriteOptions(photo, req)
+	if err != nil {
+		return nil, err
 	}
 
-	// Build full file path with extension
-	fullPath := photo.FilePath + photo.FileName + "." + fileExtension
+	// Save file (replaces an existing file once the content is verified)
+	result, err := s.fileStorage.SaveFile(fullPath, fileData, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save file: %w", err)
+	}
 
-	// Save the chunk
-	if err := s.fileStorage.SaveChunk(fullPath, chunkNumber, chunkData); err != nil {
-		return false, fmt.Errorf("failed to save chunk: %w", err)
+	return s.finishUpload(photo, req, fullPath, current, result)
+}
+
+// UploadPhotoStream uploads a photo file using streaming (no memory buffering)
+// req.ExpectedSHA256 is handled as in UploadPhoto
+func (s *PhotoService) UploadPhotoStream(userID uint, req UploadRequest, reader io.Reader) (*UploadResult, error) {
+	photo, req, fullPath, err := s.prepareUpload(req)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check if this is the last chunk
-	isComplete := chunkNumber == totalChunks-1
-	if isComplete {
-		// Verify all chunks are uploaded
-		uploadedChunks, err := s.fileStorage.GetUploadedChunks(fullPath)
-		if err != nil {
-			return false, fmt.Errorf("failed to verify chunks: %w", err)
+	// Uploads of the same file are serialized so that versions are numbered consistently
+	unlock, err := s.lockUpload(photo.LocalID, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	opts, current, err := s.versionedWriteOptions(photo, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save file using streaming (replaces an existing file once the content is verified)
+	result, err := s.fileStorage.SaveFileStream(fullPath, reader, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save file: %w", err)
+	}
+
+	return s.finishUpload(photo, req, fullPath, current, result)
+}
+
+// ChunkUploadStatus reports the progress of a chunked upload session
+type ChunkUploadStatus struct {
+	TotalChunks    int
+	TotalSize      int64 // 0 if not declared
+	ReceivedChunks []int
+	MissingChunks  []int // The first maxListedMissingChunks missing chunk numbers
+	MissingCount   int   // Number of missing chunks, including those not listed
+	ReceivedSize   int64
+}
+
+// maxListedMissingChunks bounds the missing chunk numbers a status lists
+const maxListedMissingChunks = 1000
+
+// openChunkSession returns the session of a chunked upload, starting one if needed
+// Every chunk must declare the same total_chunks and, once known, total size and hash
+func (s *PhotoService) openChunkSession(fullPath string, totalChunks int, totalSize int64, expectedSHA256 string) (*ChunkSession, error) {
+	if totalChunks < 1 || totalChunks > MaxUploadChunks {
+		return nil, fmt.Errorf("%w: %d, maximum %d", ErrInvalidChunkCount, totalChunks, MaxUploadChunks)
+	}
+
+	unlock := s.fileStorage.LockPath(fullPath)
+	defer unlock()
+
+	session, err := s.fileStorage.LoadChunkSession(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	if session == nil {
+		session = &ChunkSession{TotalChunks: totalChunks, CreatedAt: time.Now()}
+		changed = true
+	} else if session.TotalChunks != totalChunks {
+		return nil, fmt.Errorf("%w: total_chunks %d, session has %d", ErrChunkSessionConflict, totalChunks, session.TotalChunks)
+	}
+
+	if totalSize > 0 && session.TotalSize != totalSize {
+		if session.TotalSize != 0 {
+			return nil, fmt.Errorf("%w: total_size %d, session has %d", ErrChunkSessionConflict, totalSize, session.TotalSize)
 		}
+		session.TotalSize = totalSize
+		changed = true
+	}
+	if expectedSHA256 != "" && !strings.EqualFold(session.ExpectedSHA256, expectedSHA256) {
+		if session.ExpectedSHA256 != "" {
+			return nil, fmt.Errorf("%w: sha256 differs from session", ErrChunkSessionConflict)
+		}
+		session.ExpectedSHA256 = strings.ToLower(expectedSHA256)
+		changed = true
+	}
 
-		if len(uploadedChunks) != totalChunks {
-			return false, fmt.Errorf("incomplete chunks: got %d, expected %d", len(uploadedChunks), totalChunks)
+	if changed {
+		if err := s.fileStorage.SaveChunkSession(fullPath, session); err != nil {
+			return nil, err
 		}
+	}
+	return session, nil
+}
+
+// UploadPhotoChunk uploads a chunk of a photo file
+// Chunks may arrive in any order and in parallel; the request that delivers the
+// last missing chunk merges them. totalSize (0 if unknown) and req.ExpectedSHA256
+// may be sent with any chunk and are recorded in the session; the merged file is
+// verified against them and on mismatch all chunks are discarded so the client
+// can restart the upload
+func (s *PhotoService) UploadPhotoChunk(userID uint, req UploadRequest, chunkNumber, totalChunks int, totalSize int64, chunkData []byte) (bool, *UploadResult, error) {
+	photo, req, fullPath, err := s.prepareUpload(req)
+	if err != nil {
+		return false, nil, err
+	}
 
-		// Merge all chunks into final file
-		if err := s.fileStorage.MergeChunks(fullPath, totalChunks); err != nil {
-			return false, fmt.Errorf("failed to merge chunks: %w", err)
+	if _, err := s.openChunkSession(fullPath, totalChunks, totalSize, req.ExpectedSHA256); err != nil {
+		return false, nil, err
+	}
+
+	// Save the chunk; chunks of one session are written in parallel
+	if err := s.fileStorage.SaveChunk(fullPath, chunkNumber, chunkData); err != nil {
+		return false, nil, fmt.Errorf("failed to save chunk: %w", err)
+	}
+
+	// Completion is checked and merged by one request at a time
+	unlock, err := s.lockUpload(photo.LocalID, fullPath)
+	if err != nil {
+		return false, nil, err
+	}
+	defer unlock()
+
+	// Reload the session: another request may have added the hash or merged already
+	session, err := s.fileStorage.LoadChunkSession(fullPath)
+	if err != nil {
+		return false, nil, err
+	}
+	if session == nil {
+		return false, nil, nil
+	}
+
+	uploadedChunks, err := s.fileStorage.GetUploadedChunks(fullPath)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to verify chunks: %w", err)
+	}
+	// Chunk numbers are below TotalChunks, so all chunks are there once there are as many as declared
+	if len(uploadedChunks) < session.TotalChunks {
+		return false, nil, nil
+	}
+
+	// Merge all chunks into final file
+	opts, current, err := s.versionedWriteOptions(photo, req)
+	if err != nil {
+		return false, nil, err
+	}
+	opts.ExpectedSHA256 = session.ExpectedSHA256
+	opts.ExpectedSize = session.TotalSize
+	result, err := s.fileStorage.MergeChunks(fullPath, session.TotalChunks, opts)
+	if err != nil {
+		var mismatch *ChecksumMismatchError
+		var sizeMismatch *SizeMismatchError
+		var contentMismatch *ContentTypeMismatchError
+		if errors.As(err, &mismatch) || errors.As(err, &sizeMismatch) || errors.As(err, &contentMismatch) {
+			_ = s.fileStorage.CleanupChunks(fullPath)
 		}
+		return false, nil, fmt.Errorf("failed to merge chunks: %w", err)
+	}
+
+	// Cleanup chunk files; chunks are already merged, so a failure here
+	// only leaves stale chunks behind and must not fail the upload
+	_ = s.fileStorage.CleanupChunks(fullPath)
+	s.publish(Event{
+		Type:      EventChunkMerged,
+		LocalID:   photo.LocalID,
+		FileName:  s.naming.ResourceFileName(photo.FileName, req.Role),
+		Role:      req.Role,
+		Extension: req.FileExtension,
+		Size:      result.Size,
+		Chunks:    session.TotalChunks,
+	})
+
+	uploaded, err := s.finishUpload(photo, req, fullPath, current, result)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, uploaded, nil
+}
 
-		// Cleanup chunk files
-		if err := s.fileStorage.CleanupChunks(fullPath); err != nil {
-			// Log but don't fail - chunks are already merged
-			s.storageDir = s.storageDir // placeholder to avoid unused warning
+// GetChunkUploadStatus reports which chunks of a chunked upload have been received
+// An empty role selects the role the upload would be stored under by default
+func (s *PhotoService) GetChunkUploadStatus(localID, role, fileExtension string) (*ChunkUploadStatus, error) {
+	if err := ValidateResourceRole(role); err != nil {
+		return nil, err
+	}
+	photo, err := s.FindPhoto(localID)
+	if err != nil {
+		return nil, err
+	}
+	fullPath, err := s.resolvePhotoPath(photo, resourceRole(photo, role, fileExtension), fileExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.fileStorage.LoadChunkSession(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrChunkSessionNotFound
+	}
+
+	sizes, err := s.fileStorage.GetUploadedChunkSizes(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ChunkUploadStatus{
+		TotalChunks:    session.TotalChunks,
+		TotalSize:      session.TotalSize,
+		ReceivedChunks: make([]int, 0, len(sizes)),
+	}
+	for chunkNum, size := range sizes {
+		status.ReceivedChunks = append(status.ReceivedChunks, chunkNum)
+		status.ReceivedSize += size
+	}
+	sort.Ints(status.ReceivedChunks)
+	status.MissingChunks = missingChunks(status.ReceivedChunks, session.TotalChunks, maxListedMissingChunks)
+	status.MissingCount = max(session.TotalChunks-len(status.ReceivedChunks), 0)
+	return status, nil
+}
+
+// missingChunks returns up to limit chunk numbers below totalChunks not present in the sorted received list
+func missingChunks(received []int, totalChunks, limit int) []int {
+	missing := make([]int, 0)
+	next := 0
+	for i := 0; i < totalChunks && len(missing) < limit; i++ {
+		for next < len(received) && received[next] < i {
+			next++
 		}
+		if next < len(received) && received[next] == i {
+			continue
+		}
+		missing = append(missing, i)
+	}
+	return missing
+}
+
+// PhotoListRequest represents a photo listing request
+type PhotoListRequest struct {
+	From       *time.Time // Inclusive start date (YYYY-MM-DD)
+	To         *time.Time // Inclusive end date (YYYY-MM-DD)
+	FileType   string
+	Descending bool
+	Cursor     *ListCursor
+	Limit      int
+}
+
+// PhotoListItem represents a single photo in a listing response
+type PhotoListItem struct {
+	LocalID            string    `json:"local_id"`
+	CreationTime       time.Time `json:"creation_time"`
+	FileName           string    `json:"file_name"`
+	FileType           string    `json:"file_type"`
+	UploadedExtensions []string  `json:"uploaded_extensions"`
+}
 
-		// Set file timestamps using photo's creation time
-		if err := s.fileStorage.SetFileTimes(fullPath, photo.CreationTime, photo.CreationTime); err != nil {
-			return false, fmt.Errorf("failed to set file times: %w", err)
+// PhotoListResponse represents a page of photos
+type PhotoListResponse struct {
+	Photos     []PhotoListItem `json:"photos"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+	HasMore    bool            `json:"has_more"`
+}
+
+// ListCursor identifies the last photo returned in a previous page
+type ListCursor struct {
+	CreationTime time.Time
+	LocalID      string
+}
+
+// EncodeListCursor encodes a cursor into an opaque string for clients
+func EncodeListCursor(cursor ListCursor) string {
+	raw := cursor.CreationTime.Format(time.RFC3339Nano) + "|" + cursor.LocalID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeListCursor decodes an opaque cursor string produced by EncodeListCursor
+func DecodeListCursor(value string) (*ListCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor encoding")
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor format")
+	}
+
+	creationTime, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor time")
+	}
+
+	return &ListCursor{CreationTime: creationTime, LocalID: parts[1]}, nil
+}
+
+// ListPhotos returns a page of the user's photos ordered by creation time
+func (s *PhotoService) ListPhotos(userID uint, req PhotoListRequest) (*PhotoListResponse, error) {
+	opts := repository.PhotoListOptions{
+		FileType:   req.FileType,
+		Descending: req.Descending,
+		// Fetch one extra record to find out whether another page exists
+		Limit: req.Limit + 1,
+	}
+
+	// Dates map onto the storage directory layout, same as the index API
+	if req.From != nil {
+		opts.FromPath = s.naming.GetDirectoryPath(s.storageDir, userID, *req.From)
+	}
+	if req.To != nil {
+		opts.ToPath = s.naming.GetDirectoryPath(s.storageDir, userID, req.To.AddDate(0, 0, 1))
+	}
+	if req.Cursor != nil {
+		opts.AfterTime = &req.Cursor.CreationTime
+		opts.AfterID = req.Cursor.LocalID
+	}
+
+	photos, err := s.photoRepo.List(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list photos: %w", err)
+	}
+
+	resp := &PhotoListResponse{Photos: make([]PhotoListItem, 0, len(photos))}
+	if len(photos) > req.Limit {
+		photos = photos[:req.Limit]
+		resp.HasMore = true
+	}
+
+	localIDs := make([]string, 0, len(photos))
+	for _, photo := range photos {
+		localIDs = append(localIDs, photo.LocalID)
+	}
+	extensionsByID, err := s.photoRepo.GetUploadedExtensionsByLocalIDs(localIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, photo := range photos {
+		extensions, ok := extensionsByID[photo.LocalID]
+		if !ok {
+			extensions = make([]string, 0)
+		}
+		resp.Photos = append(resp.Photos, PhotoListItem{
+			LocalID:            photo.LocalID,
+			CreationTime:       photo.CreationTime,
+			FileName:           photo.FileName,
+			FileType:           photo.FileType,
+			UploadedExtensions: extensions,
+		})
+	}
+
+	if resp.HasMore {
+		last := photos[len(photos)-1]
+		resp.NextCursor = EncodeListCursor(ListCursor{CreationTime: last.CreationTime, LocalID: last.LocalID})
+	}
+
+	return resp, nil
+}
+
+// PhotoFile is an opened stored file ready to be served to a client
+type PhotoFile struct {
+	File     *os.File
+	Info     os.FileInfo
+	FileName string // Name with extension, e.g. IMG_0001.heic
+}
+
+// OpenPhotoFile opens the stored file for one uploaded resource of a photo
+// An empty role selects the role the extension is stored under by default
+// The caller must close the returned file
+func (s *PhotoService) OpenPhotoFile(localID, role, fileExtension string) (*PhotoFile, error) {
+	if err := ValidateResourceRole(role); err != nil {
+		return nil, err
+	}
+	photo, err := s.photoRepo.FindByLocalID(localID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find photo: %w", err)
+	}
+	if photo == nil {
+		return nil, ErrPhotoNotFound
+	}
+	role = resourceRole(photo, role, fileExtension)
+
+	// Only serve resources that were actually uploaded for this photo
+	uploaded, err := s.findFile(photo, role, fileExtension)
+	if err != nil {
+		return nil, err
+	}
+	if uploaded == nil {
+		return nil, ErrFileNotFound
+	}
+
+	fullPath, err := s.resolvePhotoPath(photo, role, fileExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	file, info, err := s.fileStorage.OpenFile(fullPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileNotFound
 		}
+		return nil, err
+	}
+
+	return &PhotoFile{
+		File:     file,
+		Info:     info,
+		FileName: s.naming.ResourceFileName(photo.FileName, role) + "." + fileExtension,
+	}, nil
+}
+
+// Thumbnail is a cached preview of a photo
+type Thumbnail struct {
+	Path         string
+	Info         os.FileInfo
+	SourceSHA256 string // Hash of the file previews are generated from; empty for files stored before hashing
+}
+
+// GetThumbnail returns a cached preview, generating it from an
+// uploaded decodable image (JPEG/PNG/GIF) if it does not exist yet
+// The full size render of an edit is preferred over the primary image
+func (s *PhotoService) GetThumbnail(localID string, size ThumbnailSize) (*Thumbnail, error) {
+	photo, err := s.photoRepo.FindByLocalID(localID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find photo: %w", err)
+	}
+	if photo == nil {
+		return nil, ErrPhotoNotFound
+	}
 
-		// Add extension to tracking list
-		if err := s.photoRepo.AddUploadedExtension(localID, fileExtension); err != nil {
-			return false, fmt.Errorf("failed to update extension list: %w", err)
+	thumbPath, err := s.thumbnails.ThumbnailPath(photo.FilePath, photo.FileName, size)
+	if err != nil {
+		return nil, err
+	}
+	source, err := s.previewSource(photo)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, ErrThumbnailUnavailable
+	}
+
+	exists, err := s.fileStorage.FileExists(thumbPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := s.thumbnails.Generate(s.photoFilePath(photo, source.Role, source.Extension), photo.FilePath, photo.FileName); err != nil {
+			return nil, fmt.Errorf("failed to generate thumbnail: %w", err)
 		}
+	}
 
-		// Update file count
-		if err := s.photoRepo.UpdateFileCount(localID, 1); err != nil {
-			return false, fmt.Errorf("failed to update file count: %w", err)
+	info, err := os.Stat(thumbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat thumbnail: %w", err)
+	}
+	return &Thumbnail{Path: thumbPath, Info: info, SourceSHA256: source.SHA256}, nil
+}
+
+// previewRoles lists the roles previews are generated from, most preferred first
+var previewRoles = []string{RoleFullSizeRender, RolePhoto, RoleOriginal}
+
+// previewSource returns the uploaded file previews are generated from, or nil if none can be decoded
+func (s *PhotoService) previewSource(photo *models.Photo) (*models.PhotoFile, error) {
+	files, err := s.photoRepo.GetFiles(photo.LocalID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range previewRoles {
+		for i := range files {
+			if files[i].Role == role && s.thumbnails.CanGenerate(files[i].Extension) {
+				return &files[i], nil
+			}
 		}
 	}
+	return nil, nil
+}
 
-	return isComplete, nil
+// hasPreviewSource reports whether previews are currently generated from a file with the given role
+func (s *PhotoService) hasPreviewSource(photo *models.Photo, role string) bool {
+	source, err := s.previewSource(photo)
+	return err == nil && source != nil && source.Role == role
 }
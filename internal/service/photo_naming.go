@@ -16,13 +16,23 @@ func NewPhotoNaming() *PhotoNaming {
 }
 
 // GenerateFilename generates a sequential filename for a photo
-// Format: IMG_XXXX where XXXX is a 4-digit zero-padded number (without extension)
+// Format: IMG_XXXX where XXXX is a 4-digit zero-padded number (without extension);
+// numbers past 9999 get more digits
 func (n *PhotoNaming) GenerateFilename(sequenceNumber int) string {
-	// Format: IMG_XXXX (4-digit zero-padded, no extension)
-	sequence := strconv.Itoa(sequenceNumber)
-	paddedSequence := strings.Repeat("0", 4-len(sequence)) + sequence
+	return fmt.Sprintf("IMG_%04d", sequenceNumber)
+}
 
-	return fmt.Sprintf("IMG_%s", paddedSequence)
+// ParseSequence returns the sequence number of a filename generated by GenerateFilename
+func (n *PhotoNaming) ParseSequence(fileName string) (int, bool) {
+	sequence, ok := strings.CutPrefix(fileName, "IMG_")
+	if !ok {
+		return 0, false
+	}
+	number, err := strconv.Atoi(sequence)
+	if err != nil || number < 1 {
+		return 0, false
+	}
+	return number, true
 }
 
 // ParseDate parses a date string in YYYY-MM-DD format
@@ -45,10 +55,3 @@ func (n *PhotoNaming) GetDirectoryPath(storageDir string, userID uint, date time
 		day,
 	)
 }
-
-// GetNextSequenceNumber calculates the next sequence number for a date
-// This is a placeholder - actual implementation will query the database
-func (n *PhotoNaming) GetNextSequenceNumber(existingCount int) int {
-	// Start from 1, so first photo is IMG_0001
-	return existingCount + 1
-}
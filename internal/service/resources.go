@@ -0,0 +1,177 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// Roles of the resources (files) that make up one asset
+const (
+	RolePhoto          = "photo"            // Primary image, or the video of a plain video asset
+	RolePairedVideo    = "paired_video"     // Motion component of a Live Photo
+	RoleAdjustmentData = "adjustment_data"  // Edit instructions (.aae)
+	RoleFullSizeRender = "full_size_render" // Rendered result of an edit
+	RoleOriginal       = "original"         // Unedited original kept next to an edited photo
+)
+
+// ResourceRoles lists all resource roles in presentation order
+var ResourceRoles = []string{RolePhoto, RolePairedVideo, RoleAdjustmentData, RoleFullSizeRender, RoleOriginal}
+
+// ErrResourceConflict is returned when a file would be stored at the path of a resource with another role
+var ErrResourceConflict = errors.New("another resource of this photo is stored under the same file name")
+
+// videoExtensions lists extensions of video files
+var videoExtensions = map[string]bool{
+	"mov": true,
+	"mp4": true,
+	"m4v": true,
+}
+
+// ValidateResourceRole checks a client-supplied role; an empty role is allowed and means the default
+func ValidateResourceRole(role string) error {
+	if role == "" {
+		return nil
+	}
+	for _, known := range ResourceRoles {
+		if role == known {
+			return nil
+		}
+	}
+	return &ValidationError{Field: "role", Reason: "must be one of " + strings.Join(ResourceRoles, ", ")}
+}
+
+// defaultResourceRole returns the role of a file uploaded without one
+// .aae files are adjustment data, and a video next to an image asset is the motion
+// component of a Live Photo; anything else is the primary resource
+func defaultResourceRole(photo *models.Photo, fileExtension string) string {
+	if fileExtension == "aae" {
+		return RoleAdjustmentData
+	}
+	if videoExtensions[fileExtension] && !isVideoAsset(photo) {
+		return RolePairedVideo
+	}
+	return RolePhoto
+}
+
+// isVideoAsset reports whether a photo was indexed as a video (file_type is an extension or a MIME type)
+func isVideoAsset(photo *models.Photo) bool {
+	fileType := strings.ToLower(photo.FileType)
+	return videoExtensions[fileType] || strings.HasPrefix(fileType, "video/")
+}
+
+// resourceRole returns the role a file is stored under
+func resourceRole(photo *models.Photo, role, fileExtension string) string {
+	if role == "" {
+		return defaultResourceRole(photo, fileExtension)
+	}
+	return role
+}
+
+// ResourceFileName returns the file name (without extension) of a resource
+// Following the iOS convention, renders of edits are stored as IMG_E0001 and
+// originals as IMG_O0001; all other resources share the photo's name
+func (n *PhotoNaming) ResourceFileName(fileName, role string) string {
+	var variant string
+	switch role {
+	case RoleFullSizeRender:
+		variant = "E"
+	case RoleOriginal:
+		variant = "O"
+	default:
+		return fileName
+	}
+	if rest, ok := strings.CutPrefix(fileName, "IMG_"); ok {
+		return "IMG_" + variant + rest
+	}
+	return fileName + "_" + variant
+}
+
+// checkResourceConflict rejects storing a resource at a path already used by a resource with another role
+func (s *PhotoService) checkResourceConflict(photo *models.Photo, role, fileExtension string) error {
+	files, err := s.photoRepo.GetFiles(photo.LocalID)
+	if err != nil {
+		return err
+	}
+	name := s.naming.ResourceFileName(photo.FileName, role)
+	for _, file := range files {
+		if file.Role != role && file.Extension == fileExtension && s.naming.ResourceFileName(photo.FileName, file.Role) == name {
+			return fmt.Errorf("%w: %s.%s is the %s", ErrResourceConflict, name, fileExtension, file.Role)
+		}
+	}
+	return nil
+}
+
+// findFile returns the uploaded file record of a resource, or nil if it was not uploaded
+func (s *PhotoService) findFile(photo *models.Photo, role, fileExtension string) (*models.PhotoFile, error) {
+	files, err := s.photoRepo.GetFiles(photo.LocalID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if files[i].Role == role && files[i].Extension == fileExtension {
+			return &files[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// PhotoResource is one uploaded file of a photo with its role
+type PhotoResource struct {
+	Role       string    `json:"role"`
+	Extension  string    `json:"extension"`
+	FileName   string    `json:"file_name"` // Name with extension, e.g. IMG_E0001.heic
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	MimeType   string    `json:"mime_type"`
+	Version    int       `json:"version"`
+	ChangeSeq  int64     `json:"change_seq"` // Change sequence number of the last upload
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// photoResource describes an uploaded file of a photo
+func (s *PhotoService) photoResource(photo *models.Photo, file *models.PhotoFile) PhotoResource {
+	return PhotoResource{
+		Role:       file.Role,
+		Extension:  file.Extension,
+		FileName:   s.naming.ResourceFileName(photo.FileName, file.Role) + "." + file.Extension,
+		Size:       file.Size,
+		SHA256:     file.SHA256,
+		MimeType:   file.MimeType,
+		Version:    file.Version,
+		ChangeSeq:  file.ChangeSeq,
+		UploadedAt: file.UploadedAt,
+	}
+}
+
+// PhotoResourcesResponse lists the resources of a photo grouped by role
+type PhotoResourcesResponse struct {
+	LocalID   string                     `json:"local_id"`
+	LivePhoto bool                       `json:"live_photo"` // Has both a photo and a paired video
+	Resources map[string][]PhotoResource `json:"resources"`  // Role -> files, only roles with files
+}
+
+// GetResources returns the uploaded files of a photo grouped by role
+func (s *PhotoService) GetResources(localID string) (*PhotoResourcesResponse, error) {
+	photo, err := s.FindPhoto(localID)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.photoRepo.GetFiles(localID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &PhotoResourcesResponse{
+		LocalID:   photo.LocalID,
+		Resources: make(map[string][]PhotoResource),
+	}
+	for i := range files {
+		resp.Resources[files[i].Role] = append(resp.Resources[files[i].Role], s.photoResource(photo, &files[i]))
+	}
+	resp.LivePhoto = len(resp.Resources[RolePhoto]) > 0 && len(resp.Resources[RolePairedVideo]) > 0
+	return resp, nil
+}
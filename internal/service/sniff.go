@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+)
+
+// sniffLen is how many leading bytes of an upload are kept for content detection
+const sniffLen = 512
+
+// Detected content types that have no single extension of their own
+const (
+	mimeHEICSequence = "image/heic-sequence"
+	mimeHEIFSequence = "image/heif-sequence"
+	mimeUnknown      = "application/octet-stream"
+)
+
+// extensionContentTypes lists the detected content types accepted for each extension
+// Extensions missing here are stored without a content check
+var extensionContentTypes = map[string][]string{
+	"jpg":  {"image/jpeg"},
+	"jpeg": {"image/jpeg"},
+	"heic": {"image/heic", "image/heif", mimeHEICSequence, mimeHEIFSequence},
+	"heif": {"image/heic", "image/heif", mimeHEICSequence, mimeHEIFSequence},
+	"png":  {"image/png"},
+	"gif":  {"image/gif"},
+	"webp": {"image/webp"},
+	// DNG is a TIFF variant; it is only told apart when IFD0 lies within the sniffed bytes
+	"dng":  {"image/x-adobe-dng", "image/tiff"},
+	"tif":  {"image/tiff", "image/x-adobe-dng"},
+	"tiff": {"image/tiff", "image/x-adobe-dng"},
+	// QuickTime and MP4 share the ISO base media layout and are used interchangeably by clients
+	"mov": {"video/quicktime", "video/mp4", "video/x-m4v"},
+	"mp4": {"video/quicktime", "video/mp4", "video/x-m4v"},
+	"m4v": {"video/quicktime", "video/mp4", "video/x-m4v"},
+	"aae": {"application/x-plist"},
+}
+
+// ContentTypeMismatchError is returned when content does not match its extension
+// and the server rejects such uploads
+// The destination file is left untouched when this error is returned
+type ContentTypeMismatchError struct {
+	Extension string
+	Detected  string
+}
+
+func (e *ContentTypeMismatchError) Error() string {
+	return fmt.Sprintf("content type mismatch: .%s file contains %s", e.Extension, e.Detected)
+}
+
+// DetectContentType identifies the format of a file from its leading bytes
+// Returns an empty string if the format is not recognized
+func DetectContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "image/gif"
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && string(head[8:12]) == "WEBP":
+		return "image/webp"
+	case bytes.HasPrefix(head, []byte("II*\x00")):
+		return detectTIFF(head, binary.LittleEndian)
+	case bytes.HasPrefix(head, []byte("MM\x00*")):
+		return detectTIFF(head, binary.BigEndian)
+	case bytes.HasPrefix(head, []byte("bplist00")):
+		return "application/x-plist"
+	}
+
+	if len(head) >= 8 {
+		switch string(head[4:8]) {
+		case "ftyp":
+			return detectFtyp(head)
+		case "moov", "mdat", "wide", "free", "skip", "pnot":
+			// QuickTime files written before ftyp existed start with a plain atom
+			return "video/quicktime"
+		}
+	}
+
+	if isXMLPlist(head) {
+		return "application/x-plist"
+	}
+	return ""
+}
+
+// detectTIFF tells DNG apart from plain TIFF by looking for the DNGVersion tag in IFD0
+func detectTIFF(head []byte, order binary.ByteOrder) string {
+	const dngVersionTag = 0xC612
+
+	if len(head) < 8 {
+		return "image/tiff"
+	}
+	ifd := int(order.Uint32(head[4:8]))
+	if ifd < 8 || ifd+2 > len(head) {
+		return "image/tiff"
+	}
+	entries := int(order.Uint16(head[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+2 > len(head) {
+			break
+		}
+		if order.Uint16(head[entry:entry+2]) == dngVersionTag {
+			return "image/x-adobe-dng"
+		}
+	}
+	return "image/tiff"
+}
+
+// detectFtyp maps the brands of an ISO base media ftyp box to a content type
+func detectFtyp(head []byte) string {
+	size := int(binary.BigEndian.Uint32(head[0:4]))
+	if size < 16 || size > len(head) {
+		size = len(head)
+	}
+	if size < 12 {
+		return ""
+	}
+
+	major := string(head[8:12])
+	contentType := ftypBrandContentType(major)
+	if contentType != "" && major != "mif1" && major != "msf1" {
+		return contentType
+	}
+
+	// Generic HEIF and unknown major brands: the compatible brands tell what the file holds
+	for offset := 16; offset+4 <= size; offset += 4 {
+		brand := string(head[offset : offset+4])
+		switch brand {
+		case "heic", "heix":
+			return "image/heic"
+		case "hevc", "hevx":
+			return mimeHEICSequence
+		}
+		if contentType == "" {
+			contentType = ftypBrandContentType(brand)
+		}
+	}
+	return contentType
+}
+
+// ftypBrandContentType maps a single ISO base media brand to a content type
+func ftypBrandContentType(brand string) string {
+	switch brand {
+	case "qt  ":
+		return "video/quicktime"
+	case "heic", "heix", "heim", "heis":
+		return "image/heic"
+	case "hevc", "hevx", "hevm", "hevs":
+		return mimeHEICSequence
+	case "mif1":
+		return "image/heif"
+	case "msf1":
+		return mimeHEIFSequence
+	case "M4V ", "M4VH", "M4VP":
+		return "video/x-m4v"
+	case "isom", "iso2", "iso3", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "dash":
+		return "video/mp4"
+	}
+	return ""
+}
+
+// isXMLPlist reports whether content is an XML property list, as written for .aae sidecars
+func isXMLPlist(head []byte) bool {
+	text := bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	text = bytes.TrimLeft(text, " \t\r\n")
+	if !bytes.HasPrefix(text, []byte("<?xml")) && !bytes.HasPrefix(text, []byte("<!DOCTYPE plist")) && !bytes.HasPrefix(text, []byte("<plist")) {
+		return false
+	}
+	return bytes.Contains(text, []byte("<plist")) || bytes.Contains(text, []byte("<!DOCTYPE plist"))
+}
+
+// ContentMatchesExtension reports whether a detected content type is expected for an extension
+// Extensions without a known content type always match
+func ContentMatchesExtension(fileExtension, detected string) bool {
+	accepted, ok := extensionContentTypes[fileExtension]
+	if !ok {
+		return true
+	}
+	for _, contentType := range accepted {
+		if detected == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// RejectsContentMismatch reports whether uploads whose content contradicts their extension are refused
+func (fs *FileStorage) RejectsContentMismatch() bool {
+	return fs.config.ContentTypePolicy == config.ContentPolicyReject
+}
+
+// sniffContent returns the MIME type to record for content stored under an extension
+// and whether the content contradicts the extension
+func sniffContent(fileExtension string, head []byte) (string, bool) {
+	detected := DetectContentType(head)
+	mismatch := !ContentMatchesExtension(fileExtension, detected)
+	if detected != "" {
+		return detected, mismatch
+	}
+	if _, checked := extensionContentTypes[fileExtension]; checked {
+		// A format that should have been recognized was not
+		return mimeUnknown, mismatch
+	}
+	return MimeTypeForExtension(fileExtension), mismatch
+}
+
+// headWriter keeps the first sniffLen bytes written through it
+type headWriter struct {
+	head []byte
+}
+
+func (hw *headWriter) Write(p []byte) (int, error) {
+	if room := sniffLen - len(hw.head); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		hw.head = append(hw.head, p[:room]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // Register GIF decoder
+	"image/jpeg"
+	_ "image/png" // Register PNG decoder
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+)
+
+// ThumbnailSize identifies a preview size
+type ThumbnailSize string
+
+// Supported thumbnail sizes
+const (
+	ThumbnailSmall  ThumbnailSize = "small"
+	ThumbnailMedium ThumbnailSize = "medium"
+)
+
+// thumbnailMaxDimension is the bounding box (longest edge) for each size
+var thumbnailMaxDimension = map[ThumbnailSize]int{
+	ThumbnailSmall:  256,
+	ThumbnailMedium: 1024,
+}
+
+// thumbnailSourceExtensions lists extensions that can be decoded in pure Go
+var thumbnailSourceExtensions = map[string]bool{
+	"jpg":  true,
+	"jpeg": true,
+	"png":  true,
+	"gif":  true,
+}
+
+const (
+	thumbnailQuality = 82
+	// Name prefix of previews being written
+	thumbnailTempPrefix = ".thumb-"
+	// Refuse to decode images above this many pixels to bound memory use
+	thumbnailMaxSourcePixels = 50 * 1000 * 1000
+	// Concurrent decodes; each may hold a decoded source of up to thumbnailMaxSourcePixels
+	// and its RGBA conversion, about 400MB for the largest images
+	thumbnailSlots = 2
+)
+
+// ParseThumbnailSize parses a size name, returning false if unknown
+func ParseThumbnailSize(value string) (ThumbnailSize, bool) {
+	size := ThumbnailSize(value)
+	_, ok := thumbnailMaxDimension[size]
+	return size, ok
+}
+
+// ThumbnailService generates and locates JPEG previews of stored photos
+// Previews live in storage/thumbnail/{user_id}/{year}/{month}/{day}/, parallel
+// to the photo tree, as {file_name}_{size}.jpg
+type ThumbnailService struct {
+	config *config.Config
+	logger *logger.Logger
+	slots  chan struct{} // Limits concurrent decodes
+
+	inflightMu sync.Mutex
+	inflight   map[string]*thumbnailJob // Source paths currently being processed in the background
+}
+
+// thumbnailJob is a background generation of the previews of one source
+type thumbnailJob struct {
+	photoDir string
+	fileName string
+	dirty    bool // The source changed while it was being processed; generate again when done
+}
+
+// NewThumbnailService creates a new ThumbnailService
+func NewThumbnailService(cfg *config.Config, appLogger *logger.Logger) *ThumbnailService {
+	return &ThumbnailService{
+		config:   cfg,
+		logger:   appLogger,
+		slots:    make(chan struct{}, thumbnailSlots),
+		inflight: make(map[string]*thumbnailJob),
+	}
+}
+
+// CanGenerate reports whether previews can be generated from files with this extension
+func (ts *ThumbnailService) CanGenerate(fileExtension string) bool {
+	return thumbnailSourceExtensions[strings.ToLower(fileExtension)]
+}
+
+// ThumbnailPath returns the cache path of a preview for a photo
+// photoDir and fileName are the photo record's FilePath and FileName
+func (ts *ThumbnailService) ThumbnailPath(photoDir, fileName string, size ThumbnailSize) (string, error) {
+	storageRoot := strings.TrimRight(ts.config.StorageDir, "/")
+	photoRoot := storageRoot + "/photo/"
+	if !strings.HasPrefix(photoDir, photoRoot) {
+		return "", fmt.Errorf("photo directory %s is outside storage directory", photoDir)
+	}
+
+	relDir := strings.TrimPrefix(photoDir, photoRoot)
+	return filepath.Join(storageRoot, "thumbnail", relDir, fmt.Sprintf("%s_%s.jpg", fileName, size)), nil
+}
+
+// Generate decodes a source image once and writes every preview size
+// It waits for a free slot first, so at most thumbnailSlots decodes hold a full-size image in memory
+func (ts *ThumbnailService) Generate(srcPath, photoDir, fileName string) error {
+	ts.slots <- struct{}{}
+	defer func() { <-ts.slots }()
+
+	src, err := ts.decode(srcPath)
+	if err != nil {
+		return err
+	}
+
+	// Largest first, so each smaller preview is downscaled from the previous one
+	current := toRGBA(src)
+	for _, size := range []ThumbnailSize{ThumbnailMedium, ThumbnailSmall} {
+		dstPath, err := ts.ThumbnailPath(photoDir, fileName, size)
+		if err != nil {
+			return err
+		}
+		current = resizeToFit(current, thumbnailMaxDimension[size])
+		if err := ts.writeJPEG(dstPath, current); err != nil {
+			return fmt.Errorf("failed to write %s thumbnail: %w", size, err)
+		}
+	}
+
+	return nil
+}
+
+// GenerateAsync generates previews in the background, logging failures
+// A request for a source that is already being processed marks it dirty, and the previews are
+// generated once more when the current run finishes, so a re-upload never leaves a stale preview
+func (ts *ThumbnailService) GenerateAsync(srcPath, photoDir, fileName string) {
+	ts.inflightMu.Lock()
+	defer ts.inflightMu.Unlock()
+
+	if job, busy := ts.inflight[srcPath]; busy {
+		job.photoDir, job.fileName, job.dirty = photoDir, fileName, true
+		return
+	}
+	job := &thumbnailJob{photoDir: photoDir, fileName: fileName}
+	ts.inflight[srcPath] = job
+
+	go func() {
+		for {
+			if err := ts.Generate(srcPath, photoDir, fileName); err != nil {
+				ts.logger.Warn("Thumbnail generation failed",
+					logger.String("source", srcPath),
+					logger.String("error", err.Error()))
+			}
+
+			ts.inflightMu.Lock()
+			if !job.dirty {
+				delete(ts.inflight, srcPath)
+				ts.inflightMu.Unlock()
+				return
+			}
+			job.dirty = false
+			photoDir, fileName = job.photoDir, job.fileName
+			ts.inflightMu.Unlock()
+		}
+	}()
+}
+
+// decode opens and decodes a source image, rejecting oversized inputs
+func (ts *ThumbnailService) decode(srcPath string) (image.Image, error) {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source image: %w", err)
+	}
+	defer file.Close()
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxSourcePixels {
+		return nil, fmt.Errorf("source image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("failed to rewind source image: %w", err)
+	}
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// writeJPEG encodes an image to a temp file and renames it into place,
+// so concurrent readers never see a partially written preview
+func (ts *ThumbnailService) writeJPEG(dstPath string, img image.Image) error {
+	dir := filepath.Dir(dstPath)
+	if err := config.EnsureDir(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, thumbnailTempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := jpeg.Encode(tmp, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode jpeg: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		return fmt.Errorf("failed to move thumbnail into place: %w", err)
+	}
+	return nil
+}
+
+// toRGBA converts any decoded image to RGBA; image/draw has fast paths for the decoder outputs
+func toRGBA(src image.Image) *image.RGBA {
+	// Decoded RGBA and NRGBA images are used without a copy. Previews are JPEGs, which drop alpha,
+	// so the unpremultiplied colors of NRGBA pixels can be averaged and encoded as they are
+	switch img := src.(type) {
+	case *image.RGBA:
+		if img.Rect.Min == (image.Point{}) {
+			return img
+		}
+	case *image.NRGBA:
+		if img.Rect.Min == (image.Point{}) {
+			return &image.RGBA{Pix: img.Pix, Stride: img.Stride, Rect: img.Rect}
+		}
+	}
+
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	return rgba
+}
+
+// resizeToFit downscales an image so its longest edge is at most maxDim,
+// averaging every source pixel that falls into each destination pixel
+func resizeToFit(rgba *image.RGBA, maxDim int) *image.RGBA {
+	srcW, srcH := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	if srcW <= maxDim && srcH <= maxDim {
+		return rgba
+	}
+
+	dstW, dstH := maxDim, maxDim
+	if srcW >= srcH {
+		dstH = max(1, srcH*maxDim/srcW)
+	} else {
+		dstW = max(1, srcW*maxDim/srcH)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := y * srcH / dstH
+		y1 := max(y0+1, (y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := x * srcW / dstW
+			x1 := max(x0+1, (x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					b += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(b / n)
+			d[3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
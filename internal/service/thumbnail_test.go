@@ -0,0 +1,63 @@
+package service
+
+import (
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+)
+
+func TestGenerateFromNRGBA(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.StorageDir = t.TempDir()
+	ts := NewThumbnailService(cfg, nil)
+
+	// PNGs with alpha decode to NRGBA, which is used without an RGBA copy
+	src := image.NewNRGBA(image.Rect(0, 0, 2000, 1000))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	if rgba := toRGBA(src); &rgba.Pix[0] != &src.Pix[0] {
+		t.Errorf("toRGBA copied an NRGBA image")
+	}
+
+	photoDir := filepath.Join(cfg.StorageDir, "photo", "1", "2025", "12", "10")
+	if err := os.MkdirAll(photoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srcPath := filepath.Join(photoDir, "IMG_0001.png")
+	file, err := os.Create(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, src); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if err := ts.Generate(srcPath, photoDir, "IMG_0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for size, want := range map[ThumbnailSize]image.Point{ThumbnailMedium: {1024, 512}, ThumbnailSmall: {256, 128}} {
+		path, err := ts.ThumbnailPath(photoDir, "IMG_0001", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("%s preview: %v", size, err)
+		}
+		preview, err := jpeg.DecodeConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s preview: %v", size, err)
+		}
+		if got := (image.Point{preview.Width, preview.Height}); got != want {
+			t.Errorf("%s preview is %v, want %v", size, got, want)
+		}
+	}
+}
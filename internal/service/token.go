@@ -1,106 +1,251 @@
 package service
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
 	"github.com/ios-photo-backup/photo-backup-server/internal/models"
 	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
 )
 
+// tokenCheckTTL is how long the result of looking a token up in the tokens table is reused
+// Logouts through this server take effect at once; tokens revoked by another process
+// (the CLI) may be accepted for up to this long
+const tokenCheckTTL = 30 * time.Second
+
+// maxTokenChecks bounds the number of cached token lookups
+const maxTokenChecks = 10000
+
+// tokenCheck is the cached result of looking a token up in the tokens table
+type tokenCheck struct {
+	userID    uint
+	familyID  string
+	active    bool
+	checkedAt time.Time
+}
+
+// Errors of exchanging a refresh token
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token not found or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, the session has been revoked")
+	ErrLegacyTokenInvalid  = errors.New("token cannot be exchanged: not a valid token issued before refresh tokens, or already exchanged")
+)
+
 // TokenService handles token management operations
+// Logins start a session (token family) with a short-lived access token and a refresh token; each
+// refresh replaces the refresh token and issues a new access token
 type TokenService struct {
-	tokenRepo *repository.TokenRepository
-	jwtSecret string
+	tokenRepo  *repository.TokenRepository
+	userRepo   *repository.UserRepository
+	jwtKeys    *config.JWTKeyStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+
+	checksMu        sync.Mutex
+	checks          map[string]tokenCheck
+	loggedOut       map[uint]time.Time   // When users logged out everywhere, kept for tokenCheckTTL
+	revokedFamilies map[string]time.Time // When token families were revoked, kept for tokenCheckTTL
 }
 
 // NewTokenService creates a new TokenService
-func NewTokenService(tokenRepo *repository.TokenRepository, jwtSecret string) *TokenService {
+func NewTokenService(tokenRepo *repository.TokenRepository, userRepo *repository.UserRepository, jwtKeys *config.JWTKeyStore, accessTTL, refreshTTL time.Duration) *TokenService {
 	return &TokenService{
-		tokenRepo: tokenRepo,
-		jwtSecret: jwtSecret,
+		tokenRepo:       tokenRepo,
+		userRepo:        userRepo,
+		jwtKeys:         jwtKeys,
+		accessTTL:       accessTTL,
+		refreshTTL:      refreshTTL,
+		checks:          make(map[string]tokenCheck),
+		loggedOut:       make(map[uint]time.Time),
+		revokedFamilies: make(map[string]time.Time),
 	}
 }
 
+// TokenPair is an access token and the refresh token that renews it
+type TokenPair struct {
+	Token            string    `json:"token"` // Access token
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
 // RefreshRequest represents a refresh token request
-type RefreshRequest struct{}
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
 
-// RefreshResponse represents a refresh token response
-type RefreshResponse struct {
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
+// randomToken returns 32 random bytes encoded for use in URLs and headers
+func randomToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
 }
 
-// Refresh refreshes a JWT token
-func (s *TokenService) Refresh(tokenString string) (*RefreshResponse, error) {
-	// Parse and validate the token
-	claims, err := s.validateToken(tokenString)
+// Issue starts a new session of a user on a device and returns its first tokens
+func (s *TokenService) Issue(user *models.User, deviceID uint) (*TokenPair, error) {
+	familyID, err := randomToken()
 	if err != nil {
-		return nil, fmt.Errorf("invalid token: %w", err)
+		return nil, err
+	}
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshExpiresAt := time.Now().Add(s.refreshTTL)
+	if err := s.tokenRepo.CreateRefreshToken(user.ID, deviceID, familyID, refreshToken, refreshExpiresAt); err != nil {
+		return nil, err
 	}
 
-	// Extract user ID from claims
-	userID, ok := claims["user_id"].(float64)
-	if !ok {
-		return nil, fmt.Errorf("invalid token claims")
+	accessToken, expiresAt, err := s.issueAccessToken(user, deviceID, familyID)
+	if err != nil {
+		return nil, err
 	}
+	return &TokenPair{
+		Token:            accessToken,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
+}
 
-	// Check if token exists in database and is not expired
-	existingToken, err := s.tokenRepo.FindValidToken(tokenString)
+// issueAccessToken signs an access token of a session and records it in the tokens table
+func (s *TokenService) issueAccessToken(user *models.User, deviceID uint, familyID string) (string, time.Time, error) {
+	// The random ID keeps tokens issued within the same second distinct
+	jti, err := randomToken()
 	if err != nil {
-		return nil, fmt.Errorf("failed to find token: %w", err)
+		return "", time.Time{}, err
 	}
-	if existingToken == nil {
-		return nil, fmt.Errorf("token not found or expired")
+	now := time.Now()
+	expiresAt := now.Add(s.accessTTL)
+	claims := jwt.MapClaims{
+		"user_id":   user.ID,
+		"username":  user.Username,
+		"device_id": deviceID,
+		"exp":       expiresAt.Unix(),
+		"iat":       now.Unix(),
+		"jti":       jti,
 	}
 
-	// Delete old token from database
-	if err := s.tokenRepo.DeleteByTokenValue(tokenString); err != nil {
-		return nil, fmt.Errorf("failed to delete old token: %w", err)
+	// Sign with the newest key, named in the kid header so the token can be verified after the key is rotated
+	key, err := s.jwtKeys.Keyring().SigningKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed.Header["kid"] = key.ID
+	tokenString, err := signed.SignedString([]byte(key.Secret))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
 	}
 
-	// Generate new token
-	newClaims := jwt.MapClaims{
-		"user_id":  userID,
-		"username": claims["username"],
-		"exp":      time.Now().Add(7 * 24 * time.Hour).Unix(),
-		"iat":      time.Now().Unix(),
+	token := &models.Token{
+		UserID:    user.ID,
+		DeviceID:  deviceID,
+		FamilyID:  familyID,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
 	}
+	if err := s.tokenRepo.Create(token, tokenString); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to save token: %w", err)
+	}
+	return tokenString, expiresAt, nil
+}
 
-	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims)
-	newTokenString, err := newToken.SignedString([]byte(s.jwtSecret))
+// Refresh exchanges a refresh token for a new access token and a new refresh token
+// Presenting a refresh token that was already exchanged means it was copied, so the whole session is
+// revoked and ErrRefreshTokenReused returned
+func (s *TokenService) Refresh(refreshToken string) (*TokenPair, error) {
+	next, err := randomToken()
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign token: %w", err)
+		return nil, err
 	}
+	nextExpiresAt := time.Now().Add(s.refreshTTL)
 
-	// Save new token to database
-	expiresAt := time.Now().Add(7 * 24 * time.Hour)
-	token := &models.Token{
-		UserID:     uint(userID),
-		TokenValue: newTokenString,
-		CreatedAt:  time.Now(),
-		ExpiresAt:  expiresAt,
+	used, rotated, err := s.tokenRepo.RotateRefreshToken(refreshToken, next, nextExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if used == nil || (!rotated && used.UsedAt == nil) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if !rotated {
+		if err := s.revokeFamily(used.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
 	}
 
-	if err := s.tokenRepo.Create(token); err != nil {
-		return nil, fmt.Errorf("failed to save new token: %w", err)
+	user, err := s.userRepo.FindByID(used.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if err := s.revokeFamily(used.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenInvalid
 	}
 
-	return &RefreshResponse{
-		Token:     newTokenString,
-		ExpiresAt: expiresAt,
+	accessToken, expiresAt, err := s.issueAccessToken(user, used.DeviceID, used.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		Token:            accessToken,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     next,
+		RefreshExpiresAt: nextExpiresAt,
 	}, nil
 }
 
+// ExchangeLegacyToken exchanges a still-valid access token issued before refresh tokens for the tokens of a
+// new session on the same device, so clients that only hold such a token need not log in again
+// The token is revoked by the exchange, so it can be exchanged only once
+func (s *TokenService) ExchangeLegacyToken(tokenString string) (*TokenPair, error) {
+	if _, err := s.validateToken(tokenString); err != nil {
+		return nil, ErrLegacyTokenInvalid
+	}
+	token, err := s.tokenRepo.ClaimLegacyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, ErrLegacyTokenInvalid
+	}
+	s.revoke(tokenString)
+
+	user, err := s.userRepo.FindByID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrLegacyTokenInvalid
+	}
+	return s.Issue(user, token.DeviceID)
+}
+
 // validateToken validates a JWT token
 func (s *TokenService) validateToken(tokenString string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(s.jwtSecret), nil
+		// Tokens issued before the keyring have no kid; the keyring verifies them with the imported legacy key
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.jwtKeys.Keyring().VerificationKey(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("unknown or retired signing key: %q", kid)
+		}
+		return []byte(key.Secret), nil
 	})
 
 	if err != nil {
@@ -120,6 +265,124 @@ func (s *TokenService) ValidateToken(tokenString string) (jwt.MapClaims, error)
 	return s.validateToken(tokenString)
 }
 
+// IsActive reports whether a validated token is still in the tokens table, i.e. has not been revoked
+// Results are cached for tokenCheckTTL so that authenticated requests do not each query the database
+func (s *TokenService) IsActive(tokenString string) (bool, error) {
+	now := time.Now()
+	s.checksMu.Lock()
+	check, ok := s.checks[tokenString]
+	s.checksMu.Unlock()
+	if ok && now.Sub(check.checkedAt) < tokenCheckTTL {
+		return check.active, nil
+	}
+
+	token, err := s.tokenRepo.FindValidToken(tokenString)
+	if err != nil {
+		return false, fmt.Errorf("failed to find token: %w", err)
+	}
+	check = tokenCheck{active: token != nil, checkedAt: now}
+	if token != nil {
+		check.userID = token.UserID
+		check.familyID = token.FamilyID
+	}
+
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	// A revoked token never becomes active again; keep a revocation made while the lookup ran
+	if cached, ok := s.checks[tokenString]; ok && !cached.active {
+		return false, nil
+	}
+	if check.active && s.loggedOut[check.userID].After(now) {
+		check.active = false
+	}
+	if check.active && check.familyID != "" && s.revokedFamilies[check.familyID].After(now) {
+		check.active = false
+	}
+	if len(s.checks) >= maxTokenChecks {
+		for value, cached := range s.checks {
+			if now.Sub(cached.checkedAt) >= tokenCheckTTL {
+				delete(s.checks, value)
+			}
+		}
+		if len(s.checks) >= maxTokenChecks {
+			s.checks = make(map[string]tokenCheck)
+		}
+	}
+	s.checks[tokenString] = check
+	return check.active, nil
+}
+
+// revoke records in the cache that a token was removed from the tokens table
+func (s *TokenService) revoke(tokenString string) {
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	s.checks[tokenString] = tokenCheck{active: false, checkedAt: time.Now()}
+}
+
+// revokeFamily deletes the refresh and access tokens of a session
+func (s *TokenService) revokeFamily(familyID string) error {
+	if err := s.tokenRepo.DeleteFamily(familyID); err != nil {
+		return err
+	}
+
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	now := time.Now()
+	for family, revokedAt := range s.revokedFamilies {
+		if now.Sub(revokedAt) >= tokenCheckTTL {
+			delete(s.revokedFamilies, family)
+		}
+	}
+	s.revokedFamilies[familyID] = now
+	for value, check := range s.checks {
+		if check.familyID == familyID {
+			s.checks[value] = tokenCheck{userID: check.userID, familyID: familyID, active: false, checkedAt: now}
+		}
+	}
+	return nil
+}
+
+// Logout revokes a token together with the refresh token of its session
+func (s *TokenService) Logout(tokenString string) error {
+	token, err := s.tokenRepo.FindByTokenValue(tokenString)
+	if err != nil {
+		return err
+	}
+	if token != nil && token.FamilyID != "" {
+		if err := s.revokeFamily(token.FamilyID); err != nil {
+			return err
+		}
+	} else if err := s.tokenRepo.DeleteByTokenValue(tokenString); err != nil {
+		return err
+	}
+	s.revoke(tokenString)
+	return nil
+}
+
+// LogoutAll revokes every token of a user and returns how many sessions were revoked
+func (s *TokenService) LogoutAll(userID uint) (int64, error) {
+	revoked, err := s.tokenRepo.DeleteByUserID(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	now := time.Now()
+	for user, loggedOutAt := range s.loggedOut {
+		if now.Sub(loggedOutAt) >= tokenCheckTTL {
+			delete(s.loggedOut, user)
+		}
+	}
+	s.loggedOut[userID] = now
+	for value, check := range s.checks {
+		if check.userID == userID {
+			s.checks[value] = tokenCheck{userID: userID, active: false, checkedAt: now}
+		}
+	}
+	return revoked, nil
+}
+
 // StatusResponse represents a status check response
 type StatusResponse struct {
 	Status   string `json:"status"`
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/config"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+// newTestTokenService creates a TokenService on a temporary database and keyring, with one user
+func newTestTokenService(t *testing.T) (*TokenService, *models.User) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "app.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := repository.AutoMigrate(db); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get database handle: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	keyringPath := filepath.Join(dir, "jwt_keys.json")
+	if _, err := config.LoadOrCreateJWTKeyring(keyringPath, filepath.Join(dir, "jwt_secret")); err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	jwtKeys, err := config.NewJWTKeyStore(keyringPath)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	userRepo := repository.NewUserRepository(db)
+	user := &models.User{Username: "alice", PasswordHash: "hash"}
+	if err := userRepo.Create(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return NewTokenService(repository.NewTokenRepository(db), userRepo, jwtKeys, time.Hour, 24*time.Hour), user
+}
+
+// assertActive fails the test unless IsActive reports want for token
+func assertActive(t *testing.T, s *TokenService, token string, want bool) {
+	t.Helper()
+	active, err := s.IsActive(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if active != want {
+		t.Errorf("active = %v, want %v", active, want)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s, user := newTestTokenService(t)
+	first, err := s.Issue(user, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := s.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.Token == first.Token {
+		t.Fatalf("refresh returned the same tokens")
+	}
+	claims, err := s.ValidateToken(second.Token)
+	if err != nil {
+		t.Fatalf("refreshed token is invalid: %v", err)
+	}
+	if claims["device_id"] != float64(7) || claims["user_id"] != float64(user.ID) {
+		t.Errorf("claims = %v, want device 7 of user %d", claims, user.ID)
+	}
+	assertActive(t, s, second.Token, true)
+
+	// Exchanging the first refresh token again revokes the whole session
+	if _, err := s.Refresh(first.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reused refresh error = %v, want %v", err, ErrRefreshTokenReused)
+	}
+	if _, err := s.Refresh(second.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("revoked refresh error = %v, want %v", err, ErrRefreshTokenInvalid)
+	}
+	assertActive(t, s, first.Token, false)
+	assertActive(t, s, second.Token, false)
+
+	if _, err := s.Refresh("unknown"); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("unknown refresh error = %v, want %v", err, ErrRefreshTokenInvalid)
+	}
+}
+
+func TestRefreshExpired(t *testing.T) {
+	s, user := newTestTokenService(t)
+	s.refreshTTL = -time.Minute
+	pair, err := s.Issue(user, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Refresh(pair.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("expired refresh error = %v, want %v", err, ErrRefreshTokenInvalid)
+	}
+}
+
+func TestRevokeFamily(t *testing.T) {
+	s, user := newTestTokenService(t)
+	revoked, err := s.Issue(user, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := s.Issue(user, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache both tokens as active, so revoking must update the cache as well as the database
+	assertActive(t, s, revoked.Token, true)
+	assertActive(t, s, kept.Token, true)
+
+	token, err := s.tokenRepo.FindValidToken(revoked.Token)
+	if err != nil || token == nil {
+		t.Fatalf("find token = %v, %v", token, err)
+	}
+	if err := s.revokeFamily(token.FamilyID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	assertActive(t, s, revoked.Token, false)
+	assertActive(t, s, kept.Token, true)
+	if token, _ := s.tokenRepo.FindValidToken(revoked.Token); token != nil {
+		t.Errorf("revoked access token is still stored")
+	}
+	if _, err := s.Refresh(revoked.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("revoked refresh error = %v, want %v", err, ErrRefreshTokenInvalid)
+	}
+	if _, err := s.Refresh(kept.RefreshToken); err != nil {
+		t.Errorf("refresh of the other session failed: %v", err)
+	}
+}
+
+func TestExchangeLegacyToken(t *testing.T) {
+	s, user := newTestTokenService(t)
+	legacy, _, err := s.issueAccessToken(user, 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertActive(t, s, legacy, true)
+
+	pair, err := s.ExchangeLegacyToken(legacy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	claims, err := s.ValidateToken(pair.Token)
+	if err != nil {
+		t.Fatalf("exchanged token is invalid: %v", err)
+	}
+	if claims["device_id"] != float64(4) {
+		t.Errorf("device_id = %v, want 4", claims["device_id"])
+	}
+	assertActive(t, s, legacy, false)
+	if _, err := s.Refresh(pair.RefreshToken); err != nil {
+		t.Errorf("refresh of the exchanged session failed: %v", err)
+	}
+
+	session, err := s.Issue(user, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"exchanged": legacy, "session": session.Token, "malformed": "not-a-jwt"} {
+		if _, err := s.ExchangeLegacyToken(token); !errors.Is(err, ErrLegacyTokenInvalid) {
+			t.Errorf("%s token error = %v, want %v", name, err, ErrLegacyTokenInvalid)
+		}
+	}
+}
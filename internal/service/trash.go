@@ -0,0 +1,404 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/logger"
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+// trashDirName is the storage subdirectory holding the files of deleted photos
+const trashDirName = "trash"
+
+// TrashRetention returns how long deleted photos stay in the trash; 0 keeps them until restored
+func (fs *FileStorage) TrashRetention() time.Duration {
+	return time.Duration(fs.config.TrashRetentionDays) * 24 * time.Hour
+}
+
+// trashedFile is a stored file of a photo together with where it is kept while the photo is in the trash
+type trashedFile struct {
+	Path      string
+	TrashPath string
+}
+
+// trashPath returns where a file under storage/{area}/{user_id}/ is kept while its photo is in the trash
+// Format: storage/trash/{user_id}/{area}/{year}/{month}/{day}/{file}, area being photo or version
+func (s *PhotoService) trashPath(area, path string) (string, error) {
+	userDir := strconv.FormatUint(uint64(s.photoRepo.UserID()), 10)
+	areaDir := filepath.Join(s.storageDir, area, userDir)
+	rel, err := filepath.Rel(areaDir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("file %s is outside the user's %s directory", path, area)
+	}
+	return filepath.Join(s.storageDir, trashDirName, userDir, area, rel), nil
+}
+
+// trashedFiles lists the uploaded files and kept versions of a photo with their trash paths
+func (s *PhotoService) trashedFiles(photo *models.Photo) ([]trashedFile, error) {
+	files, err := s.photoRepo.GetFiles(photo.LocalID)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.photoRepo.GetVersions(photo.LocalID)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make([]trashedFile, 0, len(files)+len(versions))
+	for _, file := range files {
+		path, err := s.resolvePhotoPath(photo, file.Role, file.Extension)
+		if err != nil {
+			return nil, err
+		}
+		trashPath, err := s.trashPath("photo", path)
+		if err != nil {
+			return nil, err
+		}
+		moves = append(moves, trashedFile{Path: path, TrashPath: trashPath})
+	}
+	for _, version := range versions {
+		path, err := s.versionPath(photo, version.Role, version.Extension, version.Version)
+		if err != nil {
+			return nil, err
+		}
+		trashPath, err := s.trashPath(versionDirName, path)
+		if err != nil {
+			return nil, err
+		}
+		moves = append(moves, trashedFile{Path: path, TrashPath: trashPath})
+	}
+	return moves, nil
+}
+
+// deleteThumbnails removes the cached previews of a photo; they are regenerated on demand
+func (s *PhotoService) deleteThumbnails(photo *models.Photo) error {
+	if s.thumbnails == nil {
+		return nil
+	}
+	for _, size := range []ThumbnailSize{ThumbnailMedium, ThumbnailSmall} {
+		thumbPath, err := s.thumbnails.ThumbnailPath(photo.FilePath, photo.FileName, size)
+		if err != nil {
+			return err
+		}
+		if err := s.fileStorage.DeleteFile(thumbPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrashedPhoto describes a photo in the trash
+type TrashedPhoto struct {
+	LocalID            string     `json:"local_id"`
+	CreationTime       time.Time  `json:"creation_time"`
+	FileName           string     `json:"file_name"`
+	FileType           string     `json:"file_type"`
+	UploadedExtensions []string   `json:"uploaded_extensions"`
+	DeletedAt          time.Time  `json:"deleted_at"`
+	PurgeAt            *time.Time `json:"purge_at,omitempty"` // Unset when the trash is never purged
+}
+
+// trashedPhoto builds the trash listing entry of a deleted photo
+func (s *PhotoService) trashedPhoto(photo *models.Photo, uploadedExtensions []string) TrashedPhoto {
+	if uploadedExtensions == nil {
+		uploadedExtensions = make([]string, 0)
+	}
+	item := TrashedPhoto{
+		LocalID:            photo.LocalID,
+		CreationTime:       photo.CreationTime,
+		FileName:           photo.FileName,
+		FileType:           photo.FileType,
+		UploadedExtensions: uploadedExtensions,
+		DeletedAt:          photo.DeletedAt.Time,
+	}
+	if retention := s.fileStorage.TrashRetention(); retention > 0 {
+		purgeAt := photo.DeletedAt.Time.Add(retention)
+		item.PurgeAt = &purgeAt
+	}
+	return item
+}
+
+// TrashPhoto moves a photo and its files into the user's trash
+// The photo disappears from listings and downloads and refuses uploads until restored
+func (s *PhotoService) TrashPhoto(localID string) (*TrashedPhoto, error) {
+	if err := ValidateLocalID(localID); err != nil {
+		return nil, err
+	}
+	photo, err := s.FindPhoto(localID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hide the record first: uploads check the photo under the path lock, so none starts
+	// writing after this, and one already writing a listed file finishes before it is moved
+	deleted, err := s.photoRepo.SoftDelete(localID)
+	if err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, ErrPhotoNotFound
+	}
+	moves, err := s.trashedFiles(photo)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, move := range moves {
+		unlock := s.fileStorage.LockPath(move.Path)
+		_, err := s.fileStorage.MoveFile(move.Path, move.TrashPath)
+		unlock()
+		if err != nil {
+			err = fmt.Errorf("failed to move file to trash: %w", err)
+			if rollbackErr := s.untrash(localID, moves[:i]); rollbackErr != nil {
+				return nil, fmt.Errorf("%w; restoring the photo also failed: %v", err, rollbackErr)
+			}
+			return nil, err
+		}
+	}
+	if err := s.deleteThumbnails(photo); err != nil {
+		return nil, err
+	}
+
+	trashed, err := s.photoRepo.FindDeleted(localID)
+	if err != nil {
+		return nil, err
+	}
+	if trashed == nil {
+		return nil, ErrPhotoNotFound
+	}
+	extensions, err := s.photoRepo.GetUploadedExtensions(localID)
+	if err != nil {
+		return nil, err
+	}
+	item := s.trashedPhoto(trashed, extensions)
+	s.publish(Event{Type: EventPhotoDeleted, LocalID: localID, FileName: trashed.FileName})
+	return &item, nil
+}
+
+// untrash moves files back from the trash and shows the photo again, undoing a trash that failed midway
+func (s *PhotoService) untrash(localID string, moves []trashedFile) error {
+	for _, move := range moves {
+		unlock := s.fileStorage.LockPath(move.Path)
+		_, err := s.fileStorage.MoveFile(move.TrashPath, move.Path)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("failed to move file back from trash: %w", err)
+		}
+	}
+	_, err := s.photoRepo.Restore(localID)
+	return err
+}
+
+// ListTrash returns the photos in the user's trash, most recently deleted first
+func (s *PhotoService) ListTrash() ([]TrashedPhoto, error) {
+	photos, err := s.photoRepo.ListDeleted(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	localIDs := make([]string, len(photos))
+	for i, photo := range photos {
+		localIDs[i] = photo.LocalID
+	}
+	extensions, err := s.photoRepo.GetUploadedExtensionsByLocalIDs(localIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]TrashedPhoto, 0, len(photos))
+	for i := range photos {
+		items = append(items, s.trashedPhoto(&photos[i], extensions[photos[i].LocalID]))
+	}
+	return items, nil
+}
+
+// RestorePhoto moves a photo and its files out of the trash
+func (s *PhotoService) RestorePhoto(localID string) (*models.Photo, error) {
+	if err := ValidateLocalID(localID); err != nil {
+		return nil, err
+	}
+	photo, err := s.photoRepo.FindDeleted(localID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find photo: %w", err)
+	}
+	if photo == nil {
+		return nil, ErrPhotoNotFound
+	}
+	moves, err := s.trashedFiles(photo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files go back before the record reappears, so it never points at missing files.
+	// A file still at its original location, left there by a trash that failed, stays in place
+	for _, move := range moves {
+		unlock := s.fileStorage.LockPath(move.Path)
+		_, err := s.fileStorage.MoveFile(move.TrashPath, move.Path)
+		unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore file from trash: %w", err)
+		}
+	}
+
+	restored, err := s.photoRepo.Restore(localID)
+	if err != nil {
+		return nil, err
+	}
+	if !restored {
+		return nil, ErrPhotoNotFound
+	}
+	photo.DeletedAt.Valid = false
+	s.publish(Event{Type: EventPhotoRestored, LocalID: localID, FileName: photo.FileName})
+	return photo, nil
+}
+
+// PurgeTrash permanently removes photos deleted before a cutoff, with their files and records
+// Returns the number of photos removed
+func (s *PhotoService) PurgeTrash(before time.Time) (int, error) {
+	photos, err := s.photoRepo.ListDeleted(before)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for i := range photos {
+		moves, err := s.trashedFiles(&photos[i])
+		if err != nil {
+			return purged, err
+		}
+		// A file is removed from its original location too, in case trashing the photo failed to move it
+		for _, move := range moves {
+			if err := s.fileStorage.DeleteFile(move.TrashPath); err != nil {
+				return purged, err
+			}
+			if err := s.fileStorage.DeleteFile(move.Path); err != nil {
+				return purged, err
+			}
+		}
+		if err := s.photoRepo.Purge(photos[i].LocalID); err != nil {
+			return purged, err
+		}
+		s.publish(Event{Type: EventPhotoDeleted, LocalID: photos[i].LocalID, FileName: photos[i].FileName, Purged: true})
+		purged++
+	}
+	return purged, nil
+}
+
+// TrashPurger permanently removes photos that have been in the trash longer than the retention period
+// It also moves photos missing from the device past their user's grace period to the trash
+type TrashPurger struct {
+	userRepo     *repository.UserRepository
+	deviceRepo   *repository.DeviceRepository
+	photoService func(device *models.Device) *PhotoService
+	logger       *logger.Logger
+}
+
+// NewTrashPurger creates a new TrashPurger
+// photoService returns the PhotoService of a device's photo library, as created per request by the handlers
+func NewTrashPurger(userRepo *repository.UserRepository, deviceRepo *repository.DeviceRepository, photoService func(device *models.Device) *PhotoService, appLogger *logger.Logger) *TrashPurger {
+	return &TrashPurger{
+		userRepo:     userRepo,
+		deviceRepo:   deviceRepo,
+		photoService: photoService,
+		logger:       appLogger,
+	}
+}
+
+// Run purges once immediately and then every interval until ctx is done
+// An interval of 0 or less disables the purger; a retention of 0 or less only disables purging the trash
+func (p *TrashPurger) Run(ctx context.Context, interval, retention time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		trashed, err := p.TrashMissing()
+		if err != nil {
+			p.logger.Error("Trashing photos deleted from devices failed", logger.String("error", err.Error()))
+		} else if trashed > 0 {
+			p.logger.Info("Photos deleted from devices moved to trash", logger.Int("trashed", trashed))
+		}
+
+		if retention > 0 {
+			purged, err := p.Purge(retention)
+			if err != nil {
+				p.logger.Error("Trash purge failed", logger.String("error", err.Error()))
+			} else if purged > 0 {
+				p.logger.Info("Trash purge complete", logger.Int("purged", purged))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TrashMissing moves photos to the trash that users with the grace deletion policy
+// deleted from their devices longer than their grace period ago
+// Returns the number of photos moved; a failure for one user does not stop the others
+func (p *TrashPurger) TrashMissing() (int, error) {
+	return p.forEachUser("Trashing photos deleted from device failed for user", func(user *models.User, photoService *PhotoService) (int, error) {
+		policy := userDeletionPolicy(user)
+		if policy.Mode != DeletionGrace {
+			return 0, nil
+		}
+		return photoService.TrashMissingPhotos(time.Now().Add(-policy.GracePeriod()))
+	})
+}
+
+// Purge removes the photos of every user deleted more than retention ago
+// Returns the number of photos removed; a failure for one user does not stop the others
+func (p *TrashPurger) Purge(retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention)
+	return p.forEachUser("Trash purge failed for user", func(user *models.User, photoService *PhotoService) (int, error) {
+		return photoService.PurgeTrash(cutoff)
+	})
+}
+
+// forEachUser runs fn for the photo library of every device of every user, summing the counts it returns
+// Failures are logged with failureMessage and the first one is returned after all users were processed
+func (p *TrashPurger) forEachUser(failureMessage string, fn func(user *models.User, photoService *PhotoService) (int, error)) (int, error) {
+	users, err := p.userRepo.ListAll()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	var firstErr error
+	fail := func(user *models.User, deviceID uint, err error) {
+		p.logger.Error(failureMessage,
+			logger.Uint("user_id", user.ID),
+			logger.Uint("device_id", deviceID),
+			logger.String("error", err.Error()))
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i := range users {
+		devices, err := p.deviceRepo.ListByUserID(users[i].ID)
+		if err != nil {
+			fail(&users[i], 0, err)
+			continue
+		}
+		for j := range devices {
+			count, err := fn(&users[i], p.photoService(&devices[j]))
+			total += count
+			if err != nil {
+				fail(&users[i], devices[j].ID, err)
+			}
+		}
+	}
+	return total, firstErr
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+// newTestPhotoService creates the PhotoService of an original device, backed by a temporary database and storage
+// Photo tables are only migrated once per process, so each test package should call it from a single test
+func newTestPhotoService(t *testing.T) *PhotoService {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "app.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := repository.AutoMigrate(db); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get database handle: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	device := &models.Device{UserID: 1, Identifier: "phone", Original: true}
+	if err := db.Create(device).Error; err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFileStorage(t)
+	naming := NewPhotoNaming()
+	return NewPhotoService(repository.NewPhotoRepository(db, device, naming), naming, fs, nil, nil, fs.config.StorageDir)
+}
+
+func TestTrashPhotoMoveFailure(t *testing.T) {
+	s := newTestPhotoService(t)
+	day := time.Date(2025, 12, 10, 9, 0, 0, 0, time.UTC)
+	photo := &models.Photo{
+		LocalID:      "live",
+		CreationTime: day,
+		FilePath:     s.naming.GetDirectoryPath(s.storageDir, 1, day),
+		FileName:     "IMG_0001",
+		FileType:     "jpg",
+	}
+	if err := s.photoRepo.Create(photo); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Live Photo: the still is moved to the trash first, then the motion video
+	var paths, trashPaths []string
+	for _, file := range []models.PhotoFile{{Role: RolePhoto, Extension: "jpg"}, {Role: RolePairedVideo, Extension: "mov"}} {
+		path := s.photoFilePath(photo, file.Role, file.Extension)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(file.Extension), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file.LocalID = photo.LocalID
+		if err := s.photoRepo.AddUploadedFile(&file); err != nil {
+			t.Fatal(err)
+		}
+		trashPath, err := s.trashPath("photo", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		trashPaths = append(trashPaths, trashPath)
+	}
+	assertFiles := func(t *testing.T, paths []string, exist bool) {
+		t.Helper()
+		for _, path := range paths {
+			if _, err := os.Stat(path); (err == nil) != exist {
+				t.Errorf("%s: exists = %v, want %v", path, err == nil, exist)
+			}
+		}
+	}
+
+	t.Run("failed move is rolled back", func(t *testing.T) {
+		// A non-empty directory where the video would go makes its move fail after the still was moved
+		blocker := filepath.Join(trashPaths[1], "blocker")
+		if err := os.MkdirAll(blocker, 0755); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(trashPaths[1])
+
+		if _, err := s.TrashPhoto(photo.LocalID); err == nil {
+			t.Fatal("trashing succeeded with a blocked trash path")
+		}
+		if _, err := s.FindPhoto(photo.LocalID); err != nil {
+			t.Fatalf("photo hidden after a failed trash: %v", err)
+		}
+		assertFiles(t, paths, true)
+		assertFiles(t, trashPaths[:1], false)
+	})
+
+	// Should the rollback fail too, the photo is in the trash with its files in either location
+	if _, err := s.fileStorage.MoveFile(paths[0], trashPaths[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.photoRepo.SoftDelete(photo.LocalID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore finds files in either location", func(t *testing.T) {
+		if _, err := s.RestorePhoto(photo.LocalID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assertFiles(t, paths, true)
+		assertFiles(t, trashPaths, false)
+	})
+
+	t.Run("purge removes files in either location", func(t *testing.T) {
+		if _, err := s.fileStorage.MoveFile(paths[1], trashPaths[1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.photoRepo.SoftDelete(photo.LocalID); err != nil {
+			t.Fatal(err)
+		}
+		purged, err := s.PurgeTrash(time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if purged != 1 {
+			t.Errorf("purged %d photos, want 1", purged)
+		}
+		assertFiles(t, paths, false)
+		assertFiles(t, trashPaths, false)
+	})
+}
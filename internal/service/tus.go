@@ -0,0 +1,324 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+	"github.com/ios-photo-backup/photo-backup-server/internal/repository"
+)
+
+// tusUploadDirName is the storage subdirectory holding unfinished tus uploads
+const tusUploadDirName = "uploads"
+
+// Protocol constants advertised to tus clients
+const (
+	TusVersion            = "1.0.0"
+	TusExtensions         = "creation,termination,checksum"
+	TusChecksumAlgorithms = "sha1,md5,sha256"
+)
+
+var (
+	ErrUploadNotFound         = errors.New("upload not found")
+	ErrUploadLocked           = errors.New("upload is being written by another request")
+	ErrUploadOffsetMismatch   = errors.New("upload offset does not match")
+	ErrUploadTooLarge         = errors.New("data exceeds declared upload length")
+	ErrUploadLengthTooLarge   = errors.New("upload length exceeds the maximum upload size")
+	ErrUnsupportedChecksum    = errors.New("unsupported checksum algorithm")
+	ErrUploadChecksumMismatch = errors.New("checksum of the request body does not match")
+)
+
+// TusChecksum is a parsed Upload-Checksum header
+type TusChecksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// ParseTusChecksum parses an Upload-Checksum header ("<algorithm> <base64 digest>")
+func ParseTusChecksum(value string) (*TusChecksum, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok {
+		return nil, fmt.Errorf("invalid Upload-Checksum header")
+	}
+	if newTusHash(algorithm) == nil {
+		return nil, ErrUnsupportedChecksum
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Upload-Checksum digest: %w", err)
+	}
+	return &TusChecksum{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// newTusHash returns a hash for a tus checksum algorithm, or nil if unsupported
+func newTusHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// ParseTusMetadata parses an Upload-Metadata header ("key base64value,key2 base64value2")
+func ParseTusMetadata(value string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata header: empty key")
+		}
+		if _, dup := metadata[key]; dup {
+			return nil, fmt.Errorf("invalid Upload-Metadata header: duplicate key %q", key)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// TusCreateRequest describes a new resumable upload
+type TusCreateRequest struct {
+	UploadRequest
+	Length   int64  // Declared total size in bytes
+	Metadata string // Raw Upload-Metadata header
+}
+
+// TusService implements tus resumable uploads on top of FileStorage
+// Data is appended to storage/uploads/{user_id}/{id} and handed to
+// PhotoService as a stream once the declared length has been received
+type TusService struct {
+	uploadRepo   *repository.TusUploadRepository
+	photoService *PhotoService
+	fileStorage  *FileStorage
+	storageDir   string
+}
+
+// NewTusService creates a new TusService
+func NewTusService(uploadRepo *repository.TusUploadRepository, photoService *PhotoService, fileStorage *FileStorage, storageDir string) *TusService {
+	return &TusService{
+		uploadRepo:   uploadRepo,
+		photoService: photoService,
+		fileStorage:  fileStorage,
+		storageDir:   storageDir,
+	}
+}
+
+// dataPath returns where the received bytes of an upload are kept
+func (s *TusService) dataPath(userID uint, id string) string {
+	return filepath.Join(s.storageDir, tusUploadDirName, strconv.FormatUint(uint64(userID), 10), id)
+}
+
+// CreateUpload creates an upload for an indexed photo
+// A zero-length upload completes immediately, in which case the UploadResult is non-nil
+func (s *TusService) CreateUpload(userID uint, req TusCreateRequest) (*models.TusUpload, *UploadResult, error) {
+	if req.Length > MaxUploadSize {
+		return nil, nil, fmt.Errorf("%w: %d bytes, maximum %d", ErrUploadLengthTooLarge, req.Length, MaxUploadSize)
+	}
+	_, resolved, _, err := s.photoService.prepareUpload(req.UploadRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate upload id: %w", err)
+	}
+
+	upload := &models.TusUpload{
+		ID:             hex.EncodeToString(idBytes),
+		UserID:         userID,
+		DeviceID:       s.photoService.photoRepo.DeviceID(),
+		LocalID:        req.LocalID,
+		Role:           resolved.Role,
+		Extension:      req.FileExtension,
+		FileType:       req.FileType,
+		Length:         req.Length,
+		Metadata:       req.Metadata,
+		ExpectedSHA256: req.ExpectedSHA256,
+		Device:         req.Device,
+	}
+
+	// Reserve the data file before the upload becomes visible
+	dataPath := s.dataPath(userID, upload.ID)
+	if _, err := s.fileStorage.WriteAt(dataPath, 0, bytes.NewReader(nil)); err != nil {
+		return nil, nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	if err := s.uploadRepo.Create(upload); err != nil {
+		_ = s.fileStorage.DeleteFile(dataPath)
+		return nil, nil, err
+	}
+
+	if upload.Length == 0 {
+		result, err := s.finalize(userID, upload, dataPath)
+		return upload, result, err
+	}
+	return upload, nil, nil
+}
+
+// GetUpload returns an upload owned by the user and made for the photo library of the service's device
+func (s *TusService) GetUpload(userID uint, id string) (*models.TusUpload, error) {
+	upload, err := s.uploadRepo.FindByID(userID, s.photoService.photoRepo.DeviceID(), id)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil {
+		return nil, ErrUploadNotFound
+	}
+	return upload, nil
+}
+
+// WriteChunk appends the request body to an upload at the given offset
+// contentLength is the declared body size, or -1 if unknown. When checksum is set,
+// the body is kept only if it matches; otherwise whatever arrives before a broken
+// connection is kept so the client can resume from there. Once the last byte has
+// been received the file is stored for the photo and a non-nil UploadResult returned
+func (s *TusService) WriteChunk(userID uint, id string, offset, contentLength int64, body io.Reader, checksum *TusChecksum) (*models.TusUpload, *UploadResult, error) {
+	dataPath := s.dataPath(userID, id)
+	unlock, ok := s.fileStorage.TryLockPath(dataPath)
+	if !ok {
+		return nil, nil, ErrUploadLocked
+	}
+	defer unlock()
+
+	upload, err := s.GetUpload(userID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset != upload.Offset {
+		return upload, nil, ErrUploadOffsetMismatch
+	}
+
+	remaining := upload.Length - upload.Offset
+	if contentLength > remaining {
+		return upload, nil, ErrUploadTooLarge
+	}
+
+	if remaining > 0 {
+		var hasher hash.Hash
+		// Read one byte past the remaining length to detect oversized bodies
+		reader := io.LimitReader(body, remaining+1)
+		if checksum != nil {
+			hasher = newTusHash(checksum.Algorithm)
+			reader = io.TeeReader(reader, hasher)
+		}
+
+		n, writeErr := s.fileStorage.WriteAt(dataPath, upload.Offset, reader)
+		if n > remaining {
+			_ = s.fileStorage.Truncate(dataPath, upload.Offset)
+			return upload, nil, ErrUploadTooLarge
+		}
+		if checksum != nil {
+			if writeErr == nil && !bytes.Equal(hasher.Sum(nil), checksum.Sum) {
+				writeErr = ErrUploadChecksumMismatch
+			}
+			if writeErr != nil {
+				// Partial or mismatching data cannot be trusted
+				_ = s.fileStorage.Truncate(dataPath, upload.Offset)
+				return upload, nil, writeErr
+			}
+		}
+
+		if n > 0 {
+			if err := s.uploadRepo.UpdateOffset(upload.ID, upload.Offset+n); err != nil {
+				return upload, nil, err
+			}
+			upload.Offset += n
+		}
+		if writeErr != nil {
+			return upload, nil, writeErr
+		}
+	}
+
+	if upload.Offset < upload.Length || upload.Finished {
+		return upload, nil, nil
+	}
+
+	// A PATCH at the final offset retries a completion that previously failed
+	result, err := s.finalize(userID, upload, dataPath)
+	return upload, result, err
+}
+
+// finalize stores a complete upload for its photo, removes its data and flags it finished
+// The record is kept so HEAD keeps reporting the upload complete to a client that missed the response.
+// A content hash or rejected content type mismatch discards the upload, since its data is bad;
+// other failures keep it so the completion can be retried
+func (s *TusService) finalize(userID uint, upload *models.TusUpload, dataPath string) (*UploadResult, error) {
+	file, _, err := s.fileStorage.OpenFile(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.photoService.UploadPhotoStream(userID, UploadRequest{
+		LocalID:        upload.LocalID,
+		Role:           upload.Role,
+		FileExtension:  upload.Extension,
+		FileType:       upload.FileType,
+		ExpectedSHA256: upload.ExpectedSHA256,
+		Device:         upload.Device,
+	}, file)
+	file.Close()
+	if err != nil {
+		var mismatch *ChecksumMismatchError
+		var contentMismatch *ContentTypeMismatchError
+		if errors.As(err, &mismatch) || errors.As(err, &contentMismatch) {
+			_ = s.discard(upload.ID, dataPath)
+		}
+		return nil, err
+	}
+
+	if err := s.uploadRepo.MarkFinished(upload.ID); err != nil {
+		return nil, err
+	}
+	upload.Finished = true
+	if err := s.fileStorage.DeleteFile(dataPath); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// discard removes an upload record and its data
+func (s *TusService) discard(id, dataPath string) error {
+	if err := s.uploadRepo.Delete(id); err != nil {
+		return err
+	}
+	return s.fileStorage.DeleteFile(dataPath)
+}
+
+// TerminateUpload deletes an upload and any data received for it
+// Terminating a finished upload only forgets it; the stored file is kept
+func (s *TusService) TerminateUpload(userID uint, id string) error {
+	dataPath := s.dataPath(userID, id)
+	unlock, ok := s.fileStorage.TryLockPath(dataPath)
+	if !ok {
+		return ErrUploadLocked
+	}
+	defer unlock()
+
+	if _, err := s.GetUpload(userID, id); err != nil {
+		return err
+	}
+	return s.discard(id, dataPath)
+}
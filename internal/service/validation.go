@@ -0,0 +1,132 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxLocalIDLength bounds local_id values accepted from clients
+const maxLocalIDLength = 255
+
+// extensionPattern restricts extensions to a short run of lowercase letters and digits,
+// which excludes dots, path separators and control characters
+var extensionPattern = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+
+// ValidationError reports a request parameter rejected before any storage is touched
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// ValidateLocalID checks a client-supplied local_id
+// "/" is allowed because iOS local identifiers have the form "UUID/L0/001"; local_id is
+// never used as a path component (stored files are named by PhotoNaming), but backslashes,
+// "." and ".." segments and control characters are rejected all the same
+func ValidateLocalID(localID string) error {
+	switch {
+	case localID == "":
+		return &ValidationError{Field: "local_id", Reason: "must not be empty"}
+	case len(localID) > maxLocalIDLength:
+		return &ValidationError{Field: "local_id", Reason: fmt.Sprintf("must be at most %d bytes", maxLocalIDLength)}
+	case !utf8.ValidString(localID):
+		return &ValidationError{Field: "local_id", Reason: "must be valid UTF-8"}
+	case strings.ContainsFunc(localID, unicode.IsControl):
+		return &ValidationError{Field: "local_id", Reason: "must not contain control characters"}
+	case strings.ContainsRune(localID, '\\'):
+		return &ValidationError{Field: "local_id", Reason: "must not contain backslashes"}
+	}
+
+	for _, segment := range strings.Split(localID, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return &ValidationError{Field: "local_id", Reason: "must not contain empty, \".\" or \"..\" path segments"}
+		}
+	}
+	return nil
+}
+
+// validateExtensionSyntax checks that an extension is safe to use in a file name
+func validateExtensionSyntax(fileExtension string) error {
+	if !extensionPattern.MatchString(fileExtension) {
+		return &ValidationError{Field: "file_type", Reason: "must be 1-16 lowercase letters or digits"}
+	}
+	return nil
+}
+
+// ValidateExtension checks that an extension is well formed and allowed for upload
+func (fs *FileStorage) ValidateExtension(fileExtension string) error {
+	if err := validateExtensionSyntax(fileExtension); err != nil {
+		return err
+	}
+	for _, allowed := range fs.config.AllowedExtensions {
+		if fileExtension == allowed {
+			return nil
+		}
+	}
+	return &ValidationError{Field: "file_type", Reason: fmt.Sprintf("extension %q is not allowed", fileExtension)}
+}
+
+// UserPhotoDir returns the directory holding all photos of a user
+func (fs *FileStorage) UserPhotoDir(userID uint) string {
+	return filepath.Join(fs.config.StorageDir, "photo", strconv.FormatUint(uint64(userID), 10))
+}
+
+// CheckUnderUserPhotoDir verifies that a path resolves to a location inside the user's photo directory
+// Symbolic links in the existing part of the path are followed, so a link inside the directory
+// cannot point a new file somewhere else
+func (fs *FileStorage) CheckUnderUserPhotoDir(userID uint, path string) error {
+	if strings.ContainsRune(path, 0) {
+		return &ValidationError{Field: "path", Reason: "must not contain NUL bytes"}
+	}
+	root, err := resolveExistingPath(fs.UserPhotoDir(userID))
+	if err != nil {
+		return fmt.Errorf("failed to resolve user directory: %w", err)
+	}
+	target, err := resolveExistingPath(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &ValidationError{Field: "path", Reason: "resolves outside the user's storage directory"}
+	}
+	return nil
+}
+
+// resolveExistingPath makes a path absolute and resolves symbolic links in its longest existing prefix
+// The part that does not exist yet is appended unchanged
+func resolveExistingPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	existing, rest := path, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return path, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, rest), nil
+}
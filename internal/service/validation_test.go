@@ -0,0 +1,101 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckUnderUserPhotoDir(t *testing.T) {
+	fs := newTestFileStorage(t)
+	root := fs.UserPhotoDir(1)
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "2025", "12", "10"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "2025"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "photo in a date directory", path: filepath.Join(root, "2025", "12", "10", "IMG_0001.jpg")},
+		{name: "directory not created yet", path: filepath.Join(root, "2026", "01", "01", "IMG_0001.jpg")},
+		{name: "dot dot back inside", path: root + "/2025/../2025/12/IMG_0001.jpg"},
+		{name: "encoded separators are part of the name", path: root + "/2025/..%2F..%2F2%2FIMG_0001.jpg"},
+		{name: "symlink inside the directory", path: filepath.Join(root, "inside", "12", "IMG_0001.jpg")},
+		{name: "dot dot into another user", path: root + "/2025/../../2/IMG_0001.jpg", wantErr: true},
+		{name: "dot dot out of storage", path: root + "/../../../../etc/passwd", wantErr: true},
+		{name: "absolute path", path: "/etc/passwd", wantErr: true},
+		{name: "user directory itself", path: root, wantErr: true},
+		{name: "sibling with the same prefix", path: root + "0/IMG_0001.jpg", wantErr: true},
+		{name: "NUL byte", path: filepath.Join(root, "2025", "IMG_0001.jpg\x00.png"), wantErr: true},
+		{name: "symlink leaving the directory", path: filepath.Join(root, "escape", "IMG_0001.jpg"), wantErr: true},
+		{name: "symlink leaving the directory then dot dot", path: filepath.Join(root, "escape") + "/x/../IMG_0001.jpg", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fs.CheckUnderUserPhotoDir(1, tt.path)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("error = %v, want a validation error", err)
+			}
+		})
+	}
+}
+
+func TestValidateLocalID(t *testing.T) {
+	tests := []struct {
+		name    string
+		localID string
+		wantErr bool
+	}{
+		{name: "iOS identifier", localID: "8B2A1C3E-6F4D-4E2B-9A7C-1D2E3F4A5B6C/L0/001"},
+		{name: "encoded separators", localID: "a%2F..%2Fb"},
+		{name: "empty", localID: "", wantErr: true},
+		{name: "too long", localID: strings.Repeat("a", maxLocalIDLength+1), wantErr: true},
+		{name: "dot dot segment", localID: "a/../b", wantErr: true},
+		{name: "leading dot dot", localID: "../b", wantErr: true},
+		{name: "dot segment", localID: "a/./b", wantErr: true},
+		{name: "absolute path", localID: "/etc/passwd", wantErr: true},
+		{name: "trailing slash", localID: "a/", wantErr: true},
+		{name: "backslash", localID: `a\..\b`, wantErr: true},
+		{name: "NUL byte", localID: "a\x00b", wantErr: true},
+		{name: "newline", localID: "a\nb", wantErr: true},
+		{name: "invalid UTF-8", localID: "a\xffb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateLocalID(tt.localID); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateExtensionSyntax(t *testing.T) {
+	for _, ext := range []string{"jpg", "heic", "mp4", "aae"} {
+		if err := validateExtensionSyntax(ext); err != nil {
+			t.Errorf("%q: unexpected error: %v", ext, err)
+		}
+	}
+	for _, ext := range []string{"", "JPG", "tar.gz", "../jpg", "jpg/", "%2Fjpg", "jpg\x00", strings.Repeat("a", 17)} {
+		if err := validateExtensionSyntax(ext); err == nil {
+			t.Errorf("%q: accepted", ext)
+		}
+	}
+}
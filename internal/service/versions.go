@@ -0,0 +1,264 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ios-photo-backup/photo-backup-server/internal/models"
+)
+
+// versionDirName is the storage subdirectory holding replaced versions of uploaded files
+const versionDirName = "version"
+
+// ErrVersionNotFound is returned when a requested version is not kept
+var ErrVersionNotFound = errors.New("version not found")
+
+// VersionRetention returns how many replaced versions are kept per file in addition to the original
+func (fs *FileStorage) VersionRetention() int {
+	return fs.config.VersionRetention
+}
+
+// versionPath returns where a replaced version of a resource is kept
+// Format: storage/version/{user_id}/{year}/{month}/{day}/{file_name}_v{version}.{ext}
+func (s *PhotoService) versionPath(photo *models.Photo, role, fileExtension string, version int) (string, error) {
+	storageRoot := strings.TrimRight(s.storageDir, "/")
+	photoRoot := storageRoot + "/photo/"
+	if !strings.HasPrefix(photo.FilePath, photoRoot) {
+		return "", fmt.Errorf("photo directory %s is outside storage directory", photo.FilePath)
+	}
+
+	relDir := strings.TrimPrefix(photo.FilePath, photoRoot)
+	return filepath.Join(storageRoot, versionDirName, relDir, s.versionFileName(photo, role, fileExtension, version)), nil
+}
+
+// versionFileName returns the name of a replaced version, e.g. IMG_0001_v2.heic
+func (s *PhotoService) versionFileName(photo *models.Photo, role, fileExtension string, version int) string {
+	return fmt.Sprintf("%s_v%d.%s", s.naming.ResourceFileName(photo.FileName, role), version, fileExtension)
+}
+
+// versionedWriteOptions returns the write options of an upload together with the record
+// of the file it replaces, if any; the replaced file is kept as a version when the content changes
+// Must be called with the destination path locked, so versions are numbered consistently
+func (s *PhotoService) versionedWriteOptions(photo *models.Photo, req UploadRequest) (WriteOptions, *models.PhotoFile, error) {
+	opts := s.uploadWriteOptions(req)
+	current, err := s.findFile(photo, req.Role, req.FileExtension)
+	if err != nil || current == nil {
+		return opts, nil, err
+	}
+
+	opts.ArchivePath, err = s.versionPath(photo, req.Role, req.FileExtension, current.Version)
+	if err != nil {
+		return opts, nil, err
+	}
+	opts.CurrentSHA256 = current.SHA256
+	return opts, current, nil
+}
+
+// nextVersion records the file replaced by an upload and returns the version number of the new content
+// Content identical to the current file keeps its version
+func (s *PhotoService) nextVersion(photo *models.Photo, current *models.PhotoFile, result *WriteResult) (int, error) {
+	if current == nil {
+		return 1, nil
+	}
+	if strings.EqualFold(current.SHA256, result.SHA256) {
+		return current.Version, nil
+	}
+	if !result.Archived {
+		// The previous file was missing on disk, so there is nothing to keep
+		return current.Version + 1, nil
+	}
+
+	if err := s.photoRepo.AddVersion(&models.PhotoVersion{
+		LocalID:    photo.LocalID,
+		Role:       current.Role,
+		Extension:  current.Extension,
+		Version:    current.Version,
+		Size:       current.Size,
+		SHA256:     current.SHA256,
+		MimeType:   current.MimeType,
+		Device:     current.Device,
+		UploadedAt: current.UploadedAt,
+		ReplacedAt: time.Now(),
+	}); err != nil {
+		return 0, err
+	}
+	if err := s.pruneVersions(photo, current.Role, current.Extension); err != nil {
+		return 0, err
+	}
+	return current.Version + 1, nil
+}
+
+// pruneVersions removes the oldest replaced versions of a resource beyond the retention count
+// The original (version 1) is always kept
+func (s *PhotoService) pruneVersions(photo *models.Photo, role, fileExtension string) error {
+	versions, err := s.photoRepo.GetVersions(photo.LocalID)
+	if err != nil {
+		return err
+	}
+
+	var edits []models.PhotoVersion
+	for _, version := range versions {
+		if version.Role == role && version.Extension == fileExtension && version.Version != 1 {
+			edits = append(edits, version)
+		}
+	}
+	retention := s.fileStorage.VersionRetention()
+	if len(edits) <= retention {
+		return nil
+	}
+
+	// Newest first; everything past the retention count goes
+	sort.Slice(edits, func(i, j int) bool { return edits[i].Version > edits[j].Version })
+	for _, version := range edits[retention:] {
+		versionPath, err := s.versionPath(photo, role, fileExtension, version.Version)
+		if err != nil {
+			return err
+		}
+		if err := s.fileStorage.DeleteFile(versionPath); err != nil {
+			return err
+		}
+		if err := s.photoRepo.DeleteVersion(version.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileVersion describes one version of an uploaded file
+type FileVersion struct {
+	Version    int        `json:"version"`
+	Size       int64      `json:"size"`
+	SHA256     string     `json:"sha256"`
+	MimeType   string     `json:"mime_type"`
+	Device     string     `json:"device,omitempty"`
+	UploadedAt time.Time  `json:"uploaded_at"`
+	ReplacedAt *time.Time `json:"replaced_at,omitempty"` // Unset for the current version
+	Current    bool       `json:"current"`
+	Original   bool       `json:"original"`
+}
+
+// ResourceVersions lists the kept versions of one resource of a photo
+type ResourceVersions struct {
+	Role           string        `json:"role"`
+	Extension      string        `json:"extension"`
+	CurrentVersion int           `json:"current_version"`
+	Versions       []FileVersion `json:"versions"` // Oldest first, ending with the current version
+}
+
+// PhotoVersionsResponse lists the versions of every uploaded file of a photo
+type PhotoVersionsResponse struct {
+	LocalID   string             `json:"local_id"`
+	Resources []ResourceVersions `json:"resources"`
+}
+
+// ListVersions returns the kept versions of every uploaded file of a photo
+func (s *PhotoService) ListVersions(localID string) (*PhotoVersionsResponse, error) {
+	photo, err := s.FindPhoto(localID)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.photoRepo.GetFiles(localID)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.photoRepo.GetVersions(localID)
+	if err != nil {
+		return nil, err
+	}
+
+	byResource := make(map[string][]models.PhotoVersion)
+	for _, version := range versions {
+		key := version.Role + "/" + version.Extension
+		byResource[key] = append(byResource[key], version)
+	}
+
+	resp := &PhotoVersionsResponse{LocalID: photo.LocalID, Resources: make([]ResourceVersions, 0, len(files))}
+	for _, file := range files {
+		resource := ResourceVersions{
+			Role:           file.Role,
+			Extension:      file.Extension,
+			CurrentVersion: file.Version,
+		}
+		for _, version := range byResource[file.Role+"/"+file.Extension] {
+			replacedAt := version.ReplacedAt
+			resource.Versions = append(resource.Versions, FileVersion{
+				Version:    version.Version,
+				Size:       version.Size,
+				SHA256:     version.SHA256,
+				MimeType:   version.MimeType,
+				Device:     version.Device,
+				UploadedAt: version.UploadedAt,
+				ReplacedAt: &replacedAt,
+				Original:   version.Version == 1,
+			})
+		}
+		resource.Versions = append(resource.Versions, FileVersion{
+			Version:    file.Version,
+			Size:       file.Size,
+			SHA256:     file.SHA256,
+			MimeType:   file.MimeType,
+			Device:     file.Device,
+			UploadedAt: file.UploadedAt,
+			Current:    true,
+			Original:   file.Version == 1,
+		})
+		resp.Resources = append(resp.Resources, resource)
+	}
+	return resp, nil
+}
+
+// OpenPhotoVersion opens one kept version of an uploaded resource of a photo
+// The current version is served from the photo itself. An empty role is resolved as in OpenPhotoFile
+// The caller must close the returned file
+func (s *PhotoService) OpenPhotoVersion(localID, role, fileExtension string, version int) (*PhotoFile, error) {
+	if err := ValidateResourceRole(role); err != nil {
+		return nil, err
+	}
+	photo, err := s.FindPhoto(localID)
+	if err != nil {
+		return nil, err
+	}
+	role = resourceRole(photo, role, fileExtension)
+
+	current, err := s.findFile(photo, role, fileExtension)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, ErrFileNotFound
+	}
+	if current.Version == version {
+		return s.OpenPhotoFile(localID, role, fileExtension)
+	}
+
+	record, err := s.photoRepo.FindVersion(localID, role, fileExtension, version)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrVersionNotFound
+	}
+
+	versionPath, err := s.versionPath(photo, role, fileExtension, version)
+	if err != nil {
+		return nil, err
+	}
+	file, info, err := s.fileStorage.OpenFile(versionPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	return &PhotoFile{
+		File:     file,
+		Info:     info,
+		FileName: s.versionFileName(photo, role, fileExtension, version),
+	}, nil
+}